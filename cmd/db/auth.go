@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+type access int
+
+const (
+	accessRead access = iota + 1
+	accessWrite
+	accessAdmin
+)
+
+var accessNames = map[string]access{
+	"read":  accessRead,
+	"write": accessWrite,
+	"admin": accessAdmin,
+}
+
+func (a access) String() string {
+	switch a {
+	case accessRead:
+		return "read"
+	case accessWrite:
+		return "write"
+	case accessAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+func (a *access) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	value, ok := accessNames[name]
+	if !ok {
+		return fmt.Errorf("unknown access level %q", name)
+	}
+	*a = value
+	return nil
+}
+
+// Permission grants access to every key starting with Prefix in Namespace,
+// or in every namespace if Namespace is empty. Higher access levels include
+// the lower ones: admin > write > read.
+type Permission struct {
+	Namespace string `json:"namespace,omitempty"`
+	Prefix    string `json:"prefix"`
+	Access    access `json:"access"`
+}
+
+type Token struct {
+	Name        string       `json:"name"`
+	Token       string       `json:"token"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// accessList authorizes requests by bearer token. Tokens are looked up by
+// their sha256, so the comparison does not depend on matching prefixes.
+type accessList struct {
+	tokens map[[sha256.Size]byte]*Token
+}
+
+// loadAccessList reads a JSON file of the form
+//
+//	{"tokens": [{"name": "server", "token": "...",
+//	             "permissions": [{"prefix": "", "access": "write"}]}]}
+func loadAccessList(path string) (*accessList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Tokens []*Token `json:"tokens"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %v", path, err)
+	}
+
+	acl := &accessList{tokens: make(map[[sha256.Size]byte]*Token)}
+	for _, token := range file.Tokens {
+		if token.Token == "" {
+			return nil, fmt.Errorf("token %q has an empty secret", token.Name)
+		}
+		acl.tokens[sha256.Sum256([]byte(token.Token))] = token
+	}
+	return acl, nil
+}
+
+func (t *Token) allows(namespace, resource string, required access) bool {
+	for _, p := range t.Permissions {
+		if p.Namespace != "" && p.Namespace != namespace {
+			continue
+		}
+		if p.Access >= required && strings.HasPrefix(resource, p.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks that the request carries a token with the required access
+// to resource in namespace, where an empty namespace stands for all of them.
+// On failure it writes the 401 or 403 response, logs the denial and returns
+// false. A nil accessList allows everything.
+func (acl *accessList) authorize(rw http.ResponseWriter, req *http.Request, namespace, resource string, required access) bool {
+	if acl == nil {
+		return true
+	}
+
+	secret, ok := strings.CutPrefix(req.Header.Get("authorization"), "Bearer ")
+	token := acl.tokens[sha256.Sum256([]byte(secret))]
+	if !ok || token == nil {
+		audit(req, "", namespace, resource, required, "missing or unknown token")
+		rw.Header().Set("www-authenticate", `Bearer realm="db"`)
+		writeError(rw, http.StatusUnauthorized, "unauthorized", "a valid bearer token is required")
+		return false
+	}
+	if !token.allows(namespace, resource, required) {
+		audit(req, token.Name, namespace, resource, required, "insufficient permissions")
+		writeError(rw, http.StatusForbidden, "forbidden", fmt.Sprintf("%s access to %q in namespace %q is not allowed", required, resource, namespace))
+		return false
+	}
+	return true
+}
+
+// keyAccess checks the tokens sent with AUTH by the binary and RESP
+// protocols, which only serve namespace. It returns nil for an unknown
+// token, and otherwise a function telling whether the token allows reading
+// or writing a key, which logs the denials.
+func (acl *accessList) keyAccess(protocol, namespace string) func(secret string) func(key string, write bool) bool {
+	return func(secret string) func(key string, write bool) bool {
+		token := acl.tokens[sha256.Sum256([]byte(secret))]
+		if token == nil {
+			log.Printf("audit: denied %s AUTH: unknown token", protocol)
+			return nil
+		}
+		return func(key string, write bool) bool {
+			required := accessRead
+			if write {
+				required = accessWrite
+			}
+			if token.allows(namespace, key, required) {
+				return true
+			}
+			log.Printf("audit: denied %s token=%q namespace=%q resource=%q access=%s: insufficient permissions",
+				protocol, token.Name, namespace, key, required)
+			return false
+		}
+	}
+}
+
+func audit(req *http.Request, tokenName, namespace, resource string, required access, reason string) {
+	log.Printf("audit: denied %s %s from %s token=%q namespace=%q resource=%q access=%s: %s",
+		req.Method, req.URL.Path, req.RemoteAddr, tokenName, namespace, resource, required, reason)
+}
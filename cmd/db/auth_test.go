@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testTokens = `{"tokens": [
+	{"name": "reader", "token": "read-secret", "permissions": [{"prefix": "", "access": "read"}]},
+	{"name": "team", "token": "team-secret", "permissions": [{"prefix": "team/", "access": "write"}]},
+	{"name": "ops", "token": "ops-secret", "permissions": [{"prefix": "", "access": "admin"}]},
+	{"name": "billing", "token": "billing-secret", "permissions": [{"namespace": "billing", "prefix": "", "access": "admin"}]}
+]}`
+
+func createTestAccessList(t *testing.T, content string) (*accessList, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return loadAccessList(path)
+}
+
+func TestLoadAccessList(t *testing.T) {
+	if _, err := createTestAccessList(t, `{"tokens": [{"name": "x", "token": "y", "permissions": [{"access": "root"}]}]}`); err == nil {
+		t.Error("Unknown access level was accepted")
+	}
+	if _, err := createTestAccessList(t, `{"tokens": [{"name": "x", "token": ""}]}`); err == nil {
+		t.Error("Empty token was accepted")
+	}
+}
+
+func TestHandler_Authorization(t *testing.T) {
+	acl, err := createTestAccessList(t, testTokens)
+	if err != nil {
+		t.Fatalf("Cannot load tokens: %s", err)
+	}
+	n := createTestNamespaces(t)
+	if err := n.create(NamespaceConfig{Name: "billing"}); err != nil {
+		t.Fatal(err)
+	}
+	h := newHandler(n, 1024, acl)
+
+	tests := []struct {
+		name, method, target, token string
+		status                      int
+	}{
+		{"no token", "GET", "/db/key", "", http.StatusUnauthorized},
+		{"unknown token", "GET", "/db/key", "wrong", http.StatusUnauthorized},
+		{"write with write access", "POST", "/db/team%2Fkey", "team-secret", http.StatusCreated},
+		{"write outside the prefix", "POST", "/db/other", "team-secret", http.StatusForbidden},
+		{"read with write access", "GET", "/db/team%2Fkey", "team-secret", http.StatusOK},
+		{"read with read access", "GET", "/db/team%2Fkey", "read-secret", http.StatusOK},
+		{"write with read access", "DELETE", "/db/team%2Fkey", "read-secret", http.StatusForbidden},
+		{"scan outside the prefix", "GET", "/scan", "team-secret", http.StatusForbidden},
+		{"scan inside the prefix", "GET", "/scan?prefix=team%2F", "team-secret", http.StatusOK},
+		{"admin writes anywhere", "POST", "/db/other", "ops-secret", http.StatusCreated},
+		{"namespace permission", "POST", "/db/billing/key", "billing-secret", http.StatusCreated},
+		{"outside the namespace", "GET", "/db/key", "billing-secret", http.StatusForbidden},
+		{"scan the namespace", "GET", "/scan?namespace=billing", "billing-secret", http.StatusOK},
+		{"namespace admin drops it", "DELETE", "/admin/namespaces/billing", "billing-secret", http.StatusNoContent},
+		{"listing needs global admin", "GET", "/admin/namespaces", "billing-secret", http.StatusForbidden},
+		{"global admin lists", "GET", "/admin/namespaces", "ops-secret", http.StatusOK},
+		{"create needs admin", "PUT", "/admin/namespaces/new", "team-secret", http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.target, strings.NewReader(`{"value":"v"}`))
+			if tc.token != "" {
+				req.Header.Set("authorization", "Bearer "+tc.token)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			if rr.Code != tc.status {
+				t.Fatalf("Expected status %d, got %d", tc.status, rr.Code)
+			}
+			if tc.status == http.StatusUnauthorized && rr.Header().Get("www-authenticate") == "" {
+				t.Error("401 response without a www-authenticate header")
+			}
+		})
+	}
+}
+
+func TestAccessList_KeyAccess(t *testing.T) {
+	acl, err := createTestAccessList(t, testTokens)
+	if err != nil {
+		t.Fatalf("Cannot load tokens: %s", err)
+	}
+	auth := acl.keyAccess("RESP", defaultNamespace)
+
+	if auth("wrong") != nil {
+		t.Error("Unknown token was accepted")
+	}
+	team := auth("team-secret")
+	if team == nil {
+		t.Fatal("Known token was rejected")
+	}
+	if !team("team/key", true) || team("other", false) {
+		t.Error("Key permissions do not follow the token prefix")
+	}
+	reader := auth("read-secret")
+	if !reader("key", false) || reader("key", true) {
+		t.Error("Read access allows writing")
+	}
+	if billing := auth("billing-secret"); billing("key", false) {
+		t.Error("Permissions of another namespace were applied")
+	}
+}
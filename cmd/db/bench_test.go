@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/mysteriousgophers/architecture-lab-4/datastore"
+	"github.com/mysteriousgophers/architecture-lab-4/dbproto"
+)
+
+const benchKeysCount = 100
+
+// benchTargets serves the same Db over HTTP and over the binary protocol.
+func benchTargets(b *testing.B) (*datastore.Db, string, *dbproto.Client) {
+	b.Helper()
+	n, err := openNamespaces(b.TempDir(), NamespaceConfig{SegmentSize: 10 * 1024 * 1024}, "", "", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	db, _ := n.get(defaultNamespace)
+	httpServer := httptest.NewServer(newHandler(n, 1<<20, nil))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	binServer := dbproto.NewServer(db)
+	go binServer.Serve(l)
+	client, err := dbproto.Dial(l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Cleanup(func() {
+		client.Close()
+		binServer.Close()
+		httpServer.Close()
+		n.Close()
+	})
+	for i := 0; i < benchKeysCount; i++ {
+		db.Put("key"+strconv.Itoa(i), "value"+strconv.Itoa(i))
+	}
+	return db, httpServer.URL, client
+}
+
+func BenchmarkGet(b *testing.B) {
+	_, url, client := benchTargets(b)
+
+	b.Run("http", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			resp, err := http.Get(fmt.Sprintf("%s/db/key%d", url, i%benchKeysCount))
+			if err != nil {
+				b.Fatal(err)
+			}
+			var body Response
+			json.NewDecoder(resp.Body).Decode(&body)
+			resp.Body.Close()
+		}
+	})
+
+	b.Run("binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := client.Get("key" + strconv.Itoa(i%benchKeysCount)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("binary-parallel", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				if _, err := client.Get("key" + strconv.Itoa(i%benchKeysCount)); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
+
+func BenchmarkPut(b *testing.B) {
+	_, url, client := benchTargets(b)
+
+	b.Run("http", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			body, _ := json.Marshal(Request{Value: "value"})
+			resp, err := http.Post(fmt.Sprintf("%s/db/key%d", url, i%benchKeysCount), "application/json", bytes.NewReader(body))
+			if err != nil {
+				b.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+	})
+
+	b.Run("binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := client.Put("key"+strconv.Itoa(i%benchKeysCount), "value"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
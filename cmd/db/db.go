@@ -1,73 +1,120 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/mysteriousgophers/architecture-lab-4/datastore"
+	"github.com/mysteriousgophers/architecture-lab-4/dbproto"
 	"github.com/mysteriousgophers/architecture-lab-4/httptools"
+	"github.com/mysteriousgophers/architecture-lab-4/resp"
 	"github.com/mysteriousgophers/architecture-lab-4/signal"
 	"io/ioutil"
 	"log"
-	"net/http"
+	"net"
+	"os"
 )
 
-var port = flag.Int("port", 8083, "server port")
+var (
+	port         = flag.Int("port", 8083, "server port")
+	binaryPort   = flag.Int("binary-port", 8084, "binary protocol port, 0 to disable")
+	respPort     = flag.Int("resp-port", 0, "Redis protocol (RESP2) port, 0 to disable")
+	maxBodyBytes = flag.Int64("max-body-bytes", 1<<20, "maximum size of a request body")
+	tokensFile   = flag.String("tokens-file", "", "JSON file with access tokens, authentication is disabled if empty")
 
-type Response struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
-}
-
-type Request struct {
-	Value string `json:"value"`
-}
+	dataDir         = flag.String("dir", "", "data directory with a subdirectory per namespace, a temporary one if empty")
+	segmentSize     = flag.Int64("segment-size", 250, "default segment size of new namespaces")
+	compactSegments = flag.Int("compact-segments", 0, "compact the default namespace once it has this many segments, 0 to disable")
+	compactInterval = flag.Int("compact-interval-sec", 60, "how often the default namespace is checked for compaction")
+	scrubRate       = flag.Int("scrub-rate", 0, "records per second the default namespace scrubber verifies, 0 to disable")
+	checksum        = flag.String("checksum", "sha1", "checksum of new segments in the default namespace: sha1, crc32c, fnv64a or sha256")
+	blobThreshold   = flag.Int64("blob-threshold", 0, "store values of the default namespace longer than this in blob files, 0 to disable")
+	keysFile        = flag.String("encryption-keys-file", "", "file with AES keys to encrypt segments with, the first one is current; $DB_ENCRYPTION_KEYS is used if empty")
+	replica         = flag.String("replica", "", "db replica to recover corrupt keys from, e.g. http://db-backup:8083")
+	replicaToken    = flag.String("replica-token", os.Getenv("DB_REPLICA_TOKEN"), "bearer token for the replica")
+)
 
 func main() {
-	h := new(http.ServeMux)
-	dir, err := ioutil.TempDir("", "temp-dir")
+	flag.Parse()
+	dir := *dataDir
+	if dir == "" {
+		var err error
+		if dir, err = ioutil.TempDir("", "temp-dir"); err != nil {
+			log.Fatal(err)
+		}
+	}
+	keys, err := encryptionKeys()
 	if err != nil {
 		log.Fatal(err)
 	}
-	Db, err := datastore.NewDb(dir, 250)
-	defer Db.Close()
-
-	h.HandleFunc("/db/", func(rw http.ResponseWriter, req *http.Request) {
-		url := req.URL.String()
-		key := url[4:]
+	namespaces, err := openNamespaces(dir, NamespaceConfig{
+		SegmentSize:        *segmentSize,
+		CompactSegments:    *compactSegments,
+		CompactIntervalSec: *compactInterval,
+		ScrubRate:          *scrubRate,
+		Checksum:           *checksum,
+		BlobThreshold:      *blobThreshold,
+	}, *replica, *replicaToken, keys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer namespaces.Close()
+	// The binary and RESP protocols only serve the default namespace.
+	Db, _ := namespaces.get(defaultNamespace)
 
-		switch req.Method {
-		case "GET":
-			value, err := Db.Get(key)
-			if err != nil {
-				rw.WriteHeader(http.StatusNotFound)
-				return
-			}
-			rw.WriteHeader(http.StatusOK)
-			rw.Header().Set("content-type", "application/json")
-			_ = json.NewEncoder(rw).Encode(Response{
-				Key:   key,
-				Value: value,
-			})
-		case "POST":
-			var body Request
+	var acl *accessList
+	if *tokensFile != "" {
+		if acl, err = loadAccessList(*tokensFile); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Loaded access tokens from %s", *tokensFile)
+	}
 
-			err := json.NewDecoder(req.Body).Decode(&body)
-			if err != nil {
-				rw.WriteHeader(http.StatusBadRequest)
+	if *binaryPort != 0 {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", *binaryPort))
+		if err != nil {
+			log.Fatal(err)
+		}
+		binServer := dbproto.NewServer(Db)
+		if acl != nil {
+			binServer.Auth = acl.keyAccess("binary protocol", defaultNamespace)
+		}
+		defer binServer.Close()
+		go func() {
+			log.Println("Staring the binary protocol server...")
+			if err := binServer.Serve(l); err != nil {
+				log.Fatalf("Binary protocol server finished: %s. Finishing the process.", err)
 			}
+		}()
+	}
 
-			err = Db.Put(key, body.Value)
-			if err != nil {
-				rw.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			rw.WriteHeader(http.StatusCreated)
-		default:
-			rw.WriteHeader(http.StatusBadRequest)
+	if *respPort != 0 {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", *respPort))
+		if err != nil {
+			log.Fatal(err)
+		}
+		respServer := resp.NewServer(Db)
+		if acl != nil {
+			respServer.Auth = acl.keyAccess("RESP", defaultNamespace)
 		}
-	})
+		defer respServer.Close()
+		go func() {
+			log.Println("Staring the RESP server...")
+			if err := respServer.Serve(l); err != nil {
+				log.Fatalf("RESP server finished: %s. Finishing the process.", err)
+			}
+		}()
+	}
 
-	server := httptools.CreateServer(*port, h)
+	server := httptools.CreateServer(*port, newHandler(namespaces, *maxBodyBytes, acl))
 	server.Start()
 	signal.WaitForTerminationSignal()
 }
+
+// encryptionKeys loads the keys from -encryption-keys-file or the
+// DB_ENCRYPTION_KEYS variable. No keys means segments are not encrypted.
+func encryptionKeys() ([]datastore.EncryptionKey, error) {
+	if *keysFile != "" {
+		return datastore.LoadEncryptionKeys(*keysFile)
+	}
+	return datastore.ParseEncryptionKeys(os.Getenv("DB_ENCRYPTION_KEYS"))
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/mysteriousgophers/architecture-lab-4/datastore"
+)
+
+const keyMethods = "GET, HEAD, POST, PUT, DELETE, OPTIONS"
+
+type Response struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type Request struct {
+	Value string `json:"value"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+type handler struct {
+	namespaces   *namespaces
+	maxBodyBytes int64
+	acl          *accessList
+}
+
+// newHandler serves the namespaces over HTTP. With a nil acl every request
+// is allowed.
+func newHandler(namespaces *namespaces, maxBodyBytes int64, acl *accessList) http.Handler {
+	h := &handler{namespaces: namespaces, maxBodyBytes: maxBodyBytes, acl: acl}
+
+	mux := http.NewServeMux()
+	// Keys are addressed as /db/<namespace>/<key>. A single path segment,
+	// which may contain an escaped slash, is a key in the default namespace.
+	for _, pattern := range []string{"/db/{key}", "/db/{namespace}/{key...}"} {
+		// GET patterns serve HEAD requests as well.
+		mux.HandleFunc("GET "+pattern, h.get)
+		mux.HandleFunc("POST "+pattern, h.put)
+		mux.HandleFunc("PUT "+pattern, h.put)
+		mux.HandleFunc("DELETE "+pattern, h.delete)
+		mux.HandleFunc("OPTIONS "+pattern, h.options)
+	}
+	mux.HandleFunc("/db/", h.noKey)
+	// Streams every record as a line of JSON, used to move keys between nodes.
+	mux.HandleFunc("GET /scan", h.scan)
+
+	mux.HandleFunc("GET /admin/namespaces", h.listNamespaces)
+	mux.HandleFunc("PUT /admin/namespaces/{namespace}", h.createNamespace)
+	mux.HandleFunc("DELETE /admin/namespaces/{namespace}", h.dropNamespace)
+	mux.HandleFunc("GET /admin/namespaces/{namespace}/stats", h.namespaceStats)
+	return mux
+}
+
+// key returns the requested key and the Db of its namespace once the caller
+// is allowed the required access to it.
+func (h *handler) key(rw http.ResponseWriter, req *http.Request, required access) (*datastore.Db, string, bool) {
+	key := req.PathValue("key")
+	if key == "" {
+		writeError(rw, http.StatusBadRequest, "bad_request", "key is required")
+		return nil, "", false
+	}
+	name := req.PathValue("namespace")
+	if name == "" {
+		name = defaultNamespace
+	}
+	db, ok := h.namespace(rw, req, name, key, required)
+	return db, key, ok
+}
+
+// namespace returns the Db of the named namespace once the caller is allowed
+// the required access to resource in it.
+func (h *handler) namespace(rw http.ResponseWriter, req *http.Request, name, resource string, required access) (*datastore.Db, bool) {
+	if !h.acl.authorize(rw, req, name, resource, required) {
+		return nil, false
+	}
+	db, ok := h.namespaces.get(name)
+	if !ok {
+		writeError(rw, http.StatusNotFound, "namespace_not_found", fmt.Sprintf("namespace %q does not exist", name))
+		return nil, false
+	}
+	return db, true
+}
+
+func (h *handler) get(rw http.ResponseWriter, req *http.Request) {
+	db, key, ok := h.key(rw, req, accessRead)
+	if !ok {
+		return
+	}
+	if req.Header.Get("accept") == "application/octet-stream" {
+		h.stream(rw, req, db, key)
+		return
+	}
+	value, err := db.GetContext(req.Context(), key)
+	if err != nil {
+		writeDbError(rw, err)
+		return
+	}
+	writeJSON(rw, http.StatusOK, Response{
+		Key:   key,
+		Value: value,
+	})
+}
+
+// stream writes the raw value without loading it into memory, which is how
+// values kept in blobs should be read.
+func (h *handler) stream(rw http.ResponseWriter, req *http.Request, db *datastore.Db, key string) {
+	r, size, err := db.GetReader(req.Context(), key)
+	if err != nil {
+		writeDbError(rw, err)
+		return
+	}
+	defer r.Close()
+
+	rw.Header().Set("content-type", "application/octet-stream")
+	rw.Header().Set("content-length", strconv.FormatInt(size, 10))
+	rw.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(rw, r); err != nil {
+		// The status is already sent, so the client only sees a short body.
+		log.Printf("Streaming %q failed: %s", key, err)
+	}
+}
+
+func (h *handler) put(rw http.ResponseWriter, req *http.Request) {
+	db, key, ok := h.key(rw, req, accessWrite)
+	if !ok {
+		return
+	}
+
+	var body Request
+	err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, h.maxBodyBytes)).Decode(&body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeError(rw, http.StatusRequestEntityTooLarge, "too_large", err.Error())
+		return
+	}
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, "bad_request", "invalid JSON body: "+err.Error())
+		return
+	}
+
+	if req.Header.Get("if-none-match") == "*" {
+		h.create(rw, req, db, key, body.Value)
+		return
+	}
+	if err := db.PutContext(req.Context(), key, body.Value); err != nil {
+		writeDbError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusCreated)
+}
+
+// create writes the value only if the key does not exist, answering with
+// 412 Precondition Failed otherwise. The check and the write are done in a
+// transaction, so a concurrent write of the key is never overwritten.
+func (h *handler) create(rw http.ResponseWriter, req *http.Request, db *datastore.Db, key, value string) {
+	tx := db.Begin()
+	_, err := tx.Get(key)
+	if err == nil || errors.Is(err, datastore.ErrConflict) {
+		tx.Rollback()
+		writeError(rw, http.StatusPreconditionFailed, "exists", fmt.Sprintf("key %q already exists", key))
+		return
+	}
+	if !errors.Is(err, datastore.ErrNotFound) {
+		tx.Rollback()
+		writeDbError(rw, err)
+		return
+	}
+	tx.Put(key, value)
+	err = tx.CommitContext(req.Context())
+	switch {
+	case errors.Is(err, datastore.ErrConflict):
+		writeError(rw, http.StatusPreconditionFailed, "exists", fmt.Sprintf("key %q already exists", key))
+	case err != nil:
+		writeDbError(rw, err)
+	default:
+		rw.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (h *handler) delete(rw http.ResponseWriter, req *http.Request) {
+	db, key, ok := h.key(rw, req, accessWrite)
+	if !ok {
+		return
+	}
+	if err := db.DeleteContext(req.Context(), key); err != nil {
+		writeDbError(rw, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) options(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("allow", keyMethods)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// noKey answers requests that did not match a key pattern: either the method
+// is not supported or the path has no key.
+func (h *handler) noKey(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		writeError(rw, http.StatusBadRequest, "bad_request", "key is required")
+	default:
+		rw.Header().Set("allow", keyMethods)
+		writeError(rw, http.StatusMethodNotAllowed, "method_not_allowed", req.Method+" is not supported")
+	}
+}
+
+func (h *handler) scan(rw http.ResponseWriter, req *http.Request) {
+	prefix := req.URL.Query().Get("prefix")
+	name := req.URL.Query().Get("namespace")
+	if name == "" {
+		name = defaultNamespace
+	}
+	db, ok := h.namespace(rw, req, name, prefix, accessRead)
+	if !ok {
+		return
+	}
+
+	rw.Header().Set("content-type", "application/x-ndjson")
+	encoder := json.NewEncoder(rw)
+	err := db.Scan(prefix, func(key, value string) error {
+		if err := req.Context().Err(); err != nil {
+			return err
+		}
+		return encoder.Encode(Response{Key: key, Value: value})
+	})
+	if err != nil {
+		log.Printf("Scan failed: %s", err)
+	}
+}
+
+func (h *handler) listNamespaces(rw http.ResponseWriter, req *http.Request) {
+	// Listing shows every namespace, so it needs admin access to all of them.
+	if !h.acl.authorize(rw, req, "", "", accessAdmin) {
+		return
+	}
+	writeJSON(rw, http.StatusOK, h.namespaces.list())
+}
+
+func (h *handler) createNamespace(rw http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("namespace")
+	if !h.acl.authorize(rw, req, name, "", accessAdmin) {
+		return
+	}
+
+	if !namespaceName.MatchString(name) {
+		writeError(rw, http.StatusBadRequest, "bad_request", fmt.Sprintf("invalid namespace name %q", name))
+		return
+	}
+
+	var config NamespaceConfig
+	if req.ContentLength != 0 {
+		err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, h.maxBodyBytes)).Decode(&config)
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, "bad_request", "invalid JSON body: "+err.Error())
+			return
+		}
+	}
+	config.Name = name
+	if _, err := datastore.ParseChecksum(config.Checksum); err != nil {
+		writeError(rw, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	err := h.namespaces.create(config)
+	switch {
+	case errors.Is(err, errNamespaceExists):
+		writeError(rw, http.StatusConflict, "namespace_exists", fmt.Sprintf("namespace %q already exists", name))
+	case err != nil:
+		log.Printf("Cannot create namespace %s: %s", name, err)
+		writeError(rw, http.StatusInternalServerError, "internal", err.Error())
+	default:
+		log.Printf("Created namespace %s", name)
+		rw.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (h *handler) dropNamespace(rw http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("namespace")
+	if !h.acl.authorize(rw, req, name, "", accessAdmin) {
+		return
+	}
+
+	err := h.namespaces.drop(name)
+	switch {
+	case errors.Is(err, errNamespaceNotFound):
+		writeError(rw, http.StatusNotFound, "namespace_not_found", fmt.Sprintf("namespace %q does not exist", name))
+	case errors.Is(err, errDefaultNamespace):
+		writeError(rw, http.StatusBadRequest, "bad_request", err.Error())
+	case err != nil:
+		log.Printf("Cannot drop namespace %s: %s", name, err)
+		writeError(rw, http.StatusInternalServerError, "internal", err.Error())
+	default:
+		log.Printf("Dropped namespace %s", name)
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (h *handler) namespaceStats(rw http.ResponseWriter, req *http.Request) {
+	db, ok := h.namespace(rw, req, req.PathValue("namespace"), "", accessAdmin)
+	if !ok {
+		return
+	}
+	writeJSON(rw, http.StatusOK, db.Stats())
+}
+
+func writeJSON(rw http.ResponseWriter, status int, body any) {
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(body)
+}
+
+func writeError(rw http.ResponseWriter, status int, code, message string) {
+	writeJSON(rw, status, ErrorResponse{Error: message, Code: code})
+}
+
+func writeDbError(rw http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, datastore.ErrNotFound):
+		writeError(rw, http.StatusNotFound, "not_found", err.Error())
+	case errors.Is(err, datastore.ErrHashMismatch):
+		writeError(rw, http.StatusInternalServerError, "hash_mismatch", err.Error())
+	case errors.Is(err, datastore.ErrClosed), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		writeError(rw, http.StatusServiceUnavailable, "unavailable", err.Error())
+	default:
+		log.Printf("Database error: %s", err)
+		writeError(rw, http.StatusInternalServerError, "internal", err.Error())
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mysteriousgophers/architecture-lab-4/datastore"
+)
+
+func createTestNamespaces(t testing.TB) *namespaces {
+	t.Helper()
+	n, err := openNamespaces(t.TempDir(), NamespaceConfig{SegmentSize: 1024}, "", "", nil)
+	if err != nil {
+		t.Fatalf("Failed to open namespaces: %v", err)
+	}
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+func createTestHandler(t *testing.T) (http.Handler, *datastore.Db) {
+	t.Helper()
+	n := createTestNamespaces(t)
+	db, _ := n.get(defaultNamespace)
+	return newHandler(n, 64, nil), db
+}
+
+func serve(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func decodeError(t *testing.T, rr *httptest.ResponseRecorder) ErrorResponse {
+	t.Helper()
+	if ct := rr.Header().Get("content-type"); ct != "application/json" {
+		t.Errorf("Unexpected error content type %q", ct)
+	}
+	var body ErrorResponse
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+		t.Fatalf("Error body is not JSON: %s", err)
+	}
+	return body
+}
+
+func TestHandler_Keys(t *testing.T) {
+	h, db := createTestHandler(t)
+
+	rr := serve(h, "POST", "/db/team%2Fa%20b?ignored=1", `{"value":"v1"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Unexpected put status %d", rr.Code)
+	}
+	if value, err := db.Get("team/a b"); err != nil || value != "v1" {
+		t.Fatalf("Key was not unescaped: %q, %v", value, err)
+	}
+
+	rr = serve(h, "GET", "/db/team%2Fa%20b?x=y", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Unexpected get status %d", rr.Code)
+	}
+	if ct := rr.Header().Get("content-type"); ct != "application/json" {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+	var body Response
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Key != "team/a b" || body.Value != "v1" {
+		t.Errorf("Unexpected response %+v", body)
+	}
+
+	if rr = serve(h, "HEAD", "/db/team%2Fa%20b", ""); rr.Code != http.StatusOK {
+		t.Errorf("Unexpected HEAD status %d", rr.Code)
+	}
+
+	if rr = serve(h, "DELETE", "/db/team%2Fa%20b", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("Unexpected delete status %d", rr.Code)
+	}
+	rr = serve(h, "GET", "/db/team%2Fa%20b", "")
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("Unexpected status for a deleted key %d", rr.Code)
+	}
+	if body := decodeError(t, rr); body.Code != "not_found" {
+		t.Errorf("Unexpected error code %q", body.Code)
+	}
+}
+
+func TestHandler_IfNoneMatch(t *testing.T) {
+	h, db := createTestHandler(t)
+	create := func(value string) int {
+		req := httptest.NewRequest("PUT", "/db/key", strings.NewReader(`{"value":"`+value+`"}`))
+		req.Header.Set("if-none-match", "*")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := create("first"); code != http.StatusCreated {
+		t.Fatalf("Unexpected status for a new key %d", code)
+	}
+	if code := create("second"); code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for an existing key, got %d", code)
+	}
+	if value, err := db.Get("key"); err != nil || value != "first" {
+		t.Errorf("Existing key was overwritten: %q, %v", value, err)
+	}
+}
+
+func TestHandler_Errors(t *testing.T) {
+	h, _ := createTestHandler(t)
+
+	tests := []struct {
+		name, method, target, body string
+		status                     int
+		code                       string
+	}{
+		{"bad json", "POST", "/db/key", `{"value":`, http.StatusBadRequest, "bad_request"},
+		{"body too large", "POST", "/db/key", `{"value":"` + strings.Repeat("x", 100) + `"}`, http.StatusRequestEntityTooLarge, "too_large"},
+		{"empty key", "GET", "/db/", "", http.StatusBadRequest, "bad_request"},
+		{"unsupported method", "PATCH", "/db/key", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := serve(h, tc.method, tc.target, tc.body)
+			if rr.Code != tc.status {
+				t.Fatalf("Expected status %d, got %d", tc.status, rr.Code)
+			}
+			if body := decodeError(t, rr); body.Code != tc.code {
+				t.Errorf("Expected error code %q, got %q", tc.code, body.Code)
+			}
+		})
+	}
+
+	rr := serve(h, "OPTIONS", "/db/key", "")
+	if rr.Code != http.StatusNoContent || rr.Header().Get("allow") != keyMethods {
+		t.Errorf("Unexpected OPTIONS response %d %q", rr.Code, rr.Header().Get("allow"))
+	}
+}
+
+func TestWriteDbError(t *testing.T) {
+	for err, status := range map[error]int{
+		datastore.ErrNotFound:     http.StatusNotFound,
+		datastore.ErrHashMismatch: http.StatusInternalServerError,
+		datastore.ErrClosed:       http.StatusServiceUnavailable,
+	} {
+		rr := httptest.NewRecorder()
+		writeDbError(rr, err)
+		if rr.Code != status {
+			t.Errorf("Expected status %d for %q, got %d", status, err, rr.Code)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	writeDbError(rr, datastore.ErrHashMismatch)
+	if body := decodeError(t, rr); body.Code != "hash_mismatch" {
+		t.Errorf("Unexpected error code %q", body.Code)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mysteriousgophers/architecture-lab-4/datastore"
+	"github.com/mysteriousgophers/architecture-lab-4/dbclient"
+)
+
+const (
+	defaultNamespace = "default"
+	namespaceFile    = "namespace.json"
+)
+
+var (
+	errNamespaceExists   = errors.New("namespace already exists")
+	errNamespaceNotFound = errors.New("namespace does not exist")
+	errDefaultNamespace  = errors.New("the default namespace cannot be dropped")
+
+	namespaceName = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+)
+
+// NamespaceConfig describes one logical database. It is stored next to the
+// segments, so namespaces survive a restart with the same -dir.
+type NamespaceConfig struct {
+	Name        string `json:"name"`
+	SegmentSize int64  `json:"segmentSize"`
+	// CompactSegments enables background compaction once the namespace has
+	// that many segments, checked every CompactIntervalSec seconds.
+	CompactSegments    int `json:"compactSegments,omitempty"`
+	CompactIntervalSec int `json:"compactIntervalSec,omitempty"`
+	// ScrubRate enables background verification of every record at that
+	// many records per second.
+	ScrubRate int `json:"scrubRate,omitempty"`
+	// Checksum names the algorithm new segments use, see
+	// datastore.ParseChecksum.
+	Checksum string `json:"checksum,omitempty"`
+	// BlobThreshold moves values longer than that many bytes to blob files.
+	BlobThreshold int64 `json:"blobThreshold,omitempty"`
+}
+
+// namespaces keeps one datastore.Db per namespace, each in its own
+// subdirectory of root. Corrupt keys are recovered from replica if it is set,
+// authenticating with replicaToken, and all namespaces are encrypted if keys
+// are given.
+type namespaces struct {
+	root         string
+	defaults     NamespaceConfig
+	replica      string
+	replicaToken string
+	keys         []datastore.EncryptionKey
+
+	mu  sync.RWMutex
+	dbs map[string]*namespace
+}
+
+type namespace struct {
+	config NamespaceConfig
+	db     *datastore.Db
+}
+
+// openNamespaces opens every namespace found under root and creates the
+// default one if it does not exist yet. The default namespace always uses
+// the defaults config, which replaces the stored one if they differ.
+func openNamespaces(root string, defaults NamespaceConfig, replica, replicaToken string, keys []datastore.EncryptionKey) (*namespaces, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &namespaces{
+		root:         root,
+		defaults:     defaults,
+		replica:      replica,
+		replicaToken: replicaToken,
+		keys:         keys,
+		dbs:          make(map[string]*namespace),
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(root, entry.Name(), namespaceFile))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			n.Close()
+			return nil, err
+		}
+		var config NamespaceConfig
+		if err := json.Unmarshal(data, &config); err != nil {
+			n.Close()
+			return nil, fmt.Errorf("cannot parse the config of namespace %s: %v", entry.Name(), err)
+		}
+		config.Name = entry.Name()
+		stored := config
+		if config.Name == defaultNamespace {
+			config = defaults
+			config.Name = defaultNamespace
+		}
+		if err := n.open(config); err != nil {
+			n.Close()
+			return nil, err
+		}
+		if config != stored {
+			log.Printf("Config of namespace %s changed from %+v to %+v", config.Name, stored, config)
+			if err := writeConfig(filepath.Join(root, config.Name), config); err != nil {
+				n.Close()
+				return nil, err
+			}
+		}
+	}
+
+	if _, ok := n.dbs[defaultNamespace]; !ok {
+		defaults.Name = defaultNamespace
+		if err := n.create(defaults); err != nil {
+			n.Close()
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (n *namespaces) open(config NamespaceConfig) error {
+	opts, err := n.options(config)
+	if err != nil {
+		return fmt.Errorf("invalid config of namespace %s: %v", config.Name, err)
+	}
+	db, err := datastore.NewDb(filepath.Join(n.root, config.Name), config.SegmentSize, opts...)
+	if err != nil {
+		return fmt.Errorf("cannot open namespace %s: %v", config.Name, err)
+	}
+	n.dbs[config.Name] = &namespace{config: config, db: db}
+	return nil
+}
+
+func (n *namespaces) options(c NamespaceConfig) ([]datastore.Option, error) {
+	checksum, err := datastore.ParseChecksum(c.Checksum)
+	if err != nil {
+		return nil, err
+	}
+	opts := []datastore.Option{datastore.WithChecksum(checksum)}
+	if len(n.keys) > 0 {
+		opts = append(opts, datastore.WithEncryption(n.keys...))
+	}
+	if c.BlobThreshold > 0 {
+		opts = append(opts, datastore.WithBlobs(c.BlobThreshold))
+	}
+	if c.CompactSegments > 0 {
+		interval := time.Duration(c.CompactIntervalSec) * time.Second
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		opts = append(opts, datastore.WithCompaction(c.CompactSegments, interval))
+	}
+	if c.ScrubRate > 0 {
+		scrub := datastore.ScrubOptions{
+			Rate: c.ScrubRate,
+			OnCorrupt: func(key string, err error) {
+				log.Printf("Scrubber found corrupt key %q in namespace %s: %s", key, c.Name, err)
+			},
+		}
+		if n.replica != "" {
+			replica := dbclient.New(n.replica, dbclient.Options{Token: n.replicaToken, Namespace: c.Name})
+			scrub.Recoverer = datastore.RecovererFunc(replica.Get)
+		}
+		opts = append(opts, datastore.WithScrubber(scrub))
+	}
+	return opts, nil
+}
+
+func (n *namespaces) get(name string) (*datastore.Db, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	ns, ok := n.dbs[name]
+	if !ok {
+		return nil, false
+	}
+	return ns.db, true
+}
+
+func (n *namespaces) list() []NamespaceConfig {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	configs := make([]NamespaceConfig, 0, len(n.dbs))
+	for _, ns := range n.dbs {
+		configs = append(configs, ns.config)
+	}
+	sort.Slice(configs, func(i, j int) bool { return configs[i].Name < configs[j].Name })
+	return configs
+}
+
+// create adds a namespace. A zero SegmentSize is taken from the defaults.
+func (n *namespaces) create(config NamespaceConfig) error {
+	if !namespaceName.MatchString(config.Name) {
+		return fmt.Errorf("invalid namespace name %q", config.Name)
+	}
+	if config.SegmentSize <= 0 {
+		config.SegmentSize = n.defaults.SegmentSize
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.dbs[config.Name]; ok {
+		return errNamespaceExists
+	}
+
+	// The config is written only once the namespace opens with it, so a
+	// rejected config is not left behind to fail every restart.
+	dir := filepath.Join(n.root, config.Name)
+	_, err := os.Stat(dir)
+	created := os.IsNotExist(err)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if err := n.open(config); err != nil {
+		if created {
+			os.RemoveAll(dir)
+		}
+		return err
+	}
+	if err := writeConfig(dir, config); err != nil {
+		n.dbs[config.Name].db.Close()
+		delete(n.dbs, config.Name)
+		if created {
+			os.RemoveAll(dir)
+		}
+		return err
+	}
+	return nil
+}
+
+func writeConfig(dir string, config NamespaceConfig) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, namespaceFile), data, 0o644)
+}
+
+// drop closes the namespace and removes its data. Requests still holding its
+// Db get datastore.ErrClosed.
+func (n *namespaces) drop(name string) error {
+	if name == defaultNamespace {
+		return errDefaultNamespace
+	}
+
+	n.mu.Lock()
+	ns, ok := n.dbs[name]
+	if !ok {
+		n.mu.Unlock()
+		return errNamespaceNotFound
+	}
+	delete(n.dbs, name)
+	n.mu.Unlock()
+
+	if err := ns.db.Close(); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(n.root, name))
+}
+
+func (n *namespaces) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var firstErr error
+	for _, ns := range n.dbs {
+		if err := ns.db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mysteriousgophers/architecture-lab-4/datastore"
+)
+
+func TestHandler_Namespaces(t *testing.T) {
+	n := createTestNamespaces(t)
+	h := newHandler(n, 1024, nil)
+
+	if rr := serve(h, "PUT", "/admin/namespaces/team-a", `{"segmentSize": 64}`); rr.Code != http.StatusCreated {
+		t.Fatalf("Unexpected create status %d", rr.Code)
+	}
+	if rr := serve(h, "PUT", "/admin/namespaces/team-a", ""); rr.Code != http.StatusConflict {
+		t.Errorf("Unexpected status for an existing namespace %d", rr.Code)
+	}
+	if rr := serve(h, "PUT", "/admin/namespaces/bad.name", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected status for an invalid name %d", rr.Code)
+	}
+	if rr := serve(h, "PUT", "/admin/namespaces/team-b", `{"checksum": "md4"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected status for an unknown checksum %d", rr.Code)
+	}
+
+	serve(h, "POST", "/db/key", `{"value":"default"}`)
+	serve(h, "POST", "/db/team-a/key", `{"value":"team"}`)
+	for target, want := range map[string]string{"/db/key": "default", "/db/team-a/key": "team"} {
+		rr := serve(h, "GET", target, "")
+		var body Response
+		if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Key != "key" || body.Value != want {
+			t.Errorf("Unexpected response for %s: %+v", target, body)
+		}
+	}
+
+	rr := serve(h, "GET", "/db/missing/key", "")
+	if body := decodeError(t, rr); rr.Code != http.StatusNotFound || body.Code != "namespace_not_found" {
+		t.Errorf("Unexpected response for a missing namespace %d %q", rr.Code, body.Code)
+	}
+
+	rr = serve(h, "GET", "/admin/namespaces", "")
+	var list []NamespaceConfig
+	if err := json.NewDecoder(rr.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "default" || list[1].Name != "team-a" || list[1].SegmentSize != 64 {
+		t.Errorf("Unexpected namespaces %+v", list)
+	}
+
+	rr = serve(h, "GET", "/admin/namespaces/team-a/stats", "")
+	var stats datastore.Stats
+	if err := json.NewDecoder(rr.Body).Decode(&stats); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("Unexpected stats response %d: %v", rr.Code, err)
+	}
+	if stats.Segments != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	if rr := serve(h, "DELETE", "/admin/namespaces/default", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("Default namespace was dropped: %d", rr.Code)
+	}
+	if rr := serve(h, "DELETE", "/admin/namespaces/team-a", ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("Unexpected drop status %d", rr.Code)
+	}
+	if rr := serve(h, "GET", "/db/team-a/key", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Dropped namespace still serves keys: %d", rr.Code)
+	}
+}
+
+func TestHandler_Stream(t *testing.T) {
+	n := createTestNamespaces(t)
+	if err := n.create(NamespaceConfig{Name: "files", BlobThreshold: 16}); err != nil {
+		t.Fatal(err)
+	}
+	h := newHandler(n, 1024, nil)
+	value := strings.Repeat("0123456789", 20)
+	if rr := serve(h, "PUT", "/db/files/big", `{"value":"`+value+`"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("Unexpected put status %d", rr.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/db/files/big", nil)
+	req.Header.Set("accept", "application/octet-stream")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != value {
+		t.Errorf("Unexpected stream %d %q", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("content-length") != "200" || rr.Header().Get("content-type") != "application/octet-stream" {
+		t.Errorf("Unexpected headers %v", rr.Header())
+	}
+}
+
+func TestOpenNamespaces_Reopen(t *testing.T) {
+	root := t.TempDir()
+	n, err := openNamespaces(root, NamespaceConfig{SegmentSize: 1024}, "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.create(NamespaceConfig{Name: "logs", SegmentSize: 128, CompactSegments: 4, Checksum: "crc32c"}); err != nil {
+		t.Fatal(err)
+	}
+	db, _ := n.get("logs")
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	n.Close()
+
+	n, err = openNamespaces(root, NamespaceConfig{SegmentSize: 1024}, "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	db, ok := n.get("logs")
+	if !ok {
+		t.Fatal("Namespace was not reopened")
+	}
+	if value, err := db.Get("key"); err != nil || value != "value" {
+		t.Errorf("Unexpected value after reopening: %q, %v", value, err)
+	}
+	if list := n.list(); len(list) != 2 || list[1].SegmentSize != 128 || list[1].CompactSegments != 4 || list[1].Checksum != "crc32c" {
+		t.Errorf("Config was not kept: %+v", list)
+	}
+}
+
+func TestOpenNamespaces_DefaultsChanged(t *testing.T) {
+	root := t.TempDir()
+	n, err := openNamespaces(root, NamespaceConfig{SegmentSize: 1024}, "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Close()
+
+	defaults := NamespaceConfig{SegmentSize: 2048, CompactSegments: 3, Checksum: "crc32c"}
+	n, err = openNamespaces(root, defaults, "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	defaults.Name = defaultNamespace
+	if list := n.list(); len(list) != 1 || list[0] != defaults {
+		t.Errorf("Default namespace does not use the new defaults: %+v", list)
+	}
+	data, err := os.ReadFile(filepath.Join(root, defaultNamespace, namespaceFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored NamespaceConfig
+	if err := json.Unmarshal(data, &stored); err != nil || stored != defaults {
+		t.Errorf("Stored config was not updated: %+v, %v", stored, err)
+	}
+}
+
+func TestNamespaces_CreateRejectedConfig(t *testing.T) {
+	root := t.TempDir()
+	keys := []datastore.EncryptionKey{{ID: 1, Key: make([]byte, 32)}}
+	n, err := openNamespaces(root, NamespaceConfig{SegmentSize: 1024}, "", "", keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Blobs are not encrypted, so the datastore refuses them with keys.
+	if err := n.create(NamespaceConfig{Name: "blobs", BlobThreshold: 64}); err == nil {
+		t.Fatal("Blobs were accepted together with encryption")
+	}
+	if _, ok := n.get("blobs"); ok {
+		t.Error("Rejected namespace is served")
+	}
+	n.Close()
+
+	n, err = openNamespaces(root, NamespaceConfig{SegmentSize: 1024}, "", "", keys)
+	if err != nil {
+		t.Fatalf("Rejected namespace breaks reopening: %v", err)
+	}
+	defer n.Close()
+	if err := n.create(NamespaceConfig{Name: "blobs"}); err != nil {
+		t.Errorf("Name of the rejected namespace cannot be reused: %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// BackendStatus is a backend as listed by GET /admin/backends. Healthy tells
+// whether it gets requests, Active is the number of requests in progress,
+// Drained tells that a draining backend has none left, Health is the result
+// of its health checks, "pending" until its first probe, and Breaker is the
+// state of its circuit breaker.
+type BackendStatus struct {
+	Backend
+	Healthy  bool   `json:"healthy"`
+	Traffic  int64  `json:"traffic"`
+	Active   int64  `json:"active"`
+	Draining bool   `json:"draining,omitempty"`
+	Drained  bool   `json:"drained,omitempty"`
+	Health   string `json:"health,omitempty"`
+	Breaker  string `json:"breaker,omitempty"`
+}
+
+// backendEndpoints are the admin endpoints of a pool, under /admin for the
+// default pool and under /admin/pools/{pool} for every pool.
+var backendEndpoints = []struct {
+	method, path string
+	handle       func(*Balancer, http.ResponseWriter, *http.Request)
+}{
+	{"GET", "/backends", (*Balancer).listBackends},
+	{"POST", "/backends", (*Balancer).addBackendHandler},
+	{"GET", "/backends/{address}", (*Balancer).getBackend},
+	{"DELETE", "/backends/{address}", (*Balancer).removeBackendHandler},
+	{"POST", "/backends/{address}/drain", (*Balancer).drainBackend},
+	{"DELETE", "/backends/{address}/drain", (*Balancer).undrainBackend},
+}
+
+// handler forwards every request to the pool.
+func (b *Balancer) handler() http.Handler {
+	return http.HandlerFunc(b.serve)
+}
+
+// adminHandler serves the admin endpoints. They are kept off the handler
+// of the public listener, so they are only reachable on -admin-addr.
+func (b *Balancer) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	for _, e := range backendEndpoints {
+		mux.HandleFunc(e.method+" /admin"+e.path, func(rw http.ResponseWriter, r *http.Request) {
+			e.handle(b, rw, r)
+		})
+	}
+	return mux
+}
+
+// status describes a server of the pool. The caller holds b.lock.
+func (b *Balancer) status(server string) BackendStatus {
+	_, draining := b.draining[server]
+	status := BackendStatus{
+		Backend:  b.backends[server],
+		Healthy:  b.inRotation(server),
+		Traffic:  b.serverTraffic[server],
+		Active:   b.active[server],
+		Draining: draining,
+		Drained:  draining && b.active[server] == 0,
+	}
+	if state, ok := b.health[server]; ok {
+		status.Health = map[bool]string{true: "up", false: "down"}[state.healthy]
+	} else if b.healthChecks != nil {
+		status.Health = "pending"
+	}
+	if b.breakerEnabled() {
+		status.Breaker = b.breakerState(server).String()
+	}
+	return status
+}
+
+func (b *Balancer) backendStatuses() []BackendStatus {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	statuses := make([]BackendStatus, len(b.pool))
+	for i, server := range b.pool {
+		statuses[i] = b.status(server)
+	}
+	return statuses
+}
+
+func (b *Balancer) backendStatus(server string) (BackendStatus, bool) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if _, ok := b.backends[server]; !ok {
+		return BackendStatus{}, false
+	}
+	return b.status(server), true
+}
+
+func (b *Balancer) listBackends(rw http.ResponseWriter, r *http.Request) {
+	writeJSON(rw, http.StatusOK, b.backendStatuses())
+}
+
+func (b *Balancer) getBackend(rw http.ResponseWriter, r *http.Request) {
+	status, ok := b.backendStatus(r.PathValue("address"))
+	if !ok {
+		http.Error(rw, errBackendNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(rw, http.StatusOK, status)
+}
+
+func (b *Balancer) addBackendHandler(rw http.ResponseWriter, r *http.Request) {
+	var backend Backend
+	if err := json.NewDecoder(r.Body).Decode(&backend); err != nil {
+		http.Error(rw, "invalid backend: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateBackends([]Backend{backend}); err != nil {
+		http.Error(rw, "invalid backend: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := b.addBackend(backend); err != nil {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+	status, _ := b.backendStatus(backend.Address)
+	writeJSON(rw, http.StatusCreated, status)
+}
+
+func (b *Balancer) removeBackendHandler(rw http.ResponseWriter, r *http.Request) {
+	if err := b.removeBackend(r.PathValue("address")); err != nil {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// drainBackend starts draining a backend and responds with its status. With
+// ?wait=true it responds only once the backend is drained.
+func (b *Balancer) drainBackend(rw http.ResponseWriter, r *http.Request) {
+	server := r.PathValue("address")
+	drained, err := b.drain(server)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if r.URL.Query().Get("wait") == "true" {
+		// Draining may take longer than the write timeout of the server.
+		_ = http.NewResponseController(rw).SetWriteDeadline(time.Time{})
+		select {
+		case <-drained:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	status, ok := b.backendStatus(server)
+	if !ok {
+		http.Error(rw, errBackendNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(rw, http.StatusOK, status)
+}
+
+func (b *Balancer) undrainBackend(rw http.ResponseWriter, r *http.Request) {
+	server := r.PathValue("address")
+	if err := b.undrain(server); err != nil {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	status, _ := b.backendStatus(server)
+	writeJSON(rw, http.StatusOK, status)
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v any) {
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		log.Printf("Failed to write response: %s", err)
+	}
+}
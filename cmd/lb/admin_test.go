@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mysteriousgophers/architecture-lab-4/httptools"
+)
+
+// blockingSender holds every request until release is closed.
+type blockingSender struct {
+	started chan string
+	release chan struct{}
+}
+
+func newBlockingSender() *blockingSender {
+	return &blockingSender{started: make(chan string, 10), release: make(chan struct{})}
+}
+
+func (s *blockingSender) Send(req *http.Request) (*http.Response, error) {
+	s.started <- req.URL.Host
+	<-s.release
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader("OK")),
+		Request:    req,
+	}, nil
+}
+
+func adminRequest(t *testing.T, h http.Handler, method, path, body string) (int, BackendStatus) {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+	var status BackendStatus
+	if strings.HasPrefix(rr.Header().Get("content-type"), "application/json") {
+		if err := json.NewDecoder(rr.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rr.Code, status
+}
+
+func TestAdmin_AddRemoveBackend(t *testing.T) {
+	balancer := NewBalancer([]string{"server1"}, &MockHealthChecker{}, &MockRequestSender{}, time.Second, false)
+	h := balancer.adminHandler()
+
+	code, status := adminRequest(t, h, "POST", "/admin/backends", `{"address": "server2:8080", "weight": 2}`)
+	if code != http.StatusCreated {
+		t.Fatalf("Expected status Created, got %d", code)
+	}
+	if expected := (BackendStatus{Backend: Backend{Address: "server2:8080", Weight: 2}, Healthy: true}); !reflect.DeepEqual(status, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, status)
+	}
+	if expected := []string{"server1", "server2:8080"}; !reflect.DeepEqual(balancer.healthyPool, expected) {
+		t.Errorf("Expected healthy pool %v, got %v", expected, balancer.healthyPool)
+	}
+
+	if code, _ := adminRequest(t, h, "POST", "/admin/backends", `{"address": "server2:8080"}`); code != http.StatusConflict {
+		t.Errorf("Expected status Conflict for a duplicate, got %d", code)
+	}
+	if code, _ := adminRequest(t, h, "POST", "/admin/backends", `{"weight": 1}`); code != http.StatusBadRequest {
+		t.Errorf("Expected status Bad Request without an address, got %d", code)
+	}
+
+	if code, _ := adminRequest(t, h, "DELETE", "/admin/backends/server1", ""); code != http.StatusNoContent {
+		t.Errorf("Expected status No Content, got %d", code)
+	}
+	if code, _ := adminRequest(t, h, "DELETE", "/admin/backends/server1", ""); code != http.StatusNotFound {
+		t.Errorf("Expected status Not Found, got %d", code)
+	}
+	if expected := []string{"server2:8080"}; !reflect.DeepEqual(balancer.pool, expected) || !reflect.DeepEqual(balancer.healthyPool, expected) {
+		t.Errorf("Expected pool %v, got %v and healthy %v", expected, balancer.pool, balancer.healthyPool)
+	}
+}
+
+func TestAdmin_DrainBackend(t *testing.T) {
+	sender := newBlockingSender()
+	balancer := NewBalancer([]string{"server1", "server2"}, &MockHealthChecker{}, sender, time.Second, false)
+	h := balancer.adminHandler()
+
+	forwarded := make(chan struct{})
+	go func() {
+		balancer.forward("server1", httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		close(forwarded)
+	}()
+	<-sender.started
+
+	code, status := adminRequest(t, h, "POST", "/admin/backends/server1/drain", "")
+	if code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %d", code)
+	}
+	if !status.Draining || status.Drained || status.Active != 1 || status.Healthy {
+		t.Errorf("Expected a draining backend with one request in progress, got %+v", status)
+	}
+	for _, chosen := range chooseMany(balancer, 5) {
+		if chosen != "server2" {
+			t.Fatalf("Expected the draining server to get no requests, got %q", chosen)
+		}
+	}
+
+	waited := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("POST", "/admin/backends/server1/drain?wait=true", nil))
+		waited <- rr
+	}()
+	select {
+	case <-waited:
+		t.Fatal("Drain returned before the request in progress finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(sender.release)
+	<-forwarded
+	rr := <-waited
+	if err := json.NewDecoder(rr.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Drained || status.Active != 0 {
+		t.Errorf("Expected a drained backend, got %+v", status)
+	}
+
+	code, status = adminRequest(t, h, "DELETE", "/admin/backends/server1/drain", "")
+	if code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %d", code)
+	}
+	if status.Draining || !status.Healthy {
+		t.Errorf("Expected the backend back in rotation, got %+v", status)
+	}
+	if expected := []string{"server1", "server2"}; !reflect.DeepEqual(balancer.healthyPool, expected) {
+		t.Errorf("Expected healthy pool %v, got %v", expected, balancer.healthyPool)
+	}
+}
+
+func TestAdmin_DrainOutlastsTimeouts(t *testing.T) {
+	sender := newBlockingSender()
+	balancer := NewBalancer([]string{"server1"}, &MockHealthChecker{}, sender, time.Second, false)
+	go balancer.forward("server1", httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	<-sender.started
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptools.NewHTTPServer("", balancer.adminHandler(), nil)
+	server.ReadTimeout, server.WriteTimeout = 100*time.Millisecond, 100*time.Millisecond
+	go server.Serve(ln)
+	defer server.Close()
+
+	// The request in progress finishes well after the server timeouts.
+	time.AfterFunc(300*time.Millisecond, func() { close(sender.release) })
+	resp, err := http.Post("http://"+ln.Addr().String()+"/admin/backends/server1/drain?wait=true", "", nil)
+	if err != nil {
+		t.Fatalf("Drain response was lost: %v", err)
+	}
+	defer resp.Body.Close()
+	var status BackendStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !status.Drained {
+		t.Errorf("Expected a drained backend, got %d %+v", resp.StatusCode, status)
+	}
+}
+
+func TestAdmin_DrainKeptByHealthCheck(t *testing.T) {
+	balancer := NewBalancer([]string{"server1", "server2"}, &MockHealthChecker{}, &MockRequestSender{}, time.Second, false)
+	if _, err := balancer.drain("server1"); err != nil {
+		t.Fatal(err)
+	}
+
+	balancer.recordProbe("server1", true)
+	balancer.setBackends([]Backend{{Address: "server1"}, {Address: "server2"}})
+
+	if expected := []string{"server2"}; !reflect.DeepEqual(balancer.healthyPool, expected) {
+		t.Errorf("Expected healthy pool %v, got %v", expected, balancer.healthyPool)
+	}
+	if _, err := balancer.drain("server3"); err != errBackendNotFound {
+		t.Errorf("Expected errBackendNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// AffinityConfig pins clients to backends. With "cookie" the balancer sets
+// a cookie naming the backend that served the client, with "header" clients
+// sending the same value of a header, such as lb-author, share a backend,
+// and with "ip" clients are pinned by their address. Requests without
+// affinity, and those whose backend is out of rotation, go to the server
+// the strategy picks.
+type AffinityConfig struct {
+	Mode   string
+	Cookie string
+	Header string
+}
+
+func parseAffinity(mode, cookie, header string) (AffinityConfig, error) {
+	switch mode {
+	case "", "cookie", "header", "ip":
+	default:
+		return AffinityConfig{}, fmt.Errorf("unknown affinity %q, expected cookie, header or ip", mode)
+	}
+	if mode == "cookie" && cookie == "" || mode == "header" && header == "" {
+		return AffinityConfig{}, fmt.Errorf("%s affinity needs a %s name", mode, mode)
+	}
+	return AffinityConfig{Mode: mode, Cookie: cookie, Header: header}, nil
+}
+
+// serverToken names a server in affinity cookies without revealing its
+// address.
+func serverToken(server string) string {
+	h := fnv.New64a()
+	h.Write([]byte(server))
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+func affinityScore(key, server string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(server))
+	return h.Sum64()
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// affinityServer returns the healthy server the request is pinned to, or ""
+// if it has none. Header and IP affinity use rendezvous hashing, so when a
+// server leaves only its own clients move, and they come back once it
+// returns.
+func (b *Balancer) affinityServer(r *http.Request, exclude []string) string {
+	var key string
+	switch b.affinity.Mode {
+	case "cookie":
+		cookie, err := r.Cookie(b.affinity.Cookie)
+		if err != nil {
+			return ""
+		}
+		b.lock.RLock()
+		defer b.lock.RUnlock()
+		for _, server := range b.healthyPool {
+			if serverToken(server) == cookie.Value && !slices.Contains(exclude, server) {
+				return server
+			}
+		}
+		return ""
+	case "header":
+		key = r.Header.Get(b.affinity.Header)
+	case "ip":
+		key = clientIP(r)
+	}
+	if key == "" {
+		return ""
+	}
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	var best string
+	var bestScore uint64
+	for _, server := range b.healthyPool {
+		if slices.Contains(exclude, server) {
+			continue
+		}
+		if score := affinityScore(key, server); best == "" || score > bestScore {
+			best, bestScore = server, score
+		}
+	}
+	return best
+}
+
+// chooseFor picks the server for a request, following its affinity or
+// else the strategy.
+func (b *Balancer) chooseFor(r *http.Request, strategy Strategy, exclude ...string) string {
+	if server := b.affinityServer(r, exclude); server != "" {
+		return server
+	}
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.choose(strategy, exclude)
+}
+
+// pin sets the affinity cookie for server unless the request already has
+// it. Cookies set for earlier attempts of the request are replaced.
+func (b *Balancer) pin(rw http.ResponseWriter, r *http.Request, server string) {
+	if b.affinity.Mode != "cookie" {
+		return
+	}
+	rw.Header().Del("Set-Cookie")
+	token := serverToken(server)
+	if cookie, err := r.Cookie(b.affinity.Cookie); err == nil && cookie.Value == token {
+		return
+	}
+	http.SetCookie(rw, &http.Cookie{
+		Name:     b.affinity.Cookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
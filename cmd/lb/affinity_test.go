@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newAffinityBalancer(t *testing.T, mode string) (*Balancer, *hostSender) {
+	t.Helper()
+	affinity, err := parseAffinity(mode, "lb-server", "lb-author")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := &hostSender{down: make(map[string]bool)}
+	balancer := newRetryBalancer(sender, "server1", "server2", "server3")
+	balancer.affinity = affinity
+	return balancer, sender
+}
+
+func serveRequest(b *Balancer, r *http.Request) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	b.serve(rr, r)
+	return rr
+}
+
+func TestAffinity_Header(t *testing.T) {
+	balancer, _ := newAffinityBalancer(t, "header")
+
+	servers := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		author := fmt.Sprintf("author%d", i%4)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("lb-author", author)
+		server := serveRequest(balancer, req).Body.String()
+		if pinned, ok := servers[author]; ok && pinned != server {
+			t.Fatalf("Expected %s to stay on %s, got %s", author, pinned, server)
+		}
+		servers[author] = server
+	}
+
+	// Without the header the strategy picks the server.
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		seen[serveRequest(balancer, httptest.NewRequest("GET", "/", nil)).Body.String()] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("Expected round-robin without affinity, got %v", seen)
+	}
+}
+
+func TestAffinity_Fallback(t *testing.T) {
+	balancer, sender := newAffinityBalancer(t, "header")
+	req := func() *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("lb-author", "author")
+		return req
+	}
+	pinned := serveRequest(balancer, req()).Body.String()
+
+	balancer.recordProbe(pinned, false)
+	fallback := serveRequest(balancer, req()).Body.String()
+	if fallback == pinned {
+		t.Fatalf("Expected a fallback server while %s is unhealthy", pinned)
+	}
+	if server := serveRequest(balancer, req()).Body.String(); server != fallback {
+		t.Errorf("Expected the fallback %s to be stable, got %s", fallback, server)
+	}
+
+	balancer.recordProbe(pinned, true)
+	if server := serveRequest(balancer, req()).Body.String(); server != pinned {
+		t.Errorf("Expected the client back on %s, got %s", pinned, server)
+	}
+
+	// A server that cannot be reached is retried like any other.
+	sender.down[pinned] = true
+	if rr := serveRequest(balancer, req()); rr.Code != http.StatusOK || rr.Body.String() == pinned {
+		t.Errorf("Expected a retry on another server, got %d from %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestAffinity_Cookie(t *testing.T) {
+	balancer, sender := newAffinityBalancer(t, "cookie")
+
+	rr := serveRequest(balancer, httptest.NewRequest("GET", "/", nil))
+	pinned := rr.Body.String()
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "lb-server" || cookies[0].Value != serverToken(pinned) {
+		t.Fatalf("Expected an affinity cookie for %s, got %v", pinned, cookies)
+	}
+
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(cookies[0])
+		rr := serveRequest(balancer, req)
+		if server := rr.Body.String(); server != pinned {
+			t.Fatalf("Expected the cookie to pin %s, got %s", pinned, server)
+		}
+		if len(rr.Result().Cookies()) != 0 {
+			t.Errorf("Expected no new cookie for a pinned client, got %v", rr.Result().Cookies())
+		}
+	}
+
+	sender.down[pinned] = true
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	rr = serveRequest(balancer, req)
+	server := rr.Body.String()
+	if rr.Code != http.StatusOK || server == pinned {
+		t.Fatalf("Expected a fallback server, got %d from %q", rr.Code, server)
+	}
+	if cookies := rr.Result().Cookies(); len(cookies) != 1 || cookies[0].Value != serverToken(server) {
+		t.Errorf("Expected the cookie to move to %s, got %v", server, cookies)
+	}
+}
+
+func TestAffinity_IP(t *testing.T) {
+	balancer, _ := newAffinityBalancer(t, "ip")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	pinned := serveRequest(balancer, req).Body.String()
+	for port := 1235; port < 1240; port++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = fmt.Sprintf("10.0.0.1:%d", port)
+		if server := serveRequest(balancer, req).Body.String(); server != pinned {
+			t.Fatalf("Expected the client address to pin %s, got %s", pinned, server)
+		}
+	}
+}
+
+func TestParseAffinity(t *testing.T) {
+	for _, tc := range []struct {
+		mode, cookie, header string
+		valid                bool
+	}{
+		{"", "", "", true},
+		{"cookie", "lb-server", "", true},
+		{"cookie", "", "lb-author", false},
+		{"header", "", "", false},
+		{"ip", "", "", true},
+		{"random", "", "", false},
+	} {
+		if _, err := parseAffinity(tc.mode, tc.cookie, tc.header); (err == nil) != tc.valid {
+			t.Errorf("%+v: unexpected error %v", tc, err)
+		}
+	}
+}
@@ -3,11 +3,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,9 +20,43 @@ import (
 
 var (
 	port         = flag.Int("port", 8090, "load balancer port")
-	timeoutSec   = flag.Int("timeout-sec", 3, "request timeout time in seconds")
+	adminAddr    = flag.String("admin-addr", "localhost:8091", "address of the admin API, empty to disable it")
+	timeoutSec   = flag.Int("timeout-sec", 3, "how long a request waits for the response headers, in seconds")
 	https        = flag.Bool("https", false, "whether backends support HTTPs")
 	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
+	strategyName = flag.String("strategy", "least-bytes", "load balancing strategy: "+strings.Join(strategyNames, ", "))
+	weights      = flag.String("weights", "", "server weights for weighted-round-robin, e.g. server1:8080=3,server2:8080=1")
+	halfLife     = flag.Duration("traffic-half-life", time.Minute, "how fast traffic is forgotten by decaying-traffic")
+	configPath   = flag.String("config", "", "YAML or JSON file with the backends, reloaded on SIGHUP or when it changes")
+	configPoll   = flag.Duration("config-poll", 5*time.Second, "how often the config file is checked for changes")
+
+	breakerFailures = flag.Int("breaker-failures", 5, "consecutive failures that take a backend out of rotation, 0 to disable")
+	breakerTimeout  = flag.Duration("breaker-open-timeout", 10*time.Second, "how long a failing backend stays out of rotation")
+	breakerProbes   = flag.Int("breaker-half-open-requests", 1, "successful requests that bring a failing backend back")
+
+	maxRetries        = flag.Int("max-retries", 2, "how many other backends a request is retried on when its backend is unreachable")
+	retryMethods      = flag.String("retry-methods", "GET,HEAD", "comma-separated idempotent methods that are retried")
+	retryRatio        = flag.Float64("retry-budget-ratio", 0.2, "retries allowed per request")
+	retryMinPerSecond = flag.Float64("retry-budget-min-per-sec", 3, "retries allowed per second regardless of the ratio")
+
+	healthPath         = flag.String("health-path", "/health", "path probed by health checks")
+	healthInterval     = flag.Duration("health-interval", 10*time.Second, "time between health checks of a backend")
+	healthTimeout      = flag.Duration("health-timeout", 3*time.Second, "health check timeout")
+	healthExpectStatus = flag.Int("health-expect-status", http.StatusOK, "status of a passing health check")
+	healthExpectBody   = flag.String("health-expect-body", "", "text a passing health check response has to contain")
+	healthRise         = flag.Int("health-rise", 2, "passing health checks in a row that make a backend healthy")
+	healthFall         = flag.Int("health-fall", 3, "failing health checks in a row that make a backend unhealthy")
+
+	affinityMode   = flag.String("affinity", "", "pin clients to backends by cookie, header or ip, empty to disable")
+	affinityCookie = flag.String("affinity-cookie", "lb-server", "cookie used by cookie affinity")
+	affinityHeader = flag.String("affinity-header", "lb-author", "header used by header affinity")
+
+	tlsCert     = flag.String("tls-cert", "", "comma-separated certificate files to serve HTTPS with, picked by SNI")
+	tlsKey      = flag.String("tls-key", "", "comma-separated key files of the -tls-cert certificates")
+	backendCA   = flag.String("backend-ca", "", "CA bundle trusted for HTTPS backends instead of the system one")
+	backendCert = flag.String("backend-cert", "", "client certificate presented to HTTPS backends")
+	backendKey  = flag.String("backend-key", "", "key of the -backend-cert certificate")
+	certPoll    = flag.Duration("tls-poll", 5*time.Second, "how often certificate files are checked for changes")
 )
 
 var serversPool = []string{
@@ -29,27 +66,49 @@ var serversPool = []string{
 }
 
 type Balancer struct {
-	pool          []string
-	healthyPool   []string
-	serverTraffic map[string]int64
-	lock          sync.RWMutex
-	healthChecker HealthChecker
-	requestSender RequestSender
-	timeout       time.Duration
-	useHttps      bool
+	pool           []string
+	healthyPool    []string
+	backends       map[string]Backend
+	serverTraffic  map[string]int64
+	active         map[string]int64
+	draining       map[string]chan struct{}
+	breakers       map[string]*circuitBreaker
+	breakerConfig  BreakerConfig
+	health         map[string]*healthState
+	healthDefaults HealthCheck
+	healthChecks   *healthChecks
+	retryConfig    RetryConfig
+	retryBudget    *retryBudget
+	affinity       AffinityConfig
+	lock           sync.RWMutex
+	healthChecker  HealthChecker
+	requestSender  RequestSender
+	strategy       Strategy
+	timeout        time.Duration
+	useHttps       bool
 }
 
 func NewBalancer(pool []string, hc HealthChecker, rs RequestSender, timeout time.Duration, useHttps bool) *Balancer {
 	b := &Balancer{
 		pool:          pool,
 		healthyPool:   make([]string, len(pool)),
+		backends:      make(map[string]Backend, len(pool)),
 		serverTraffic: make(map[string]int64),
+		active:        make(map[string]int64),
+		draining:      make(map[string]chan struct{}),
+		breakers:      make(map[string]*circuitBreaker),
+		health:        make(map[string]*healthState),
+		retryBudget:   newRetryBudget(0, 0),
 		healthChecker: hc,
 		requestSender: rs,
 		timeout:       timeout,
 		useHttps:      useHttps,
 	}
 	copy(b.healthyPool, b.pool)
+	for _, server := range pool {
+		b.backends[server] = Backend{Address: server}
+	}
+	b.strategy = &leastBytes{b: b}
 	return b
 }
 
@@ -59,6 +118,15 @@ type HealthChecker interface {
 
 type DefaultHealthChecker struct {
 	Timeout time.Duration
+	// Client is used for health checks, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+func (hc *DefaultHealthChecker) client() *http.Client {
+	if hc.Client != nil {
+		return hc.Client
+	}
+	return http.DefaultClient
 }
 
 func (hc *DefaultHealthChecker) scheme(useHttps bool) string {
@@ -68,54 +136,184 @@ func (hc *DefaultHealthChecker) scheme(useHttps bool) string {
 	return "http"
 }
 
+// Check probes dst with the default health check and the timeout of hc.
 func (hc *DefaultHealthChecker) Check(dst string, useHttps bool) bool {
-	ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
-	defer cancel()
-
-	req, _ := http.NewRequestWithContext(ctx, "GET",
-		fmt.Sprintf("%s://%s/health", hc.scheme(useHttps), dst), nil)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return false
+	check := defaultHealthCheck
+	if hc.Timeout > 0 {
+		check.Timeout = Duration(hc.Timeout)
 	}
-	defer resp.Body.Close()
-	return resp.StatusCode == http.StatusOK
+	return hc.Probe(context.Background(), dst, useHttps, check)
 }
 
 type RequestSender interface {
 	Send(*http.Request) (*http.Response, error)
 }
 
-type DefaultRequestSender struct{}
+type DefaultRequestSender struct {
+	// Client forwards requests, http.DefaultClient if nil.
+	Client *http.Client
+}
 
 func (rs *DefaultRequestSender) Send(fwdRequest *http.Request) (*http.Response, error) {
+	if rs.Client != nil {
+		return rs.Client.Do(fwdRequest)
+	}
 	return http.DefaultClient.Do(fwdRequest)
 }
 
-func (b *Balancer) scheme() string {
-	if b.useHttps {
+// weight returns the weight of a server. The caller holds b.lock.
+func (b *Balancer) weight(server string) int {
+	if w := b.backends[server].Weight; w > 0 {
+		return w
+	}
+	return 1
+}
+
+// usesHttps tells whether a server is reached over HTTPS. The caller holds
+// b.lock.
+func (b *Balancer) usesHttps(server string) bool {
+	if https := b.backends[server].Https; https != nil {
+		return *https
+	}
+	return b.useHttps
+}
+
+func (b *Balancer) scheme(server string) string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if b.usesHttps(server) {
 		return "https"
 	}
 	return "http"
 }
 
+// policy is how a request is balanced: with the strategy and within the
+// timeout of its route, or those of the balancer.
+type policy struct {
+	strategy Strategy
+	timeout  time.Duration
+}
+
+func (b *Balancer) policy() policy {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return policy{strategy: b.strategy, timeout: b.timeout}
+}
+
+// serve forwards a client request with the policy of the balancer.
+func (b *Balancer) serve(rw http.ResponseWriter, r *http.Request) {
+	b.serveWith(rw, r, b.policy())
+}
+
+// serveWith forwards a client request to the server it has affinity with or
+// the one the strategy picks. Requests that cannot reach their server are
+// retried on other healthy servers if the retry config and budget allow.
+// The response headers have to arrive within the timeout, retries included.
+func (b *Balancer) serveWith(rw http.ResponseWriter, r *http.Request, p policy) {
+	r, headers, cancel := withHeaderTimeout(r, p.timeout)
+	defer cancel(nil)
+	defer headers.Stop()
+	ctx := r.Context()
+	b.retryBudget.request()
+	if b.retryConfig.MaxRetries > 0 && slices.Contains(b.retryConfig.Methods, r.Method) {
+		if err := bufferBody(r); err != nil {
+			http.Error(rw, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var tried []string
+	for {
+		server := b.chooseFor(r, p.strategy, tried...)
+		if server == "" {
+			if len(tried) == 0 {
+				http.Error(rw, "No healthy servers available", http.StatusServiceUnavailable)
+			} else {
+				rw.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+		if *traceEnabled {
+			rw.Header().Set("lb-retries", strconv.Itoa(len(tried)))
+		}
+		b.pin(rw, r, server)
+
+		err := b.forwardOnce(server, rw, r, p.strategy, headers)
+		var sendErr *sendError
+		if !errors.As(err, &sendErr) {
+			return
+		}
+		tried = append(tried, server)
+		if len(tried) > b.retryConfig.MaxRetries || !b.retryConfig.retryable(r) || ctx.Err() != nil || !b.retryBudget.retry() {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		log.Printf("Retrying %s %s on another server", r.Method, r.URL)
+	}
+}
+
+// forward sends r to dst within the balancer timeout and copies the
+// response to rw, responding with 503 if dst cannot be reached.
 func (b *Balancer) forward(dst string, rw http.ResponseWriter, r *http.Request) error {
-	ctx, cancel := context.WithTimeout(r.Context(), b.timeout)
-	defer cancel()
-	fwdRequest := r.Clone(ctx)
-	fwdRequest.RequestURI = ""
-	fwdRequest.URL.Host = dst
-	fwdRequest.URL.Scheme = b.scheme()
-	fwdRequest.Host = dst
+	p := b.policy()
+	r, headers, cancel := withHeaderTimeout(r, p.timeout)
+	defer cancel(nil)
+	defer headers.Stop()
+	err := b.forwardOnce(dst, rw, r, p.strategy, headers)
+	var sendErr *sendError
+	if errors.As(err, &sendErr) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return err
+}
+
+// withHeaderTimeout returns r with a context that is cancelled unless the
+// headers timer is stopped within timeout, which forwardOnce does once the
+// response headers arrive. Bodies are not limited, so event streams and
+// upgraded connections last as long as both sides keep them open.
+func withHeaderTimeout(r *http.Request, timeout time.Duration) (*http.Request, *time.Timer, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(r.Context())
+	headers := time.AfterFunc(timeout, func() { cancel(context.DeadlineExceeded) })
+	return r.WithContext(ctx), headers, cancel
+}
+
+// sendError is returned by forwardOnce when no response was received, in
+// which case nothing has been written to the client.
+type sendError struct {
+	server string
+	err    error
+}
+
+func (e *sendError) Error() string {
+	return fmt.Sprintf("failed to get response from %s: %s", e.server, e.err)
+}
+
+func (e *sendError) Unwrap() error {
+	return e.err
+}
+
+func (b *Balancer) forwardOnce(dst string, rw http.ResponseWriter, r *http.Request, strategy Strategy, headers *time.Timer) error {
+	fwdRequest, err := b.outgoingRequest(dst, r)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return err
+	}
+
+	b.begin(dst, strategy)
+	var n int64
+	defer func() { b.done(dst, n, strategy) }()
 
 	resp, err := b.requestSender.Send(fwdRequest)
+	b.recordResult(dst, err != nil || resp.StatusCode >= http.StatusInternalServerError)
 	if err != nil {
 		log.Printf("Failed to get response from %s: %s", dst, err)
-		rw.WriteHeader(http.StatusServiceUnavailable)
-		return err
+		return &sendError{server: dst, err: err}
 	}
 	defer resp.Body.Close()
+	headers.Stop()
 
+	upgrade := upgradeType(resp.Header)
+	removeHopHeaders(resp.Header)
 	for k, values := range resp.Header {
 		for _, value := range values {
 			rw.Header().Add(k, value)
@@ -127,9 +325,11 @@ func (b *Balancer) forward(dst string, rw http.ResponseWriter, r *http.Request)
 	}
 
 	log.Println("fwd", resp.StatusCode, resp.Request.URL)
-	rw.WriteHeader(resp.StatusCode)
-
-	n, err := io.Copy(rw, resp.Body)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		n, err = switchProtocols(rw, r, resp, upgrade)
+	} else {
+		n, err = copyResponse(rw, resp)
+	}
 	if err != nil {
 		log.Printf("Failed to write response: %s", err)
 		return err
@@ -142,74 +342,147 @@ func (b *Balancer) forward(dst string, rw http.ResponseWriter, r *http.Request)
 	return nil
 }
 
-func (b *Balancer) chooseServer() string {
+// chooseServer picks a healthy server other than the excluded ones with the
+// strategy of the balancer, or returns "" if there is none.
+func (b *Balancer) chooseServer(exclude ...string) string {
 	b.lock.RLock()
 	defer b.lock.RUnlock()
+	return b.choose(b.strategy, exclude)
+}
 
-	if len(b.healthyPool) == 0 {
+// choose picks a healthy server with strategy. The caller holds b.lock.
+func (b *Balancer) choose(strategy Strategy, exclude []string) string {
+	servers := b.healthyPool
+	if len(exclude) > 0 {
+		servers = slices.DeleteFunc(slices.Clone(servers), func(s string) bool {
+			return slices.Contains(exclude, s)
+		})
+	}
+	if len(servers) == 0 {
 		return ""
 	}
+	return strategy.Choose(servers)
+}
 
-	var minTrafficServer string
-	var minTraffic int64 = -1
+func main() {
+	flag.Parse()
+	timeout := time.Duration(*timeoutSec) * time.Second
 
-	for _, server := range b.healthyPool {
-		traffic := b.serverTraffic[server]
-		if minTraffic == -1 || traffic < minTraffic {
-			minTraffic = traffic
-			minTrafficServer = server
+	config := &Config{}
+	if *configPath != "" {
+		var err error
+		if config, err = loadConfig(*configPath); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		serverWeights, err := parseWeights(*weights)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, server := range serversPool {
+			config.Backends = append(config.Backends, Backend{Address: server, Weight: serverWeights[server]})
 		}
 	}
-	return minTrafficServer
-}
+	breakerConfig := BreakerConfig{
+		Failures:         *breakerFailures,
+		OpenTimeout:      *breakerTimeout,
+		HalfOpenRequests: *breakerProbes,
+	}
+	methods, err := parseMethods(*retryMethods)
+	if err != nil {
+		log.Fatal(err)
+	}
+	affinity, err := parseAffinity(*affinityMode, *affinityCookie, *affinityHeader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !slices.Contains(strategyNames, *strategyName) {
+		log.Fatalf("unknown strategy %q, expected one of %s", *strategyName, strings.Join(strategyNames, ", "))
+	}
+	healthDefaults := HealthCheck{
+		Path:         *healthPath,
+		Interval:     Duration(*healthInterval),
+		Timeout:      Duration(*healthTimeout),
+		ExpectStatus: *healthExpectStatus,
+		ExpectBody:   *healthExpectBody,
+		Rise:         *healthRise,
+		Fall:         *healthFall,
+	}
+	if err := healthDefaults.validate(); err != nil {
+		log.Fatal(err)
+	}
 
-func (b *Balancer) healthCheck() {
-	for {
-		time.Sleep(10 * time.Second)
-		log.Println("Starting health check...")
-		newHealthyPool := make([]string, 0, len(b.pool))
-		for _, server := range b.pool {
-			isHealthy := b.healthChecker.Check(server, b.useHttps)
-			if isHealthy {
-				newHealthyPool = append(newHealthyPool, server)
-			}
-			log.Printf("Server %s is %s", server, map[bool]string{true: "healthy", false: "unhealthy"}[isHealthy])
+	serverCerts, err := parseCertFiles(*tlsCert, *tlsKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	clientCerts, err := parseCertFiles(*backendCert, *backendKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(clientCerts) > 1 {
+		log.Fatal("only one backend client certificate can be given")
+	}
+	var serverStore, clientStore *certStore
+	if len(serverCerts) > 0 {
+		if serverStore, err = newCertStore(serverCerts); err != nil {
+			log.Fatal(err)
 		}
+	}
+	if len(clientCerts) > 0 {
+		if clientStore, err = newCertStore(clientCerts); err != nil {
+			log.Fatal(err)
+		}
+	}
+	client, err := newBackendClient(*backendCA, clientStore)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		b.lock.Lock()
-		b.healthyPool = newHealthyPool
-		b.lock.Unlock()
-		log.Println("Health check finished.")
+	healthChecker := &DefaultHealthChecker{Timeout: timeout, Client: client}
+	requestSender := &DefaultRequestSender{Client: client}
+	router := NewRouter(func() *Balancer {
+		pool := NewBalancer(nil, healthChecker, requestSender, timeout, *https)
+		pool.breakerConfig = breakerConfig
+		pool.retryConfig = RetryConfig{Methods: methods, MaxRetries: *maxRetries}
+		pool.retryBudget = newRetryBudget(*retryRatio, *retryMinPerSecond)
+		pool.affinity = affinity
+		pool.healthDefaults = healthDefaults
+		return pool
+	}, *strategyName, *halfLife)
+	if err := router.apply(config); err != nil {
+		log.Fatal(err)
 	}
-}
 
-func main() {
-	flag.Parse()
-	timeout := time.Duration(*timeoutSec) * time.Second
+	ctx, stop := context.WithCancel(context.Background())
+	router.start(ctx)
+	if *configPath != "" {
+		watchConfig(ctx, router, *configPath, *configPoll, signal.Hangups())
+	}
 
-	balancer := NewBalancer(
-		serversPool,
-		&DefaultHealthChecker{Timeout: timeout},
-		&DefaultRequestSender{},
-		timeout,
-		*https,
-	)
+	for _, store := range []*certStore{serverStore, clientStore} {
+		if store != nil {
+			store.watch(ctx, *certPoll, signal.Hangups())
+		}
+	}
 
-	go balancer.healthCheck()
+	var frontend httptools.Server
+	if serverStore != nil {
+		frontend = httptools.CreateTLSServer(*port, router.handler(), serverStore.serverConfig())
+	} else {
+		frontend = httptools.CreateServer(*port, router.handler())
+	}
 
-	frontend := httptools.CreateServer(*port, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		server := balancer.chooseServer()
-		if server == "" {
-			http.Error(rw, "No healthy servers available", http.StatusServiceUnavailable)
-			return
-		}
-		if err := balancer.forward(server, rw, r); err != nil {
-			return
-		}
-	}))
+	if *adminAddr != "" {
+		log.Printf("Serving the admin API on %s", *adminAddr)
+		httptools.CreateServerAt(*adminAddr, router.adminHandler()).Start()
+	}
 
 	log.Println("Starting load balancer...")
 	log.Printf("Tracing support enabled: %t", *traceEnabled)
+	log.Printf("Balancing strategy: %s", *strategyName)
 	frontend.Start()
 	signal.WaitForTerminationSignal()
+	stop()
+	router.wait()
 }
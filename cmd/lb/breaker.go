@@ -0,0 +1,161 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// BreakerConfig sets when a backend is taken out of rotation because of
+// failed requests. After Failures consecutive errors, 5xx responses or
+// timeouts the breaker opens for OpenTimeout, then lets HalfOpenRequests
+// requests through and closes if all of them succeed. Zero Failures
+// disables circuit breaking.
+type BreakerConfig struct {
+	Failures         int
+	OpenTimeout      time.Duration
+	HalfOpenRequests int
+}
+
+type circuitBreaker struct {
+	state     breakerState
+	failures  int
+	probes    int
+	successes int
+	timer     *time.Timer
+}
+
+func (b *Balancer) breakerEnabled() bool {
+	return b.breakerConfig.Failures > 0
+}
+
+// breakerAllows tells whether the breaker of a server lets new requests
+// through. The caller holds b.lock.
+func (b *Balancer) breakerAllows(server string) bool {
+	cb, ok := b.breakers[server]
+	if !ok {
+		return true
+	}
+	switch cb.state {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		return cb.probes < b.halfOpenRequests()
+	}
+	return true
+}
+
+func (b *Balancer) halfOpenRequests() int {
+	if n := b.breakerConfig.HalfOpenRequests; n > 0 {
+		return n
+	}
+	return 1
+}
+
+// breakerBegin counts a request of a half-open server as a probe, taking
+// the server out of rotation once it has as many probes as it needs. The
+// caller holds b.lock.
+func (b *Balancer) breakerBegin(server string) {
+	cb, ok := b.breakers[server]
+	if !ok || cb.state != breakerHalfOpen {
+		return
+	}
+	cb.probes++
+	if !b.breakerAllows(server) {
+		b.updateHealthyPool()
+	}
+}
+
+// recordResult feeds the outcome of a request to the breaker of a server.
+func (b *Balancer) recordResult(server string, failed bool) {
+	if !b.breakerEnabled() {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.backends[server]; !ok {
+		return
+	}
+	cb, ok := b.breakers[server]
+	if !ok {
+		cb = &circuitBreaker{}
+		b.breakers[server] = cb
+	}
+	switch cb.state {
+	case breakerClosed:
+		if !failed {
+			cb.failures = 0
+			return
+		}
+		if cb.failures++; cb.failures >= b.breakerConfig.Failures {
+			log.Printf("Circuit breaker of %s opened after %d failures", server, cb.failures)
+			b.openBreaker(server, cb)
+		}
+	case breakerHalfOpen:
+		if failed {
+			log.Printf("Circuit breaker of %s opened again", server)
+			b.openBreaker(server, cb)
+			return
+		}
+		if cb.successes++; cb.successes >= b.halfOpenRequests() {
+			log.Printf("Circuit breaker of %s closed", server)
+			*cb = circuitBreaker{}
+			b.updateHealthyPool()
+		}
+	}
+}
+
+// openBreaker takes a server out of rotation until the open timeout
+// passes. The caller holds b.lock.
+func (b *Balancer) openBreaker(server string, cb *circuitBreaker) {
+	*cb = circuitBreaker{state: breakerOpen}
+	b.updateHealthyPool()
+	cb.timer = time.AfterFunc(b.breakerConfig.OpenTimeout, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if b.breakers[server] != cb || cb.state != breakerOpen {
+			return
+		}
+		log.Printf("Circuit breaker of %s is half-open", server)
+		cb.state = breakerHalfOpen
+		b.updateHealthyPool()
+	})
+}
+
+// forgetBreaker drops the breaker of a server leaving the pool. The caller
+// holds b.lock.
+func (b *Balancer) forgetBreaker(server string) {
+	if cb, ok := b.breakers[server]; ok {
+		if cb.timer != nil {
+			cb.timer.Stop()
+		}
+		delete(b.breakers, server)
+	}
+}
+
+// breakerState returns the state of the breaker of a server. The caller
+// holds b.lock.
+func (b *Balancer) breakerState(server string) breakerState {
+	if cb, ok := b.breakers[server]; ok {
+		return cb.state
+	}
+	return breakerClosed
+}
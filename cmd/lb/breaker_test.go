@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statusSender answers every request with the status it holds, or fails
+// when the status is zero.
+type statusSender struct {
+	status int
+}
+
+func (s *statusSender) Send(req *http.Request) (*http.Response, error) {
+	if s.status == 0 {
+		return nil, errors.New("connection refused")
+	}
+	return &http.Response{
+		StatusCode: s.status,
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+func newBreakerBalancer(sender RequestSender) *Balancer {
+	balancer := NewBalancer([]string{"server1", "server2"}, &MockHealthChecker{}, sender, time.Second, false)
+	balancer.breakerConfig = BreakerConfig{Failures: 2, OpenTimeout: 20 * time.Millisecond, HalfOpenRequests: 1}
+	return balancer
+}
+
+func forwardTo(b *Balancer, server string) {
+	b.forward(server, httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func waitForBreaker(t *testing.T, b *Balancer, server string, expected breakerState) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		b.lock.RLock()
+		state := b.breakerState(server)
+		b.lock.RUnlock()
+		if state == expected {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Breaker of %s did not become %s", server, expected)
+}
+
+func TestBreaker_OpensAndCloses(t *testing.T) {
+	sender := &statusSender{}
+	balancer := newBreakerBalancer(sender)
+
+	forwardTo(balancer, "server1")
+	if expected := []string{"server1", "server2"}; !reflect.DeepEqual(balancer.healthyPool, expected) {
+		t.Fatalf("Expected a single failure to keep server1, got %v", balancer.healthyPool)
+	}
+	forwardTo(balancer, "server1")
+	if expected := []string{"server2"}; !reflect.DeepEqual(balancer.healthyPool, expected) {
+		t.Fatalf("Expected server1 to be ejected, got %v", balancer.healthyPool)
+	}
+	if status, _ := balancer.backendStatus("server1"); status.Breaker != "open" {
+		t.Errorf("Expected an open breaker, got %q", status.Breaker)
+	}
+
+	waitForBreaker(t, balancer, "server1", breakerHalfOpen)
+	if expected := []string{"server1", "server2"}; !reflect.DeepEqual(balancer.healthyPool, expected) {
+		t.Fatalf("Expected a half-open server1 to get a probe, got %v", balancer.healthyPool)
+	}
+
+	sender.status = http.StatusOK
+	forwardTo(balancer, "server1")
+	waitForBreaker(t, balancer, "server1", breakerClosed)
+	if expected := []string{"server1", "server2"}; !reflect.DeepEqual(balancer.healthyPool, expected) {
+		t.Errorf("Expected server1 back in rotation, got %v", balancer.healthyPool)
+	}
+}
+
+func TestBreaker_HalfOpenFailure(t *testing.T) {
+	sender := &statusSender{status: http.StatusBadGateway}
+	balancer := newBreakerBalancer(sender)
+
+	forwardTo(balancer, "server1")
+	forwardTo(balancer, "server1")
+	waitForBreaker(t, balancer, "server1", breakerHalfOpen)
+
+	forwardTo(balancer, "server1")
+	waitForBreaker(t, balancer, "server1", breakerOpen)
+	if expected := []string{"server2"}; !reflect.DeepEqual(balancer.healthyPool, expected) {
+		t.Errorf("Expected server1 to be ejected again, got %v", balancer.healthyPool)
+	}
+}
+
+func TestBreaker_HalfOpenProbes(t *testing.T) {
+	sender := newBlockingSender()
+	balancer := newBreakerBalancer(sender)
+	balancer.lock.Lock()
+	balancer.breakers["server1"] = &circuitBreaker{state: breakerHalfOpen}
+	balancer.lock.Unlock()
+
+	forwarded := make(chan struct{})
+	go func() {
+		forwardTo(balancer, "server1")
+		close(forwarded)
+	}()
+	<-sender.started
+	for _, chosen := range chooseMany(balancer, 5) {
+		if chosen != "server2" {
+			t.Fatalf("Expected no more requests to server1 while it is probed, got %q", chosen)
+		}
+	}
+
+	close(sender.release)
+	<-forwarded
+	waitForBreaker(t, balancer, "server1", breakerClosed)
+}
+
+func TestBreaker_SuccessResetsFailures(t *testing.T) {
+	sender := &statusSender{}
+	balancer := newBreakerBalancer(sender)
+
+	forwardTo(balancer, "server1")
+	sender.status = http.StatusNotFound
+	forwardTo(balancer, "server1")
+	sender.status = 0
+	forwardTo(balancer, "server1")
+
+	if expected := []string{"server1", "server2"}; !reflect.DeepEqual(balancer.healthyPool, expected) {
+		t.Errorf("Expected failures separated by a success to keep server1, got %v", balancer.healthyPool)
+	}
+}
+
+func TestBreaker_Disabled(t *testing.T) {
+	balancer := NewBalancer([]string{"server1"}, &MockHealthChecker{}, &statusSender{}, time.Second, false)
+	for i := 0; i < 10; i++ {
+		forwardTo(balancer, "server1")
+	}
+	if expected := []string{"server1"}; !reflect.DeepEqual(balancer.healthyPool, expected) {
+		t.Errorf("Expected no ejection without a breaker, got %v", balancer.healthyPool)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Backend is a server the balancer forwards requests to.
+type Backend struct {
+	Address string `json:"address" yaml:"address"`
+	// Weight is used by weighted-round-robin, zero meaning 1.
+	Weight int `json:"weight,omitempty" yaml:"weight,omitempty"`
+	// Https overrides the -https flag for this backend.
+	Https       *bool        `json:"https,omitempty" yaml:"https,omitempty"`
+	HealthCheck *HealthCheck `json:"healthCheck,omitempty" yaml:"healthCheck,omitempty"`
+}
+
+// defaultPool is the pool of the top-level backends of a config, which gets
+// the requests that match no route.
+const defaultPool = "default"
+
+// PoolConfig is a named group of backends. Strategy overrides the -strategy
+// flag for the pool.
+type PoolConfig struct {
+	Backends []Backend `json:"backends" yaml:"backends"`
+	Strategy string    `json:"strategy,omitempty" yaml:"strategy,omitempty"`
+}
+
+// Route sends the requests it matches to Pool. A request matches when it
+// has the Host, the PathPrefix, one of the Methods and all of the Headers of
+// the route; empty fields match any request. Host may start with "*." to
+// match subdomains, and PathPrefix matches whole path segments unless it
+// ends with a slash. Timeout and Strategy override those of the pool.
+type Route struct {
+	Name       string            `json:"name,omitempty" yaml:"name,omitempty"`
+	Host       string            `json:"host,omitempty" yaml:"host,omitempty"`
+	PathPrefix string            `json:"pathPrefix,omitempty" yaml:"pathPrefix,omitempty"`
+	Methods    []string          `json:"methods,omitempty" yaml:"methods,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Pool       string            `json:"pool" yaml:"pool"`
+	Timeout    Duration          `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	Strategy   string            `json:"strategy,omitempty" yaml:"strategy,omitempty"`
+}
+
+// Config is the content of the file given by -config, in JSON if its name
+// ends with .json and in YAML otherwise. Backends make up the default pool,
+// and routes are tried in order.
+type Config struct {
+	Backends []Backend             `json:"backends,omitempty" yaml:"backends,omitempty"`
+	Pools    map[string]PoolConfig `json:"pools,omitempty" yaml:"pools,omitempty"`
+	Routes   []Route               `json:"routes,omitempty" yaml:"routes,omitempty"`
+}
+
+// pools returns the pools of the config by name, including the default one.
+func (c *Config) pools() map[string]PoolConfig {
+	pools := make(map[string]PoolConfig, len(c.Pools)+1)
+	for name, pool := range c.Pools {
+		pools[name] = pool
+	}
+	if len(c.Backends) > 0 {
+		pools[defaultPool] = PoolConfig{Backends: c.Backends}
+	}
+	return pools
+}
+
+func parseConfig(data []byte, name string) (*Config, error) {
+	var config Config
+	if filepath.Ext(name) == ".json" {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			return nil, fmt.Errorf("invalid config %s: %v", name, err)
+		}
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&config); err != nil {
+			return nil, fmt.Errorf("invalid config %s: %v", name, err)
+		}
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", name, err)
+	}
+	return &config, nil
+}
+
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data, path)
+}
+
+func (c *Config) validate() error {
+	if len(c.Backends) == 0 && len(c.Pools) == 0 {
+		return errors.New("no backends")
+	}
+	if _, ok := c.Pools[defaultPool]; ok && len(c.Backends) > 0 {
+		return fmt.Errorf("pool %s is given by both backends and pools", defaultPool)
+	}
+	if len(c.Backends) > 0 {
+		if err := validateBackends(c.Backends); err != nil {
+			return err
+		}
+	}
+	for name, pool := range c.Pools {
+		if err := validateBackends(pool.Backends); err != nil {
+			return fmt.Errorf("pool %s: %v", name, err)
+		}
+		if pool.Strategy != "" && !slices.Contains(strategyNames, pool.Strategy) {
+			return fmt.Errorf("pool %s: unknown strategy %q", name, pool.Strategy)
+		}
+	}
+	pools := c.pools()
+	for i, route := range c.Routes {
+		name := route.Name
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+		if _, ok := pools[route.Pool]; !ok {
+			return fmt.Errorf("route %s: unknown pool %q", name, route.Pool)
+		}
+		if route.PathPrefix != "" && !strings.HasPrefix(route.PathPrefix, "/") {
+			return fmt.Errorf("route %s: path prefix %q does not start with /", name, route.PathPrefix)
+		}
+		if route.Strategy != "" && !slices.Contains(strategyNames, route.Strategy) {
+			return fmt.Errorf("route %s: unknown strategy %q", name, route.Strategy)
+		}
+	}
+	return nil
+}
+
+func validateBackends(backends []Backend) error {
+	if len(backends) == 0 {
+		return errors.New("no backends")
+	}
+	seen := make(map[string]bool, len(backends))
+	for i, backend := range backends {
+		if backend.Address == "" {
+			return fmt.Errorf("backend %d has no address", i)
+		}
+		if seen[backend.Address] {
+			return fmt.Errorf("backend %s is listed twice", backend.Address)
+		}
+		seen[backend.Address] = true
+		if backend.Weight < 0 {
+			return fmt.Errorf("backend %s has a negative weight", backend.Address)
+		}
+		if backend.HealthCheck != nil {
+			if err := backend.HealthCheck.validate(); err != nil {
+				return fmt.Errorf("backend %s: %v", backend.Address, err)
+			}
+		}
+	}
+	return nil
+}
+
+// watchConfig starts reloading the config at path into rt whenever reload
+// receives a value or the file changes, checking for changes every interval,
+// until ctx is done. A config that fails to load is logged and the pools and
+// routes are left as they are.
+func watchConfig(ctx context.Context, rt *Router, path string, interval time.Duration, reload <-chan os.Signal) {
+	watchFiles(ctx, []string{path}, interval, reload, func() {
+		config, err := loadConfig(path)
+		if err != nil {
+			log.Printf("Keeping the current config: %s", err)
+			return
+		}
+		if err := rt.apply(config); err != nil {
+			log.Printf("Keeping the current config: %s", err)
+		}
+	})
+}
+
+// fileStamp tells whether a file has changed.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stampFiles(paths []string) []fileStamp {
+	stamps := make([]fileStamp, len(paths))
+	for i, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			stamps[i] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return stamps
+}
+
+// watchFiles starts calling load whenever reload receives a value or one of
+// the files at paths changes, checking for changes every interval, until
+// ctx is done.
+func watchFiles(ctx context.Context, paths []string, interval time.Duration, reload <-chan os.Signal, load func()) {
+	last := stampFiles(paths)
+	names := strings.Join(paths, ", ")
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-reload:
+				log.Printf("Reloading %s", names)
+			case <-ticker.C:
+				stamps := stampFiles(paths)
+				if slices.EqualFunc(stamps, last, func(a, b fileStamp) bool {
+					return a.modTime.Equal(b.modTime) && a.size == b.size
+				}) {
+					continue
+				}
+				last = stamps
+				log.Printf("%s changed, reloading", names)
+			}
+			load()
+		}
+	}()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	yes := true
+	expected := &Config{Backends: []Backend{
+		{Address: "server1:8080", Weight: 3},
+		{Address: "server2:8080", Https: &yes},
+	}}
+
+	yamlConfig := `
+backends:
+  - address: server1:8080
+    weight: 3
+  - address: server2:8080
+    https: true
+`
+	config, err := parseConfig([]byte(yamlConfig), "lb.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, config)
+	}
+
+	jsonConfig := `{"backends": [{"address": "server1:8080", "weight": 3}, {"address": "server2:8080", "https": true}]}`
+	config, err = parseConfig([]byte(jsonConfig), "lb.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, config)
+	}
+}
+
+func TestParseConfig_Invalid(t *testing.T) {
+	for name, config := range map[string]string{
+		"no backends":   "backends: []",
+		"no address":    "backends: [{weight: 1}]",
+		"duplicate":     "backends: [{address: a}, {address: a}]",
+		"weight":        "backends: [{address: a, weight: -1}]",
+		"unknown field": "backends: [{address: a, port: 1}]",
+		"syntax":        "backends: [",
+	} {
+		if _, err := parseConfig([]byte(config), "lb.yaml"); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestBalancer_SetBackends(t *testing.T) {
+	balancer := NewBalancer([]string{"server1", "server2", "server3"}, &MockHealthChecker{}, &MockRequestSender{}, time.Second, false)
+	balancer.recordProbe("server2", false)
+	balancer.serverTraffic["server1"] = 100
+
+	balancer.setBackends([]Backend{{Address: "server1"}, {Address: "server2"}, {Address: "server4", Weight: 2}})
+
+	if expected := []string{"server1", "server2", "server4"}; !reflect.DeepEqual(balancer.pool, expected) {
+		t.Errorf("Expected pool %v, got %v", expected, balancer.pool)
+	}
+	if expected := []string{"server1", "server4"}; !reflect.DeepEqual(balancer.healthyPool, expected) {
+		t.Errorf("Expected healthy pool %v, got %v", expected, balancer.healthyPool)
+	}
+	if balancer.serverTraffic["server1"] != 100 {
+		t.Errorf("Expected traffic of server1 to be kept, got %d", balancer.serverTraffic["server1"])
+	}
+	if w := balancer.weight("server4"); w != 2 {
+		t.Errorf("Expected weight 2, got %d", w)
+	}
+}
+
+func TestBalancer_BackendHttps(t *testing.T) {
+	yes, no := true, false
+	balancer := NewBalancer(nil, &MockHealthChecker{}, &MockRequestSender{}, time.Second, true)
+	balancer.setBackends([]Backend{{Address: "server1"}, {Address: "server2", Https: &no}, {Address: "server3", Https: &yes}})
+
+	for server, expected := range map[string]string{"server1": "https", "server2": "http", "server3": "https"} {
+		if scheme := balancer.scheme(server); scheme != expected {
+			t.Errorf("%s: expected %s, got %s", server, expected, scheme)
+		}
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lb.yaml")
+	if err := os.WriteFile(path, []byte("backends: [{address: server1}]"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	router := newTestRouter(&MockRequestSender{})
+	if err := router.apply(&Config{Backends: []Backend{{Address: "server1"}}}); err != nil {
+		t.Fatal(err)
+	}
+	balancer := router.pool(defaultPool)
+	reload := make(chan os.Signal)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watchConfig(ctx, router, path, 10*time.Millisecond, reload)
+
+	waitForPool := func(expected ...string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			balancer.lock.RLock()
+			pool := balancer.pool
+			balancer.lock.RUnlock()
+			if reflect.DeepEqual(pool, expected) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Pool was not reloaded to %v", expected)
+	}
+
+	if err := os.WriteFile(path, []byte("backends: [{address: server1}, {address: server2}]"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	waitForPool("server1", "server2")
+
+	// A broken config keeps the current backends.
+	if err := os.WriteFile(path, []byte("backends: ["), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	waitForPool("server1", "server2")
+
+	balancer.setBackends([]Backend{{Address: "server3"}})
+	if err := os.WriteFile(path, []byte("backends: [{address: server2}]"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reload <- os.Interrupt
+	waitForPool("server2")
+}
+
+func TestHandler_ListBackends(t *testing.T) {
+	balancer := NewBalancer([]string{"server1", "server2"}, &MockHealthChecker{}, &MockRequestSender{}, time.Second, false)
+	balancer.healthyPool = []string{"server2"}
+	balancer.serverTraffic["server2"] = 42
+
+	rr := httptest.NewRecorder()
+	balancer.adminHandler().ServeHTTP(rr, httptest.NewRequest("GET", "/admin/backends", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %d", rr.Code)
+	}
+	var statuses []BackendStatus
+	if err := json.NewDecoder(rr.Body).Decode(&statuses); err != nil {
+		t.Fatal(err)
+	}
+	expected := []BackendStatus{
+		{Backend: Backend{Address: "server1"}},
+		{Backend: Backend{Address: "server2"}, Healthy: true, Traffic: 42},
+	}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, statuses)
+	}
+}
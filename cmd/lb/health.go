@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxHealthBody is how much of a health check response is searched for the
+// expected body.
+const maxHealthBody = 64 << 10
+
+// Duration is a time.Duration written as "10s" or "500ms" in configs.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	return d.parse(node.Value)
+}
+
+func (d *Duration) parse(s string) error {
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if parsed < 0 {
+		return fmt.Errorf("negative duration %s", s)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// HealthCheck sets how a backend is probed. A backend becomes healthy after
+// Rise passing probes in a row and unhealthy after Fall failing ones. Zero
+// fields of a backend take the values given by flags.
+type HealthCheck struct {
+	Path     string   `json:"path,omitempty" yaml:"path,omitempty"`
+	Interval Duration `json:"interval,omitempty" yaml:"interval,omitempty"`
+	Timeout  Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	// ExpectStatus is the status of a passing probe, 200 by default.
+	ExpectStatus int `json:"expectStatus,omitempty" yaml:"expectStatus,omitempty"`
+	// ExpectBody, if set, has to be a part of the response body.
+	ExpectBody string `json:"expectBody,omitempty" yaml:"expectBody,omitempty"`
+	Rise       int    `json:"rise,omitempty" yaml:"rise,omitempty"`
+	Fall       int    `json:"fall,omitempty" yaml:"fall,omitempty"`
+}
+
+// merge fills the zero fields of c from defaults.
+func (c HealthCheck) merge(defaults HealthCheck) HealthCheck {
+	if c.Path == "" {
+		c.Path = defaults.Path
+	}
+	if c.Interval == 0 {
+		c.Interval = defaults.Interval
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaults.Timeout
+	}
+	if c.ExpectStatus == 0 {
+		c.ExpectStatus = defaults.ExpectStatus
+	}
+	if c.ExpectBody == "" {
+		c.ExpectBody = defaults.ExpectBody
+	}
+	if c.Rise == 0 {
+		c.Rise = defaults.Rise
+	}
+	if c.Fall == 0 {
+		c.Fall = defaults.Fall
+	}
+	return c
+}
+
+func (c HealthCheck) validate() error {
+	if c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("health check path %q does not start with /", c.Path)
+	}
+	if c.ExpectStatus < 0 || c.Rise < 0 || c.Fall < 0 {
+		return fmt.Errorf("health check has negative thresholds")
+	}
+	return nil
+}
+
+var defaultHealthCheck = HealthCheck{
+	Path:         "/health",
+	Interval:     Duration(10 * time.Second),
+	Timeout:      Duration(3 * time.Second),
+	ExpectStatus: http.StatusOK,
+	Rise:         1,
+	Fall:         1,
+}
+
+// Prober is a HealthChecker that follows the health check settings of each
+// backend. The balancer uses Check of health checkers that are not Probers.
+type Prober interface {
+	Probe(ctx context.Context, dst string, useHttps bool, check HealthCheck) bool
+}
+
+func (hc *DefaultHealthChecker) Probe(ctx context.Context, dst string, useHttps bool, check HealthCheck) bool {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(check.Timeout))
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		fmt.Sprintf("%s://%s%s", hc.scheme(useHttps), dst, check.Path), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := hc.client().Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != check.ExpectStatus {
+		return false
+	}
+	if check.ExpectBody == "" {
+		return true
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+	return err == nil && strings.Contains(string(body), check.ExpectBody)
+}
+
+// healthState counts the probes of a backend that passed or failed in a
+// row.
+type healthState struct {
+	healthy   bool
+	successes int
+	failures  int
+}
+
+// healthChecks runs a probe loop for every backend of the pool.
+type healthChecks struct {
+	ctx    context.Context
+	cancel map[string]context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// isHealthy tells whether the last probes of a server passed. Once health
+// checks run, a server that has not been probed yet is pending and gets no
+// requests until its first probe passes; without health checks every server
+// is healthy. The caller holds b.lock.
+func (b *Balancer) isHealthy(server string) bool {
+	state, ok := b.health[server]
+	if !ok {
+		return b.healthChecks == nil
+	}
+	return state.healthy
+}
+
+// healthCheckOf returns the health check settings of a server. The caller
+// holds b.lock.
+func (b *Balancer) healthCheckOf(server string) HealthCheck {
+	var check HealthCheck
+	if backend, ok := b.backends[server]; ok && backend.HealthCheck != nil {
+		check = *backend.HealthCheck
+	}
+	return check.merge(b.healthDefaults).merge(defaultHealthCheck)
+}
+
+func (b *Balancer) probe(ctx context.Context, server string) bool {
+	b.lock.RLock()
+	check := b.healthCheckOf(server)
+	useHttps := b.usesHttps(server)
+	b.lock.RUnlock()
+
+	if prober, ok := b.healthChecker.(Prober); ok {
+		return prober.Probe(ctx, server, useHttps, check)
+	}
+	return b.healthChecker.Check(server, useHttps)
+}
+
+// recordProbe updates the health of a server with the result of a probe.
+// The first probe decides at once, later ones have to reach the rise or
+// fall threshold.
+func (b *Balancer) recordProbe(server string, passed bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.backends[server]; !ok {
+		return
+	}
+	check := b.healthCheckOf(server)
+	state, ok := b.health[server]
+	if !ok {
+		state = &healthState{healthy: !passed}
+		b.health[server] = state
+		check.Rise, check.Fall = 1, 1
+	}
+	if passed {
+		state.successes++
+		state.failures = 0
+	} else {
+		state.failures++
+		state.successes = 0
+	}
+	switch {
+	case !state.healthy && passed && state.successes >= check.Rise:
+		state.healthy = true
+	case state.healthy && !passed && state.failures >= check.Fall:
+		state.healthy = false
+	default:
+		return
+	}
+	log.Printf("Server %s is %s", server, map[bool]string{true: "healthy", false: "unhealthy"}[state.healthy])
+	b.updateHealthyPool()
+}
+
+// startHealthChecks probes every backend at once and then keeps probing each
+// of them at its own interval until ctx is done. Backends added later get
+// their own probe loop.
+func (b *Balancer) startHealthChecks(ctx context.Context) {
+	b.lock.RLock()
+	pool := append([]string(nil), b.pool...)
+	b.lock.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, server := range pool {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.recordProbe(server, b.probe(ctx, server))
+		}()
+	}
+	wg.Wait()
+	log.Println("Initial health check finished.")
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.healthChecks = &healthChecks{ctx: ctx, cancel: make(map[string]context.CancelFunc)}
+	b.syncHealthChecks()
+}
+
+// waitHealthChecks waits for the probe loops to stop once the context given
+// to startHealthChecks is done.
+func (b *Balancer) waitHealthChecks() {
+	b.lock.RLock()
+	checks := b.healthChecks
+	b.lock.RUnlock()
+	if checks != nil {
+		checks.wg.Wait()
+	}
+}
+
+// syncHealthChecks starts probe loops for new servers of the pool and stops
+// those of removed ones. New servers are probed at once, since they are
+// pending until their first probe passes. The caller holds b.lock.
+func (b *Balancer) syncHealthChecks() {
+	checks := b.healthChecks
+	if checks == nil {
+		return
+	}
+	for server, cancel := range checks.cancel {
+		if _, ok := b.backends[server]; !ok {
+			cancel()
+			delete(checks.cancel, server)
+		}
+	}
+	for _, server := range b.pool {
+		if _, ok := checks.cancel[server]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(checks.ctx)
+		checks.cancel[server] = cancel
+		_, probed := b.health[server]
+		checks.wg.Add(1)
+		go func() {
+			defer checks.wg.Done()
+			b.runHealthCheck(ctx, server, probed)
+		}()
+	}
+}
+
+// runHealthCheck probes a server until ctx is done. The first wait is a
+// random part of the interval, so probes of different servers are spread
+// out, and later ones are jittered by a tenth of the interval.
+func (b *Balancer) runHealthCheck(ctx context.Context, server string, probed bool) {
+	b.lock.RLock()
+	interval := time.Duration(b.healthCheckOf(server).Interval)
+	b.lock.RUnlock()
+
+	wait := time.Duration(0)
+	if probed {
+		wait = time.Duration(rand.Int63n(int64(interval) + 1))
+	}
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		passed := b.probe(ctx, server)
+		if ctx.Err() != nil {
+			return
+		}
+		b.recordProbe(server, passed)
+
+		b.lock.RLock()
+		interval = time.Duration(b.healthCheckOf(server).Interval)
+		b.lock.RUnlock()
+		jitter := int64(interval) / 10
+		wait = interval + time.Duration(rand.Int63n(2*jitter+1)-jitter)
+	}
+}
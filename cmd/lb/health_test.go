@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptedProber answers probes from a map and counts them per server.
+type scriptedProber struct {
+	mu      sync.Mutex
+	healthy map[string]bool
+	probes  map[string]int
+	checks  map[string]HealthCheck
+}
+
+func newScriptedProber(healthy map[string]bool) *scriptedProber {
+	return &scriptedProber{healthy: healthy, probes: make(map[string]int), checks: make(map[string]HealthCheck)}
+}
+
+func (p *scriptedProber) Check(dst string, useHttps bool) bool {
+	return p.Probe(context.Background(), dst, useHttps, HealthCheck{})
+}
+
+func (p *scriptedProber) Probe(ctx context.Context, dst string, useHttps bool, check HealthCheck) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.probes[dst]++
+	p.checks[dst] = check
+	return p.healthy[dst]
+}
+
+func (p *scriptedProber) count(server string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.probes[server]
+}
+
+func (p *scriptedProber) set(server string, healthy bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.healthy[server] = healthy
+}
+
+func healthyPool(b *Balancer) []string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return append([]string(nil), b.healthyPool...)
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s", what)
+}
+
+func TestDefaultHealthChecker_Probe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ready":
+			rw.Write([]byte(`{"status": "ready"}`))
+		case "/starting":
+			rw.Write([]byte(`{"status": "starting"}`))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	dst := strings.TrimPrefix(server.URL, "http://")
+	checker := &DefaultHealthChecker{}
+
+	for _, tc := range []struct {
+		check    HealthCheck
+		expected bool
+	}{
+		{HealthCheck{Path: "/ready", ExpectStatus: http.StatusOK}, true},
+		{HealthCheck{Path: "/ready", ExpectStatus: http.StatusOK, ExpectBody: "ready"}, true},
+		{HealthCheck{Path: "/starting", ExpectStatus: http.StatusOK, ExpectBody: `"ready"`}, false},
+		{HealthCheck{Path: "/missing", ExpectStatus: http.StatusOK}, false},
+		{HealthCheck{Path: "/missing", ExpectStatus: http.StatusNotFound}, true},
+	} {
+		tc.check.Timeout = Duration(time.Second)
+		if got := checker.Probe(context.Background(), dst, false, tc.check); got != tc.expected {
+			t.Errorf("%+v: expected %t, got %t", tc.check, tc.expected, got)
+		}
+	}
+}
+
+func TestBalancer_RiseAndFall(t *testing.T) {
+	balancer := NewBalancer([]string{"server1"}, &MockHealthChecker{}, &MockRequestSender{}, time.Second, false)
+	balancer.healthDefaults = HealthCheck{Rise: 2, Fall: 3}
+
+	balancer.recordProbe("server1", false)
+	if pool := healthyPool(balancer); len(pool) != 0 {
+		t.Fatalf("Expected the first failing probe to decide at once, got %v", pool)
+	}
+	balancer.recordProbe("server1", true)
+	if pool := healthyPool(balancer); len(pool) != 0 {
+		t.Fatalf("Expected one passing probe not to be enough, got %v", pool)
+	}
+	balancer.recordProbe("server1", true)
+	if pool := healthyPool(balancer); !reflect.DeepEqual(pool, []string{"server1"}) {
+		t.Fatalf("Expected two passing probes to bring server1 back, got %v", pool)
+	}
+
+	balancer.recordProbe("server1", false)
+	balancer.recordProbe("server1", false)
+	balancer.recordProbe("server1", true)
+	balancer.recordProbe("server1", false)
+	balancer.recordProbe("server1", false)
+	if pool := healthyPool(balancer); !reflect.DeepEqual(pool, []string{"server1"}) {
+		t.Fatalf("Expected failures that are not in a row to keep server1, got %v", pool)
+	}
+	balancer.recordProbe("server1", false)
+	if pool := healthyPool(balancer); len(pool) != 0 {
+		t.Errorf("Expected three failing probes to take server1 out, got %v", pool)
+	}
+}
+
+func TestBalancer_HealthChecks(t *testing.T) {
+	prober := newScriptedProber(map[string]bool{"server1": true, "server2": false})
+	balancer := NewBalancer([]string{"server1", "server2"}, prober, &MockRequestSender{}, time.Second, false)
+	balancer.healthDefaults = HealthCheck{Interval: Duration(5 * time.Millisecond)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	balancer.startHealthChecks(ctx)
+	if pool := healthyPool(balancer); !reflect.DeepEqual(pool, []string{"server1"}) {
+		t.Fatalf("Expected the initial check to take server2 out, got %v", pool)
+	}
+
+	prober.set("server2", true)
+	waitFor(t, "server2 to become healthy", func() bool {
+		return reflect.DeepEqual(healthyPool(balancer), []string{"server1", "server2"})
+	})
+
+	if err := balancer.addBackend(Backend{Address: "server3"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "server3 to be probed", func() bool { return prober.count("server3") > 0 })
+	waitFor(t, "server3 to be taken out", func() bool {
+		return reflect.DeepEqual(healthyPool(balancer), []string{"server1", "server2"})
+	})
+
+	if err := balancer.removeBackend("server3"); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	balancer.waitHealthChecks()
+	probes := prober.count("server1")
+	time.Sleep(20 * time.Millisecond)
+	if prober.count("server1") != probes {
+		t.Error("Expected probes to stop after shutdown")
+	}
+}
+
+// gatedProber holds the probes of a server until its gate is closed.
+type gatedProber struct {
+	*scriptedProber
+	gates map[string]chan struct{}
+}
+
+func (p *gatedProber) Probe(ctx context.Context, dst string, useHttps bool, check HealthCheck) bool {
+	if gate, ok := p.gates[dst]; ok {
+		<-gate
+	}
+	return p.scriptedProber.Probe(ctx, dst, useHttps, check)
+}
+
+func TestBalancer_NewBackendsPending(t *testing.T) {
+	prober := &gatedProber{
+		scriptedProber: newScriptedProber(map[string]bool{"server1": true, "server2": true, "server3": true}),
+		gates:          map[string]chan struct{}{"server2": make(chan struct{}), "server3": make(chan struct{})},
+	}
+	balancer := NewBalancer([]string{"server1"}, prober, &MockRequestSender{}, time.Second, false)
+	balancer.healthDefaults = HealthCheck{Interval: Duration(time.Hour)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		balancer.waitHealthChecks()
+	}()
+	balancer.startHealthChecks(ctx)
+
+	if err := balancer.addBackend(Backend{Address: "server2"}); err != nil {
+		t.Fatal(err)
+	}
+	balancer.setBackends([]Backend{{Address: "server1"}, {Address: "server2"}, {Address: "server3"}})
+	if pool := healthyPool(balancer); !reflect.DeepEqual(pool, []string{"server1"}) {
+		t.Errorf("Expected new backends to wait for their first probe, got %v", pool)
+	}
+	balancer.lock.RLock()
+	health := balancer.status("server3").Health
+	balancer.lock.RUnlock()
+	if health != "pending" {
+		t.Errorf("Expected an unprobed backend to be pending, got %q", health)
+	}
+
+	close(prober.gates["server2"])
+	close(prober.gates["server3"])
+	waitFor(t, "new backends to pass their first probe", func() bool {
+		return reflect.DeepEqual(healthyPool(balancer), []string{"server1", "server2", "server3"})
+	})
+}
+
+func TestDefaultHealthChecker_Check(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	hc := &DefaultHealthChecker{Timeout: time.Second}
+	if !hc.Check(strings.TrimPrefix(server.URL, "http://"), false) {
+		t.Error("Expected the default health check to pass")
+	}
+}
+
+func TestBalancer_HealthCheckSettings(t *testing.T) {
+	prober := newScriptedProber(map[string]bool{"server1": true, "server2": true})
+	balancer := NewBalancer(nil, prober, &MockRequestSender{}, time.Second, false)
+	balancer.healthDefaults = HealthCheck{Path: "/ping", Interval: Duration(time.Hour)}
+	balancer.setBackends([]Backend{
+		{Address: "server1"},
+		{Address: "server2", HealthCheck: &HealthCheck{Path: "/ready", ExpectBody: "ok", Fall: 5}},
+	})
+
+	balancer.probe(context.Background(), "server1")
+	balancer.probe(context.Background(), "server2")
+
+	expected := map[string]HealthCheck{
+		"server1": {Path: "/ping", Interval: Duration(time.Hour), Timeout: Duration(3 * time.Second), ExpectStatus: http.StatusOK, Rise: 1, Fall: 1},
+		"server2": {Path: "/ready", Interval: Duration(time.Hour), Timeout: Duration(3 * time.Second), ExpectStatus: http.StatusOK, ExpectBody: "ok", Rise: 1, Fall: 5},
+	}
+	if !reflect.DeepEqual(prober.checks, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, prober.checks)
+	}
+}
+
+func TestParseConfig_HealthCheck(t *testing.T) {
+	yamlConfig := `
+backends:
+  - address: server1:8080
+    healthCheck:
+      path: /ready
+      interval: 2s
+      timeout: 500ms
+      rise: 2
+`
+	config, err := parseConfig([]byte(yamlConfig), "lb.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &HealthCheck{Path: "/ready", Interval: Duration(2 * time.Second), Timeout: Duration(500 * time.Millisecond), Rise: 2}
+	if !reflect.DeepEqual(config.Backends[0].HealthCheck, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, config.Backends[0].HealthCheck)
+	}
+
+	jsonConfig := `{"backends": [{"address": "server1:8080", "healthCheck": {"path": "/ready", "interval": "2s", "timeout": "500ms", "rise": 2}}]}`
+	config, err = parseConfig([]byte(jsonConfig), "lb.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.Backends[0].HealthCheck, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, config.Backends[0].HealthCheck)
+	}
+
+	for _, invalid := range []string{
+		"backends: [{address: a, healthCheck: {interval: soon}}]",
+		"backends: [{address: a, healthCheck: {path: ready}}]",
+		"backends: [{address: a, healthCheck: {fall: -1}}]",
+	} {
+		if _, err := parseConfig([]byte(invalid), "lb.yaml"); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
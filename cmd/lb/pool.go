@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"slices"
+)
+
+var (
+	errBackendExists   = errors.New("backend already exists")
+	errBackendNotFound = errors.New("backend not found")
+)
+
+// updateHealthyPool rebuilds healthyPool from the servers of the pool that
+// are healthy, not draining and not stopped by their circuit breaker. The
+// caller holds b.lock.
+func (b *Balancer) updateHealthyPool() {
+	healthyPool := make([]string, 0, len(b.pool))
+	for _, server := range b.pool {
+		if _, draining := b.draining[server]; !draining && b.breakerAllows(server) && b.isHealthy(server) {
+			healthyPool = append(healthyPool, server)
+		}
+	}
+	b.healthyPool = healthyPool
+}
+
+// inRotation tells whether the server is in healthyPool. The caller holds
+// b.lock.
+func (b *Balancer) inRotation(server string) bool {
+	return slices.Contains(b.healthyPool, server)
+}
+
+// forget drops the state of a server leaving the pool. The caller holds
+// b.lock.
+func (b *Balancer) forget(server string) {
+	b.stopDraining(server)
+	b.forgetBreaker(server)
+	delete(b.health, server)
+}
+
+// setBackends replaces the pool. Servers that stay keep their health,
+// traffic and draining, new ones are pending until their first probe
+// passes, and requests already forwarded to removed ones are left to
+// finish.
+func (b *Balancer) setBackends(backends []Backend) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	previous := b.backends
+	b.pool = make([]string, 0, len(backends))
+	b.backends = make(map[string]Backend, len(backends))
+	for _, backend := range backends {
+		b.pool = append(b.pool, backend.Address)
+		b.backends[backend.Address] = backend
+	}
+	for server := range previous {
+		if _, ok := b.backends[server]; !ok {
+			b.forget(server)
+		}
+	}
+	b.updateHealthyPool()
+	b.syncHealthChecks()
+	log.Printf("Backends: %v", b.pool)
+}
+
+// addBackend adds a server to the pool, which is pending until its first
+// probe passes.
+func (b *Balancer) addBackend(backend Backend) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.backends[backend.Address]; ok {
+		return errBackendExists
+	}
+	b.pool = append(b.pool, backend.Address)
+	b.backends[backend.Address] = backend
+	b.updateHealthyPool()
+	b.syncHealthChecks()
+	log.Printf("Backend %s added", backend.Address)
+	return nil
+}
+
+// removeBackend takes a server out of the pool at once. Requests already
+// forwarded to it are left to finish.
+func (b *Balancer) removeBackend(server string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.backends[server]; !ok {
+		return errBackendNotFound
+	}
+	delete(b.backends, server)
+	b.pool = slices.DeleteFunc(b.pool, func(s string) bool { return s == server })
+	b.forget(server)
+	b.updateHealthyPool()
+	b.syncHealthChecks()
+	log.Printf("Backend %s removed", server)
+	return nil
+}
+
+// drain stops sending new requests to a server. The returned channel is
+// closed once the requests in progress have finished, or when the server
+// is removed or undrained.
+func (b *Balancer) drain(server string) (<-chan struct{}, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.backends[server]; !ok {
+		return nil, errBackendNotFound
+	}
+	drained, ok := b.draining[server]
+	if !ok {
+		drained = make(chan struct{})
+		b.draining[server] = drained
+		b.updateHealthyPool()
+		log.Printf("Draining backend %s with %d requests in progress", server, b.active[server])
+		b.checkDrained(server)
+	}
+	return drained, nil
+}
+
+// undrain returns a draining server to rotation if it is healthy.
+func (b *Balancer) undrain(server string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.backends[server]; !ok {
+		return errBackendNotFound
+	}
+	if _, ok := b.draining[server]; ok {
+		b.stopDraining(server)
+		b.updateHealthyPool()
+		log.Printf("Backend %s is back in rotation", server)
+	}
+	return nil
+}
+
+// stopDraining forgets the draining of a server, releasing those waiting
+// for it. The caller holds b.lock.
+func (b *Balancer) stopDraining(server string) {
+	if drained, ok := b.draining[server]; ok {
+		select {
+		case <-drained:
+		default:
+			close(drained)
+		}
+		delete(b.draining, server)
+	}
+}
+
+// checkDrained reports a draining server that has no requests in progress.
+// The caller holds b.lock.
+func (b *Balancer) checkDrained(server string) {
+	drained, ok := b.draining[server]
+	if !ok || b.active[server] > 0 {
+		return
+	}
+	select {
+	case <-drained:
+	default:
+		close(drained)
+		log.Printf("Backend %s drained", server)
+	}
+}
+
+func (b *Balancer) begin(server string, strategy Strategy) {
+	b.lock.Lock()
+	b.active[server]++
+	b.breakerBegin(server)
+	b.lock.Unlock()
+	strategy.Begin(server)
+}
+
+func (b *Balancer) done(server string, bytes int64, strategy Strategy) {
+	strategy.Done(server, bytes)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.active[server]--; b.active[server] == 0 {
+		delete(b.active, server)
+	}
+	b.checkDrained(server)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// hopHeaders only apply to a single connection, so they are not forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers, including those listed
+// in Connection.
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// hasToken tells whether comma-separated header values contain token.
+func hasToken(values []string, token string) bool {
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeType returns the protocol a request or response upgrades to, or ""
+// if it does not upgrade.
+func upgradeType(h http.Header) string {
+	if !hasToken(h["Connection"], "upgrade") {
+		return ""
+	}
+	return h.Get("Upgrade")
+}
+
+// outgoingRequest prepares a copy of r for dst: hop-by-hop headers are
+// removed, except for an upgrade and trailers, and the client is recorded
+// in the X-Forwarded headers.
+func (b *Balancer) outgoingRequest(dst string, r *http.Request) (*http.Request, error) {
+	fwdRequest := r.Clone(r.Context())
+	fwdRequest.RequestURI = ""
+	fwdRequest.URL.Host = dst
+	fwdRequest.URL.Scheme = b.scheme(dst)
+	fwdRequest.Host = dst
+	if r.GetBody != nil {
+		body, err := r.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		fwdRequest.Body = body
+	}
+
+	upgrade := upgradeType(r.Header)
+	removeHopHeaders(fwdRequest.Header)
+	if hasToken(r.Header["Te"], "trailers") {
+		fwdRequest.Header.Set("Te", "trailers")
+	}
+	if upgrade != "" {
+		fwdRequest.Header.Set("Connection", "Upgrade")
+		fwdRequest.Header.Set("Upgrade", upgrade)
+	}
+
+	if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		fwdRequest.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+clientIP(r))
+	} else {
+		fwdRequest.Header.Set("X-Forwarded-For", clientIP(r))
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	fwdRequest.Header.Set("X-Forwarded-Proto", proto)
+	fwdRequest.Header.Set("X-Forwarded-Host", r.Host)
+	return fwdRequest, nil
+}
+
+// bufferBody reads the body of r into memory, if it is small enough, so
+// that it can be sent again on a retry.
+func bufferBody(r *http.Request) error {
+	if r.Body == nil || r.Body == http.NoBody || r.GetBody != nil {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRetryBody+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxRetryBody {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil
+	}
+	r.Body.Close()
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return nil
+}
+
+// copyResponse writes the status, body and trailers of resp to rw. Bodies
+// of unknown length and event streams are flushed as they arrive.
+func copyResponse(rw http.ResponseWriter, resp *http.Response) (int64, error) {
+	if len(resp.Trailer) > 0 {
+		names := make([]string, 0, len(resp.Trailer))
+		for name := range resp.Trailer {
+			names = append(names, name)
+		}
+		rw.Header().Set("Trailer", strings.Join(names, ", "))
+	}
+	rw.WriteHeader(resp.StatusCode)
+
+	var w io.Writer = rw
+	if resp.ContentLength == -1 || strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		// Streams may outlast the write timeout of the server.
+		rc := http.NewResponseController(rw)
+		_ = rc.SetWriteDeadline(time.Time{})
+		w = &flushWriter{rw: rw, rc: rc}
+	}
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return n, err
+	}
+	for name, values := range resp.Trailer {
+		rw.Header()[name] = values
+	}
+	return n, nil
+}
+
+// flushWriter sends every write to the client at once.
+type flushWriter struct {
+	rw http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	n, err := w.rw.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if err := w.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return n, err
+	}
+	return n, nil
+}
+
+// switchProtocols completes an upgrade, such as a WebSocket handshake,
+// by taking over the client connection and copying data both ways until
+// either side closes. It returns the number of bytes sent to the client.
+func switchProtocols(rw http.ResponseWriter, r *http.Request, resp *http.Response, upgrade string) (int64, error) {
+	if requested := upgradeType(r.Header); !strings.EqualFold(upgrade, requested) {
+		rw.WriteHeader(http.StatusBadGateway)
+		return 0, fmt.Errorf("backend switched to %q instead of %q", upgrade, requested)
+	}
+	backend, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		rw.WriteHeader(http.StatusBadGateway)
+		return 0, errors.New("backend connection cannot be upgraded")
+	}
+	defer backend.Close()
+
+	conn, brw, err := http.NewResponseController(rw).Hijack()
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return 0, err
+	}
+	// Hijack clears the deadlines the server set for the request, so the
+	// connection is not cut off by its timeouts.
+	defer conn.Close()
+
+	rw.Header().Set("Connection", "Upgrade")
+	rw.Header().Set("Upgrade", upgrade)
+	fmt.Fprintf(brw, "HTTP/1.1 %s\r\n", resp.Status)
+	rw.Header().Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		return 0, err
+	}
+
+	sent := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(conn, backend)
+		conn.Close()
+		sent <- n
+	}()
+	if _, err := io.Copy(backend, brw); err != nil {
+		log.Printf("Upgraded connection closed: %s", err)
+	}
+	backend.Close()
+	return <-sent, nil
+}
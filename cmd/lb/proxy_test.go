@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newProxy starts a backend with the given handler and a balancer in front
+// of it, returning the balancer and its URL.
+func newProxy(t *testing.T, handler http.HandlerFunc) (*Balancer, string) {
+	t.Helper()
+	backend := httptest.NewServer(handler)
+	t.Cleanup(backend.Close)
+	balancer := NewBalancer([]string{strings.TrimPrefix(backend.URL, "http://")},
+		&MockHealthChecker{}, &DefaultRequestSender{}, time.Second, false)
+	front := httptest.NewServer(balancer.handler())
+	t.Cleanup(front.Close)
+	return balancer, front.URL
+}
+
+// recordingSender answers with resp and keeps the requests it was sent,
+// along with their bodies.
+type recordingSender struct {
+	down map[string]bool
+	resp func() *http.Response
+
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []string
+}
+
+func (s *recordingSender) Send(req *http.Request) (*http.Response, error) {
+	body, _ := io.ReadAll(req.Body)
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	s.bodies = append(s.bodies, string(body))
+	s.mu.Unlock()
+	if s.down[req.URL.Host] {
+		return nil, fmt.Errorf("connection refused")
+	}
+	resp := s.resp()
+	resp.Request = req
+	return resp, nil
+}
+
+func okResponse() *http.Response {
+	return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: http.NoBody}
+}
+
+func TestForward_HopHeaders(t *testing.T) {
+	sender := &recordingSender{resp: func() *http.Response {
+		resp := okResponse()
+		resp.Header.Set("Connection", "X-Backend-Hop")
+		resp.Header.Set("X-Backend-Hop", "1")
+		resp.Header.Set("Keep-Alive", "timeout=5")
+		resp.Header.Set("X-Backend", "kept")
+		return resp
+	}}
+	balancer := NewBalancer([]string{"server1"}, &MockHealthChecker{}, sender, time.Second, false)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Connection", "keep-alive, X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "1")
+	req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	req.Header.Set("Te", "trailers, deflate")
+	req.Header.Set("X-Client", "kept")
+	rr := serveRequest(balancer, req)
+
+	sent := sender.requests[0].Header
+	for _, name := range []string{"Connection", "X-Client-Hop", "Proxy-Authorization", "Upgrade"} {
+		if value := sent.Get(name); value != "" {
+			t.Errorf("Expected %s not to be forwarded, got %q", name, value)
+		}
+	}
+	if sent.Get("X-Client") != "kept" || sent.Get("Te") != "trailers" {
+		t.Errorf("Expected end-to-end headers and Te: trailers to be forwarded, got %v", sent)
+	}
+	for _, name := range []string{"Connection", "X-Backend-Hop", "Keep-Alive"} {
+		if value := rr.Header().Get(name); value != "" {
+			t.Errorf("Expected %s not to be returned, got %q", name, value)
+		}
+	}
+	if rr.Header().Get("X-Backend") != "kept" {
+		t.Errorf("Expected end-to-end response headers to be returned, got %v", rr.Header())
+	}
+}
+
+func TestForward_ForwardedHeaders(t *testing.T) {
+	sender := &recordingSender{resp: okResponse}
+	balancer := NewBalancer([]string{"server1"}, &MockHealthChecker{}, sender, time.Second, false)
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	serveRequest(balancer, req)
+
+	req = httptest.NewRequest("GET", "https://example.com:8443/", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	req.TLS = &tls.ConnectionState{}
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	serveRequest(balancer, req)
+
+	for i, expected := range []map[string]string{
+		{"X-Forwarded-For": "10.0.0.1", "X-Forwarded-Proto": "http", "X-Forwarded-Host": "example.com"},
+		{"X-Forwarded-For": "192.0.2.1, 10.0.0.2", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "example.com:8443"},
+	} {
+		for name, value := range expected {
+			if got := sender.requests[i].Header.Get(name); got != value {
+				t.Errorf("Request %d: expected %s %q, got %q", i, name, value, got)
+			}
+		}
+		if host := sender.requests[i].Host; host != "server1" {
+			t.Errorf("Request %d: expected host server1, got %q", i, host)
+		}
+	}
+}
+
+func TestForward_RetryWithBody(t *testing.T) {
+	sender := &recordingSender{down: map[string]bool{"server1": true}, resp: okResponse}
+	balancer := newRetryBalancer(sender, "server1", "server2")
+	balancer.retryConfig.Methods = []string{"PUT"}
+
+	rr := serveRequest(balancer, httptest.NewRequest("PUT", "/", strings.NewReader("value")))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected the request to be retried, got %d", rr.Code)
+	}
+	if len(sender.bodies) != 2 || sender.bodies[0] != "value" || sender.bodies[1] != "value" {
+		t.Errorf("Expected the body to be sent to both servers, got %q", sender.bodies)
+	}
+}
+
+func TestForward_Trailers(t *testing.T) {
+	_, url := newProxy(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Trailer", "X-Checksum")
+		rw.Write([]byte("data"))
+		rw.Header().Set("X-Checksum", "8d777f38")
+	})
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "data" {
+		t.Errorf("Expected body data, got %q", body)
+	}
+	if checksum := resp.Trailer.Get("X-Checksum"); checksum != "8d777f38" {
+		t.Errorf("Expected trailer X-Checksum, got %v", resp.Trailer)
+	}
+}
+
+func TestForward_Streaming(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	_, url := newProxy(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.Write([]byte("data: first\n\n"))
+		rw.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+
+	line := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			line <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		s, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- s
+	}()
+	select {
+	case s := <-line:
+		if s != "data: first\n" {
+			t.Errorf("Expected the first event, got %q", s)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Error("Expected the first event before the response ends")
+	}
+}
+
+func TestForward_Upgrade(t *testing.T) {
+	balancer, url := newProxy(t, func(rw http.ResponseWriter, r *http.Request) {
+		if upgradeType(r.Header) != "echo" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := http.NewResponseController(rw).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	})
+	balancer.timeout = 100 * time.Millisecond
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: lb\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "echo" {
+		t.Fatalf("Expected the connection to switch to echo, got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// The upgraded connection outlives the request timeout.
+	time.Sleep(200 * time.Millisecond)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	for _, message := range []string{"ping\n", "pong\n"} {
+		if _, err := conn.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		echo, err := reader.ReadString('\n')
+		if err != nil || echo != message {
+			t.Fatalf("Expected echo %q, got %q (%v)", message, echo, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const retryBudgetWindow = 10 * time.Second
+
+// maxRetryBody is the largest request body bufferBody keeps in memory so
+// that the request can be retried on another backend.
+const maxRetryBody = 1 << 20
+
+// RetryConfig sets which requests are retried on another backend when the
+// chosen one cannot be reached, at most MaxRetries times each. Requests with
+// a body are only retried if it fits in maxRetryBody.
+type RetryConfig struct {
+	Methods    []string
+	MaxRetries int
+}
+
+// parseMethods reads a comma-separated list of HTTP methods.
+func parseMethods(s string) ([]string, error) {
+	var methods []string
+	for _, method := range strings.Split(s, ",") {
+		if method = strings.ToUpper(strings.TrimSpace(method)); method == "" {
+			continue
+		}
+		if strings.ContainsAny(method, " \t/") {
+			return nil, fmt.Errorf("invalid method %q", method)
+		}
+		methods = append(methods, method)
+	}
+	return methods, nil
+}
+
+func (c RetryConfig) retryable(r *http.Request) bool {
+	return c.MaxRetries > 0 && slices.Contains(c.Methods, r.Method) && (r.Body == nil || r.Body == http.NoBody || r.GetBody != nil)
+}
+
+// retryBudget keeps retries from amplifying an outage: within every window
+// it allows ratio retries per request plus minPerSecond retries per second.
+type retryBudget struct {
+	ratio        float64
+	minPerSecond float64
+	now          func() time.Time
+
+	mu       sync.Mutex
+	start    time.Time
+	requests int
+	retries  int
+}
+
+func newRetryBudget(ratio, minPerSecond float64) *retryBudget {
+	return &retryBudget{ratio: ratio, minPerSecond: minPerSecond, now: time.Now}
+}
+
+// roll starts a new window if the current one has passed. The caller holds
+// rb.mu.
+func (rb *retryBudget) roll() {
+	if now := rb.now(); now.Sub(rb.start) >= retryBudgetWindow {
+		rb.start, rb.requests, rb.retries = now, 0, 0
+	}
+}
+
+func (rb *retryBudget) request() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.roll()
+	rb.requests++
+}
+
+// retry takes a retry from the budget, telling whether there was one left.
+func (rb *retryBudget) retry() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.roll()
+	allowed := rb.ratio*float64(rb.requests) + rb.minPerSecond*retryBudgetWindow.Seconds()
+	if float64(rb.retries+1) > allowed {
+		return false
+	}
+	rb.retries++
+	return true
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hostSender fails the requests to the hosts listed in down and records
+// where every request went.
+type hostSender struct {
+	down map[string]bool
+
+	mu   sync.Mutex
+	sent []string
+}
+
+func (s *hostSender) Send(req *http.Request) (*http.Response, error) {
+	s.mu.Lock()
+	s.sent = append(s.sent, req.URL.Host)
+	s.mu.Unlock()
+	if s.down[req.URL.Host] {
+		return nil, errors.New("connection refused")
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(req.URL.Host)),
+		Request:    req,
+	}, nil
+}
+
+func newRetryBalancer(sender RequestSender, servers ...string) *Balancer {
+	balancer := NewBalancer(servers, &MockHealthChecker{}, sender, time.Second, false)
+	balancer.strategy = &roundRobin{}
+	balancer.retryConfig = RetryConfig{Methods: []string{"GET", "HEAD"}, MaxRetries: 2}
+	balancer.retryBudget = newRetryBudget(0.2, 10)
+	return balancer
+}
+
+func enableTracing(t *testing.T) {
+	enabled := *traceEnabled
+	*traceEnabled = true
+	t.Cleanup(func() { *traceEnabled = enabled })
+}
+
+func TestServe_RetriesOnAnotherServer(t *testing.T) {
+	enableTracing(t)
+	sender := &hostSender{down: map[string]bool{"server1": true}}
+	balancer := newRetryBalancer(sender, "server1", "server2")
+
+	rr := httptest.NewRecorder()
+	balancer.serve(rr, httptest.NewRequest("GET", "/", nil))
+
+	if rr.Code != http.StatusOK || rr.Body.String() != "server2" {
+		t.Fatalf("Expected a response from server2, got %d %q", rr.Code, rr.Body.String())
+	}
+	if retries := rr.Header().Get("lb-retries"); retries != "1" {
+		t.Errorf("Expected lb-retries 1, got %q", retries)
+	}
+	if from := rr.Header().Get("lb-from"); from != "server2" {
+		t.Errorf("Expected lb-from server2, got %q", from)
+	}
+}
+
+func TestServe_NoRetry(t *testing.T) {
+	for name, req := range map[string]*http.Request{
+		"method":     httptest.NewRequest("POST", "/", nil),
+		"large body": httptest.NewRequest("GET", "/", strings.NewReader(strings.Repeat("x", maxRetryBody+1))),
+	} {
+		sender := &hostSender{down: map[string]bool{"server1": true}}
+		balancer := newRetryBalancer(sender, "server1", "server2")
+
+		rr := httptest.NewRecorder()
+		balancer.serve(rr, req)
+
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: expected status Service Unavailable, got %d", name, rr.Code)
+		}
+		if expected := []string{"server1"}; !reflect.DeepEqual(sender.sent, expected) {
+			t.Errorf("%s: expected requests to %v, got %v", name, expected, sender.sent)
+		}
+	}
+}
+
+func TestServe_MaxRetries(t *testing.T) {
+	sender := &hostSender{down: map[string]bool{"server1": true, "server2": true, "server3": true}}
+	balancer := newRetryBalancer(sender, "server1", "server2", "server3")
+	balancer.retryConfig.MaxRetries = 1
+
+	rr := httptest.NewRecorder()
+	balancer.serve(rr, httptest.NewRequest("GET", "/", nil))
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status Service Unavailable, got %d", rr.Code)
+	}
+	if len(sender.sent) != 2 || sender.sent[0] == sender.sent[1] {
+		t.Errorf("Expected requests to two different servers, got %v", sender.sent)
+	}
+}
+
+func TestServe_RetryBudget(t *testing.T) {
+	sender := &hostSender{down: map[string]bool{"server1": true}}
+	balancer := newRetryBalancer(sender, "server1", "server2")
+	balancer.retryBudget = newRetryBudget(0, 0)
+
+	rr := httptest.NewRecorder()
+	balancer.serve(rr, httptest.NewRequest("GET", "/", nil))
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status Service Unavailable without a budget, got %d", rr.Code)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	budget := newRetryBudget(0.5, 0)
+	now := time.Unix(0, 0)
+	budget.now = func() time.Time { return now }
+
+	for i := 0; i < 4; i++ {
+		budget.request()
+	}
+	for i := 0; i < 2; i++ {
+		if !budget.retry() {
+			t.Fatalf("Expected retry %d to be allowed", i)
+		}
+	}
+	if budget.retry() {
+		t.Fatal("Expected the budget to be used up")
+	}
+
+	now = now.Add(retryBudgetWindow)
+	if budget.retry() {
+		t.Error("Expected no retries in a new window without requests")
+	}
+	budget.request()
+	budget.request()
+	if !budget.retry() {
+		t.Error("Expected a retry in a new window")
+	}
+
+	budget = newRetryBudget(0, 0.1)
+	if !budget.retry() || budget.retry() {
+		t.Error("Expected exactly one retry per window from the minimum rate")
+	}
+}
+
+func TestParseMethods(t *testing.T) {
+	methods, err := parseMethods("get, HEAD,,OPTIONS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"GET", "HEAD", "OPTIONS"}; !reflect.DeepEqual(methods, expected) {
+		t.Errorf("Expected %v, got %v", expected, methods)
+	}
+	if _, err := parseMethods("GET /"); err == nil {
+		t.Error("Expected an error for an invalid method")
+	}
+}
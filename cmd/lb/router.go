@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// route is a Route of the current config bound to its pool.
+type route struct {
+	Route
+	pool     *Balancer
+	strategy Strategy
+}
+
+// matches tells whether a request matches the route.
+func (ro *route) matches(r *http.Request) bool {
+	if ro.Host != "" && !matchHost(ro.Host, r.Host) {
+		return false
+	}
+	if ro.PathPrefix != "" && !matchPathPrefix(ro.PathPrefix, r.URL.Path) {
+		return false
+	}
+	if len(ro.Methods) > 0 && !slices.ContainsFunc(ro.Methods, func(m string) bool {
+		return strings.EqualFold(m, r.Method)
+	}) {
+		return false
+	}
+	for name, value := range ro.Headers {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return len(host) > len(suffix) && strings.HasSuffix(strings.ToLower(host), strings.ToLower(suffix))
+	}
+	return strings.EqualFold(pattern, host)
+}
+
+func matchPathPrefix(prefix, path string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return strings.HasSuffix(prefix, "/") || len(path) == len(prefix) || path[len(prefix)] == '/'
+}
+
+// Router sends requests to named pools by the first route they match, and
+// those that match none to the default pool. Every pool is a Balancer with
+// its own backends, health checks and circuit breakers.
+type Router struct {
+	// newPool creates an empty pool with the settings given by flags.
+	newPool  func() *Balancer
+	strategy string
+	halfLife time.Duration
+
+	// reload serializes apply.
+	reload sync.Mutex
+
+	mu         sync.RWMutex
+	pools      map[string]*Balancer
+	strategies map[string]string
+	routes     []*route
+	ctx        context.Context
+	cancel     map[string]context.CancelFunc
+}
+
+// NewRouter creates a router without pools. Pools use the strategy with
+// the given name unless their config sets another one.
+func NewRouter(newPool func() *Balancer, strategy string, halfLife time.Duration) *Router {
+	return &Router{
+		newPool:    newPool,
+		strategy:   strategy,
+		halfLife:   halfLife,
+		pools:      make(map[string]*Balancer),
+		strategies: make(map[string]string),
+		cancel:     make(map[string]context.CancelFunc),
+	}
+}
+
+// pool returns the pool with the given name, or nil if there is none.
+func (rt *Router) pool(name string) *Balancer {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.pools[name]
+}
+
+// apply switches the router to the pools and routes of config. Pools that
+// stay keep the state of their backends, new pools are health checked
+// before they get requests, and the health checks of removed pools stop.
+func (rt *Router) apply(config *Config) error {
+	rt.reload.Lock()
+	defer rt.reload.Unlock()
+
+	rt.mu.RLock()
+	pools := make(map[string]*Balancer, len(rt.pools))
+	for name, pool := range rt.pools {
+		pools[name] = pool
+	}
+	strategies := make(map[string]string, len(rt.strategies))
+	for name, strategy := range rt.strategies {
+		strategies[name] = strategy
+	}
+	ctx := rt.ctx
+	rt.mu.RUnlock()
+
+	configs := config.pools()
+	added := make(map[string]bool)
+	for name, pc := range configs {
+		pool, ok := pools[name]
+		if !ok {
+			pool = rt.newPool()
+			pools[name] = pool
+			added[name] = true
+		}
+		strategyName := pc.Strategy
+		if strategyName == "" {
+			strategyName = rt.strategy
+		}
+		if strategies[name] != strategyName {
+			strategy, err := newStrategy(strategyName, pool, rt.halfLife)
+			if err != nil {
+				return err
+			}
+			pool.lock.Lock()
+			pool.strategy = strategy
+			pool.lock.Unlock()
+			strategies[name] = strategyName
+		}
+		pool.setBackends(pc.Backends)
+	}
+
+	routes := make([]*route, len(config.Routes))
+	for i, r := range config.Routes {
+		routes[i] = &route{Route: r, pool: pools[r.Pool]}
+		if r.Strategy != "" {
+			strategy, err := newStrategy(r.Strategy, routes[i].pool, rt.halfLife)
+			if err != nil {
+				return err
+			}
+			routes[i].strategy = strategy
+		}
+	}
+
+	cancels := make(map[string]context.CancelFunc)
+	if ctx != nil {
+		for name := range added {
+			cancels[name] = rt.startPool(ctx, name, pools[name])
+		}
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for name := range pools {
+		if _, ok := configs[name]; !ok {
+			if cancel, ok := rt.cancel[name]; ok {
+				cancel()
+				delete(rt.cancel, name)
+			}
+			delete(pools, name)
+			delete(strategies, name)
+			log.Printf("Pool %s removed", name)
+		}
+	}
+	for name, cancel := range cancels {
+		rt.cancel[name] = cancel
+	}
+	rt.pools, rt.strategies, rt.routes = pools, strategies, routes
+	return nil
+}
+
+// startPool starts the health checks of a pool, which stop once the pool is
+// removed or ctx is done.
+func (rt *Router) startPool(ctx context.Context, name string, pool *Balancer) context.CancelFunc {
+	ctx, cancel := context.WithCancel(ctx)
+	log.Printf("Checking health of pool %s", name)
+	pool.startHealthChecks(ctx)
+	return cancel
+}
+
+// start health checks every pool until ctx is done, and so every pool
+// added later.
+func (rt *Router) start(ctx context.Context) {
+	rt.reload.Lock()
+	defer rt.reload.Unlock()
+
+	rt.mu.RLock()
+	pools := make(map[string]*Balancer, len(rt.pools))
+	for name, pool := range rt.pools {
+		pools[name] = pool
+	}
+	rt.mu.RUnlock()
+
+	var mu sync.Mutex
+	cancels := make(map[string]context.CancelFunc, len(pools))
+	var wg sync.WaitGroup
+	for name, pool := range pools {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cancel := rt.startPool(ctx, name, pool)
+			mu.Lock()
+			cancels[name] = cancel
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.ctx = ctx
+	for name, cancel := range cancels {
+		rt.cancel[name] = cancel
+	}
+}
+
+// wait waits for the health checks of every pool to stop once the context
+// given to start is done.
+func (rt *Router) wait() {
+	rt.mu.RLock()
+	pools := make([]*Balancer, 0, len(rt.pools))
+	for _, pool := range rt.pools {
+		pools = append(pools, pool)
+	}
+	rt.mu.RUnlock()
+	for _, pool := range pools {
+		pool.waitHealthChecks()
+	}
+}
+
+// match returns the pool name and policy for a request, or a nil pool if
+// it matches no route and there is no default pool.
+func (rt *Router) match(r *http.Request) (string, *Balancer, policy) {
+	rt.mu.RLock()
+	routes := rt.routes
+	defaultBalancer := rt.pools[defaultPool]
+	rt.mu.RUnlock()
+
+	for _, route := range routes {
+		if !route.matches(r) {
+			continue
+		}
+		p := route.pool.policy()
+		if route.strategy != nil {
+			p.strategy = route.strategy
+		}
+		if route.Timeout > 0 {
+			p.timeout = time.Duration(route.Timeout)
+		}
+		return route.Pool, route.pool, p
+	}
+	if defaultBalancer == nil {
+		return "", nil, policy{}
+	}
+	return defaultPool, defaultBalancer, defaultBalancer.policy()
+}
+
+// serve forwards a client request to the pool of its route.
+func (rt *Router) serve(rw http.ResponseWriter, r *http.Request) {
+	name, pool, p := rt.match(r)
+	if pool == nil {
+		http.Error(rw, "no route", http.StatusNotFound)
+		return
+	}
+	if *traceEnabled {
+		rw.Header().Set("lb-pool", name)
+	}
+	pool.serveWith(rw, r, p)
+}
+
+// PoolStatus is a pool as listed by GET /admin/pools.
+type PoolStatus struct {
+	Strategy string          `json:"strategy"`
+	Backends []BackendStatus `json:"backends"`
+}
+
+func (rt *Router) listPools(rw http.ResponseWriter, r *http.Request) {
+	rt.mu.RLock()
+	statuses := make(map[string]PoolStatus, len(rt.pools))
+	for name, pool := range rt.pools {
+		statuses[name] = PoolStatus{Strategy: rt.strategies[name], Backends: pool.backendStatuses()}
+	}
+	rt.mu.RUnlock()
+	writeJSON(rw, http.StatusOK, statuses)
+}
+
+// handler routes every request to its pool.
+func (rt *Router) handler() http.Handler {
+	return http.HandlerFunc(rt.serve)
+}
+
+// adminHandler serves the admin endpoints of every pool.
+func (rt *Router) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/pools", rt.listPools)
+	for _, e := range backendEndpoints {
+		handle := func(rw http.ResponseWriter, r *http.Request) {
+			name := r.PathValue("pool")
+			if name == "" {
+				name = defaultPool
+			}
+			pool := rt.pool(name)
+			if pool == nil {
+				http.Error(rw, "pool not found", http.StatusNotFound)
+				return
+			}
+			e.handle(pool, rw, r)
+		}
+		mux.HandleFunc(e.method+" /admin"+e.path, handle)
+		mux.HandleFunc(e.method+" /admin/pools/{pool}"+e.path, handle)
+	}
+	return mux
+}
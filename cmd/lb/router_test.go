@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRouter(sender RequestSender) *Router {
+	return NewRouter(func() *Balancer {
+		pool := NewBalancer(nil, &MockHealthChecker{}, sender, time.Second, false)
+		pool.retryConfig = RetryConfig{Methods: []string{"GET", "HEAD"}}
+		return pool
+	}, "least-bytes", time.Minute)
+}
+
+// namedServer starts a backend that responds with its name, or after delay
+// unless the request is cancelled first.
+func namedServer(t *testing.T, name string, delay time.Duration) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		rw.Write([]byte(name))
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func routeRequest(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	return rr
+}
+
+func TestRouter_Routes(t *testing.T) {
+	api, db, web := namedServer(t, "api", 0), namedServer(t, "db", 0), namedServer(t, "web", 0)
+	router := newTestRouter(&DefaultRequestSender{})
+	err := router.apply(&Config{
+		Backends: []Backend{{Address: web}},
+		Pools: map[string]PoolConfig{
+			"api": {Backends: []Backend{{Address: api}}},
+			"db":  {Backends: []Backend{{Address: db}}},
+		},
+		Routes: []Route{
+			{PathPrefix: "/api/v1", Pool: "api"},
+			{PathPrefix: "/db/", Methods: []string{"GET", "PUT"}, Pool: "db"},
+			{Host: "*.db.local", Pool: "db"},
+			{Headers: map[string]string{"lb-pool": "db"}, Pool: "db"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := router.handler()
+
+	for _, tc := range []struct {
+		method, target string
+		header         string
+		expected       string
+	}{
+		{"GET", "/api/v1/some-data", "", "api"},
+		{"GET", "/api/v1", "", "api"},
+		{"GET", "/api/v10", "", "web"},
+		{"GET", "/db/key", "", "db"},
+		{"PUT", "/db/key", "", "db"},
+		{"POST", "/db/key", "", "web"},
+		{"GET", "http://node1.db.local:8090/", "", "db"},
+		{"GET", "http://db.local/", "", "web"},
+		{"GET", "/", "db", "db"},
+		{"GET", "/", "", "web"},
+	} {
+		req := httptest.NewRequest(tc.method, tc.target, nil)
+		if tc.header != "" {
+			req.Header.Set("lb-pool", tc.header)
+		}
+		rr := routeRequest(h, req)
+		if rr.Code != http.StatusOK || rr.Body.String() != tc.expected {
+			t.Errorf("%s %s (lb-pool %q): expected %s, got %d %q", tc.method, tc.target, tc.header, tc.expected, rr.Code, rr.Body.String())
+		}
+	}
+
+	// Without a default pool requests that match no route are not found.
+	err = router.apply(&Config{
+		Pools:  map[string]PoolConfig{"api": {Backends: []Backend{{Address: api}}}},
+		Routes: []Route{{PathPrefix: "/api/", Pool: "api"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr := routeRequest(h, httptest.NewRequest("GET", "/", nil)); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 without a route, got %d", rr.Code)
+	}
+}
+
+func TestRouter_RouteTimeout(t *testing.T) {
+	slow := namedServer(t, "slow", 200*time.Millisecond)
+	router := newTestRouter(&DefaultRequestSender{})
+	err := router.apply(&Config{
+		Backends: []Backend{{Address: slow}},
+		Routes:   []Route{{PathPrefix: "/fast", Pool: defaultPool, Timeout: Duration(20 * time.Millisecond)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := router.handler()
+
+	if rr := routeRequest(h, httptest.NewRequest("GET", "/fast", nil)); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the route timeout to end the request, got %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := routeRequest(h, httptest.NewRequest("GET", "/", nil)); rr.Code != http.StatusOK || rr.Body.String() != "slow" {
+		t.Errorf("Expected the pool timeout to let the request finish, got %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestRouter_RouteStrategy(t *testing.T) {
+	server1, server2 := namedServer(t, "server1", 0), namedServer(t, "server2", 0)
+	router := newTestRouter(&DefaultRequestSender{})
+	err := router.apply(&Config{
+		Pools: map[string]PoolConfig{"api": {
+			Backends: []Backend{{Address: server1, Weight: 5}, {Address: server2}},
+			Strategy: "weighted-round-robin",
+		}},
+		Routes: []Route{
+			{PathPrefix: "/spread", Pool: "api", Strategy: "round-robin"},
+			{Pool: "api"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := router.handler()
+
+	served := func(target string) []string {
+		var servers []string
+		for i := 0; i < 2; i++ {
+			servers = append(servers, routeRequest(h, httptest.NewRequest("GET", target, nil)).Body.String())
+		}
+		return servers
+	}
+	if servers := served("/"); !reflect.DeepEqual(servers, []string{"server1", "server1"}) {
+		t.Errorf("Expected the pool strategy to favour server1, got %v", servers)
+	}
+	if servers := served("/spread"); servers[0] == servers[1] {
+		t.Errorf("Expected the route strategy to alternate, got %v", servers)
+	}
+}
+
+func TestRouter_Apply(t *testing.T) {
+	router := newTestRouter(&MockRequestSender{})
+	err := router.apply(&Config{
+		Backends: []Backend{{Address: "server1"}},
+		Pools:    map[string]PoolConfig{"db": {Backends: []Backend{{Address: "db1"}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	router.start(ctx)
+
+	web, db := router.pool(defaultPool), router.pool("db")
+	web.serverTraffic["server1"] = 100
+	err = router.apply(&Config{
+		Backends: []Backend{{Address: "server1"}, {Address: "server2"}},
+		Pools:    map[string]PoolConfig{"api": {Backends: []Backend{{Address: "api1"}}, Strategy: "round-robin"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if router.pool(defaultPool) != web || web.serverTraffic["server1"] != 100 {
+		t.Error("Expected the default pool to keep its state")
+	}
+	waitFor(t, "the default pool to get server2 once it is probed", func() bool {
+		return reflect.DeepEqual(healthyPool(web), []string{"server1", "server2"})
+	})
+	if router.pool("db") != nil {
+		t.Error("Expected the db pool to be removed")
+	}
+	db.waitHealthChecks()
+
+	api := router.pool("api")
+	if api == nil {
+		t.Fatal("Expected the api pool to be added")
+	}
+	if _, ok := api.strategy.(*roundRobin); !ok {
+		t.Errorf("Expected the api pool to use round-robin, got %T", api.strategy)
+	}
+	api.lock.RLock()
+	_, probed := api.health["api1"]
+	api.lock.RUnlock()
+	if !probed {
+		t.Error("Expected the api pool to be health checked before getting requests")
+	}
+
+	cancel()
+	router.wait()
+}
+
+func TestRouter_Admin(t *testing.T) {
+	router := newTestRouter(&MockRequestSender{})
+	err := router.apply(&Config{
+		Backends: []Backend{{Address: "server1"}},
+		Pools:    map[string]PoolConfig{"db": {Backends: []Backend{{Address: "db1"}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := router.adminHandler()
+
+	rr := routeRequest(h, httptest.NewRequest("POST", "/admin/pools/db/backends", strings.NewReader(`{"address": "db2"}`)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := routeRequest(h, httptest.NewRequest("DELETE", "/admin/backends/server1", nil)); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected the legacy endpoints to manage the default pool, got %d", rr.Code)
+	}
+	if rr := routeRequest(h, httptest.NewRequest("GET", "/admin/pools/cache/backends", nil)); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown pool, got %d", rr.Code)
+	}
+
+	rr = routeRequest(h, httptest.NewRequest("GET", "/admin/pools", nil))
+	var pools map[string]PoolStatus
+	if err := json.NewDecoder(rr.Body).Decode(&pools); err != nil {
+		t.Fatal(err)
+	}
+	addresses := make(map[string][]string)
+	for name, pool := range pools {
+		if pool.Strategy != "least-bytes" {
+			t.Errorf("Expected pool %s to use least-bytes, got %s", name, pool.Strategy)
+		}
+		addresses[name] = []string{}
+		for _, backend := range pool.Backends {
+			addresses[name] = append(addresses[name], backend.Address)
+		}
+	}
+	expected := map[string][]string{defaultPool: {}, "db": {"db1", "db2"}}
+	if !reflect.DeepEqual(addresses, expected) {
+		t.Errorf("Expected pools %v, got %v", expected, addresses)
+	}
+}
+
+func TestMatchRoute(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, value string
+		expected       bool
+	}{
+		{"example.com", "EXAMPLE.com:8090", true},
+		{"example.com", "www.example.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "example.com", false},
+	} {
+		if got := matchHost(tc.pattern, tc.value); got != tc.expected {
+			t.Errorf("host %q on %q: expected %t", tc.pattern, tc.value, tc.expected)
+		}
+	}
+	for _, tc := range []struct {
+		pattern, value string
+		expected       bool
+	}{
+		{"/api", "/api", true},
+		{"/api", "/api/v1", true},
+		{"/api", "/apis", false},
+		{"/api/", "/api", false},
+		{"/api/", "/api/v1", true},
+		{"/", "/anything", true},
+	} {
+		if got := matchPathPrefix(tc.pattern, tc.value); got != tc.expected {
+			t.Errorf("path prefix %q on %q: expected %t", tc.pattern, tc.value, tc.expected)
+		}
+	}
+}
+
+func TestParseConfig_Routes(t *testing.T) {
+	yamlConfig := `
+backends:
+  - address: server1:8080
+pools:
+  db:
+    strategy: round-robin
+    backends:
+      - address: db1:8083
+routes:
+  - name: db
+    pathPrefix: /db/
+    methods: [GET, PUT]
+    headers:
+      lb-author: mysteriousgophers
+    pool: db
+    timeout: 500ms
+    strategy: least-connections
+`
+	config, err := parseConfig([]byte(yamlConfig), "lb.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Config{
+		Backends: []Backend{{Address: "server1:8080"}},
+		Pools:    map[string]PoolConfig{"db": {Backends: []Backend{{Address: "db1:8083"}}, Strategy: "round-robin"}},
+		Routes: []Route{{
+			Name:       "db",
+			PathPrefix: "/db/",
+			Methods:    []string{"GET", "PUT"},
+			Headers:    map[string]string{"lb-author": "mysteriousgophers"},
+			Pool:       "db",
+			Timeout:    Duration(500 * time.Millisecond),
+			Strategy:   "least-connections",
+		}},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, config)
+	}
+
+	for name, invalid := range map[string]string{
+		"unknown pool":     "backends: [{address: a}]\nroutes: [{pool: db}]",
+		"default twice":    "backends: [{address: a}]\npools: {default: {backends: [{address: b}]}}",
+		"empty pool":       "pools: {db: {backends: []}}",
+		"pool strategy":    "pools: {db: {backends: [{address: a}], strategy: random}}",
+		"route strategy":   "backends: [{address: a}]\nroutes: [{pool: default, strategy: random}]",
+		"path prefix":      "backends: [{address: a}]\nroutes: [{pool: default, pathPrefix: api}]",
+		"duplicate in db":  "pools: {db: {backends: [{address: a}, {address: a}]}}",
+		"negative timeout": "backends: [{address: a}]\nroutes: [{pool: default, timeout: -1s}]",
+	} {
+		if _, err := parseConfig([]byte(invalid), "lb.yaml"); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestRouter_AdminNotPublic(t *testing.T) {
+	web := namedServer(t, "web", 0)
+	router := newTestRouter(&DefaultRequestSender{})
+	if err := router.apply(&Config{Backends: []Backend{{Address: web}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Backend paths under /admin are forwarded like any other.
+	rr := routeRequest(router.handler(), httptest.NewRequest("GET", "/admin/pools", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "web" {
+		t.Errorf("Expected the request to reach the backend, got %d %q", rr.Code, rr.Body.String())
+	}
+}
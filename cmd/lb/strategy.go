@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy picks the backend for the next request. Choose is called with
+// the balancer lock held for reading and a non-empty list of healthy
+// servers, so implementations guard their own state. Begin and Done bracket
+// every forwarded request, Done receiving the number of response bytes.
+type Strategy interface {
+	Choose(servers []string) string
+	Begin(server string)
+	Done(server string, bytes int64)
+}
+
+var strategyNames = []string{
+	"least-bytes",
+	"round-robin",
+	"weighted-round-robin",
+	"least-connections",
+	"power-of-two",
+	"decaying-traffic",
+}
+
+// newStrategy creates the strategy with the given name for b. HalfLife is
+// only used by decaying-traffic.
+func newStrategy(name string, b *Balancer, halfLife time.Duration) (Strategy, error) {
+	switch name {
+	case "least-bytes":
+		return &leastBytes{b: b}, nil
+	case "round-robin":
+		return &roundRobin{}, nil
+	case "weighted-round-robin":
+		return newWeightedRoundRobin(b), nil
+	case "least-connections":
+		return &leastConnections{b: b}, nil
+	case "power-of-two":
+		return &powerOfTwo{b: b}, nil
+	case "decaying-traffic":
+		return newDecayingTraffic(halfLife), nil
+	}
+	return nil, fmt.Errorf("unknown strategy %q, expected one of %s", name, strings.Join(strategyNames, ", "))
+}
+
+// parseWeights reads weights written as "server1:8080=3,server2:8080=1".
+func parseWeights(s string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		server, weight, ok := strings.Cut(field, "=")
+		n, err := strconv.Atoi(weight)
+		if !ok || err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid weight %q, expected <server>=<positive number>", field)
+		}
+		weights[server] = n
+	}
+	return weights, nil
+}
+
+type noHooks struct{}
+
+func (noHooks) Begin(string)       {}
+func (noHooks) Done(string, int64) {}
+
+// leastBytes picks the server that has sent the fewest bytes in total, as
+// recorded in Balancer.serverTraffic.
+type leastBytes struct {
+	noHooks
+	b *Balancer
+}
+
+func (s *leastBytes) Choose(servers []string) string {
+	var minTrafficServer string
+	var minTraffic int64 = -1
+
+	for _, server := range servers {
+		traffic := s.b.serverTraffic[server]
+		if minTraffic == -1 || traffic < minTraffic {
+			minTraffic = traffic
+			minTrafficServer = server
+		}
+	}
+	return minTrafficServer
+}
+
+type roundRobin struct {
+	noHooks
+	next atomic.Uint64
+}
+
+func (s *roundRobin) Choose(servers []string) string {
+	return servers[(s.next.Add(1)-1)%uint64(len(servers))]
+}
+
+// weightedRoundRobin is the smooth weighted round-robin of nginx: servers
+// with weights 5, 1, 1 are picked as a a b a c a a rather than in bursts.
+// Weights are those of the balancer backends.
+type weightedRoundRobin struct {
+	noHooks
+	b *Balancer
+
+	mu      sync.Mutex
+	current map[string]int
+}
+
+func newWeightedRoundRobin(b *Balancer) *weightedRoundRobin {
+	return &weightedRoundRobin{b: b, current: make(map[string]int)}
+}
+
+func (s *weightedRoundRobin) Choose(servers []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total := 0
+	best := ""
+	for _, server := range servers {
+		w := s.b.weight(server)
+		total += w
+		s.current[server] += w
+		if best == "" || s.current[server] > s.current[best] {
+			best = server
+		}
+	}
+	s.current[best] -= total
+	return best
+}
+
+// leastConnections picks the server with the fewest requests in progress,
+// as counted in Balancer.active for every route of the pool.
+type leastConnections struct {
+	noHooks
+	b *Balancer
+}
+
+func (s *leastConnections) Choose(servers []string) string {
+	best := servers[0]
+	for _, server := range servers[1:] {
+		if s.b.active[server] < s.b.active[best] {
+			best = server
+		}
+	}
+	return best
+}
+
+// powerOfTwo samples two distinct servers at random and picks the one with
+// fewer requests in progress, which avoids herding on a single idle server.
+type powerOfTwo struct {
+	noHooks
+	b *Balancer
+}
+
+func (s *powerOfTwo) Choose(servers []string) string {
+	if len(servers) == 1 {
+		return servers[0]
+	}
+	i := rand.Intn(len(servers))
+	j := rand.Intn(len(servers) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := servers[i], servers[j]
+	if s.b.active[b] < s.b.active[a] {
+		return b
+	}
+	return a
+}
+
+// decayingTraffic picks the server with the fewest recent bytes. Traffic
+// halves every halfLife, so a server coming back after a long outage is not
+// flooded until its total catches up with the others.
+type decayingTraffic struct {
+	noHooks
+	halfLife time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	traffic map[string]decayed
+}
+
+type decayed struct {
+	value   float64
+	updated time.Time
+}
+
+func newDecayingTraffic(halfLife time.Duration) *decayingTraffic {
+	if halfLife <= 0 {
+		halfLife = time.Minute
+	}
+	return &decayingTraffic{halfLife: halfLife, now: time.Now, traffic: make(map[string]decayed)}
+}
+
+func (s *decayingTraffic) valueAt(server string, now time.Time) float64 {
+	d := s.traffic[server]
+	if d.updated.IsZero() {
+		return 0
+	}
+	return d.value * math.Exp2(-float64(now.Sub(d.updated))/float64(s.halfLife))
+}
+
+func (s *decayingTraffic) Done(server string, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.traffic[server] = decayed{value: s.valueAt(server, now) + float64(bytes), updated: now}
+}
+
+func (s *decayingTraffic) Choose(servers []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	best, bestTraffic := servers[0], s.valueAt(servers[0], now)
+	for _, server := range servers[1:] {
+		if traffic := s.valueAt(server, now); traffic < bestTraffic {
+			best, bestTraffic = server, traffic
+		}
+	}
+	return best
+}
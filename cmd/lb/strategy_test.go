@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newStrategyBalancer(t *testing.T, name string, servers []string, sender RequestSender) *Balancer {
+	t.Helper()
+	balancer := NewBalancer(servers, &MockHealthChecker{}, sender, time.Second, false)
+	balancer.backends["server1"] = Backend{Address: "server1", Weight: 3}
+	strategy, err := newStrategy(name, balancer, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	balancer.strategy = strategy
+	return balancer
+}
+
+func chooseMany(b *Balancer, n int) []string {
+	chosen := make([]string, n)
+	for i := range chosen {
+		chosen[i] = b.chooseServer()
+	}
+	return chosen
+}
+
+func TestStrategy_RoundRobin(t *testing.T) {
+	balancer := newStrategyBalancer(t, "round-robin", []string{"server1", "server2", "server3"}, &MockRequestSender{})
+
+	chosen := chooseMany(balancer, 6)
+	expected := []string{"server1", "server2", "server3", "server1", "server2", "server3"}
+	if !reflect.DeepEqual(chosen, expected) {
+		t.Errorf("Expected %v, got %v", expected, chosen)
+	}
+}
+
+func TestStrategy_WeightedRoundRobin(t *testing.T) {
+	balancer := newStrategyBalancer(t, "weighted-round-robin", []string{"server1", "server2", "server3"}, &MockRequestSender{})
+
+	chosen := chooseMany(balancer, 5)
+	expected := []string{"server1", "server2", "server1", "server3", "server1"}
+	if !reflect.DeepEqual(chosen, expected) {
+		t.Errorf("Expected %v, got %v", expected, chosen)
+	}
+}
+
+func TestStrategy_LeastConnections(t *testing.T) {
+	balancer := newStrategyBalancer(t, "least-connections", []string{"server1", "server2", "server3"}, &MockRequestSender{})
+
+	balancer.begin("server1", balancer.strategy)
+	balancer.begin("server1", balancer.strategy)
+	balancer.begin("server2", balancer.strategy)
+	if chosen := balancer.chooseServer(); chosen != "server3" {
+		t.Errorf("Expected server3, got %q", chosen)
+	}
+
+	balancer.begin("server3", balancer.strategy)
+	balancer.begin("server3", balancer.strategy)
+	balancer.done("server1", 0, balancer.strategy)
+	balancer.done("server1", 0, balancer.strategy)
+	if chosen := balancer.chooseServer(); chosen != "server1" {
+		t.Errorf("Expected server1, got %q", chosen)
+	}
+}
+
+func TestStrategy_LeastConnectionsSharedByRoutes(t *testing.T) {
+	balancer := newStrategyBalancer(t, "least-connections", []string{"server1", "server2"}, &MockRequestSender{})
+	route, err := newStrategy("least-connections", balancer, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests of a route with its own strategy load the same servers.
+	balancer.begin("server1", route)
+	if chosen := balancer.chooseServer(); chosen != "server2" {
+		t.Errorf("Expected server2, got %q", chosen)
+	}
+}
+
+func TestStrategy_LeastConnectionsForward(t *testing.T) {
+	mockSender := &MockRequestSender{Err: errors.New("connection failed")}
+	balancer := newStrategyBalancer(t, "least-connections", []string{"server1", "server2"}, mockSender)
+
+	balancer.forward("server1", httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if n := balancer.active["server1"]; n != 0 {
+		t.Errorf("Expected no active connections after a failed request, got %d", n)
+	}
+}
+
+func TestStrategy_PowerOfTwo(t *testing.T) {
+	balancer := newStrategyBalancer(t, "power-of-two", []string{"server1", "server2"}, &MockRequestSender{})
+
+	balancer.begin("server1", balancer.strategy)
+	for i := 0; i < 20; i++ {
+		if chosen := balancer.chooseServer(); chosen != "server2" {
+			t.Fatalf("Expected the idle server2, got %q", chosen)
+		}
+	}
+
+	balancer.healthyPool = []string{"server1"}
+	if chosen := balancer.chooseServer(); chosen != "server1" {
+		t.Errorf("Expected the only healthy server, got %q", chosen)
+	}
+}
+
+func TestStrategy_DecayingTraffic(t *testing.T) {
+	balancer := newStrategyBalancer(t, "decaying-traffic", []string{"server1", "server2"}, &MockRequestSender{})
+	strategy := balancer.strategy.(*decayingTraffic)
+	now := time.Unix(0, 0)
+	strategy.now = func() time.Time { return now }
+
+	strategy.Done("server1", 10000)
+	now = now.Add(time.Hour)
+	strategy.Done("server2", 100)
+	if chosen := balancer.chooseServer(); chosen != "server1" {
+		t.Errorf("Expected traffic of server1 to decay, got %q", chosen)
+	}
+
+	now = now.Add(time.Minute)
+	if got := strategy.valueAt("server2", now); got != 50 {
+		t.Errorf("Expected traffic to halve after one half-life, got %v", got)
+	}
+}
+
+func TestStrategy_LeastBytesForward(t *testing.T) {
+	mockSender := &MockRequestSender{
+		Response: &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader("response")),
+		},
+	}
+	balancer := newStrategyBalancer(t, "least-bytes", []string{"server1", "server2"}, mockSender)
+
+	if err := balancer.forward("server1", httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if chosen := balancer.chooseServer(); chosen != "server2" {
+		t.Errorf("Expected server2, got %q", chosen)
+	}
+}
+
+func TestStrategy_NoHealthyServers(t *testing.T) {
+	for _, name := range strategyNames {
+		balancer := newStrategyBalancer(t, name, []string{"server1"}, &MockRequestSender{})
+		balancer.healthyPool = nil
+		if chosen := balancer.chooseServer(); chosen != "" {
+			t.Errorf("%s: expected no server, got %q", name, chosen)
+		}
+	}
+}
+
+func TestNewStrategy_Unknown(t *testing.T) {
+	if _, err := newStrategy("random", nil, time.Minute); err == nil {
+		t.Error("Expected an error for an unknown strategy")
+	}
+}
+
+func TestParseWeights(t *testing.T) {
+	weights, err := parseWeights("server1:8080=3, server2:8080=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int{"server1:8080": 3, "server2:8080": 1}
+	if !reflect.DeepEqual(weights, expected) {
+		t.Errorf("Expected %v, got %v", expected, weights)
+	}
+
+	for _, invalid := range []string{"server1", "server1=0", "server1=x"} {
+		if _, err := parseWeights(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certFiles is a certificate and its private key in PEM files.
+type certFiles struct {
+	cert, key string
+}
+
+// parseCertFiles pairs comma-separated lists of certificate and key files.
+func parseCertFiles(certs, keys string) ([]certFiles, error) {
+	if certs == "" && keys == "" {
+		return nil, nil
+	}
+	certList, keyList := strings.Split(certs, ","), strings.Split(keys, ",")
+	if len(certList) != len(keyList) {
+		return nil, fmt.Errorf("%d certificates given with %d keys", len(certList), len(keyList))
+	}
+	files := make([]certFiles, len(certList))
+	for i := range certList {
+		files[i] = certFiles{cert: strings.TrimSpace(certList[i]), key: strings.TrimSpace(keyList[i])}
+		if files[i].cert == "" || files[i].key == "" {
+			return nil, errors.New("empty certificate or key file name")
+		}
+	}
+	return files, nil
+}
+
+// certStore holds certificates loaded from files, which can be reloaded
+// while connections are being served.
+type certStore struct {
+	files []certFiles
+
+	mu    sync.RWMutex
+	certs []*tls.Certificate
+}
+
+func newCertStore(files []certFiles) (*certStore, error) {
+	s := &certStore{files: files}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads all the certificates, keeping the current ones if any of them
+// fails to load.
+func (s *certStore) load() error {
+	certs := make([]*tls.Certificate, len(s.files))
+	for i, files := range s.files {
+		cert, err := tls.LoadX509KeyPair(files.cert, files.key)
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %v", files.cert, err)
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", files.cert, err)
+		}
+		certs[i] = &cert
+	}
+	s.mu.Lock()
+	s.certs = certs
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *certStore) paths() []string {
+	var paths []string
+	for _, files := range s.files {
+		paths = append(paths, files.cert, files.key)
+	}
+	return paths
+}
+
+// watch reloads the certificates whenever reload receives a value or their
+// files change until ctx is done.
+func (s *certStore) watch(ctx context.Context, interval time.Duration, reload <-chan os.Signal) {
+	watchFiles(ctx, s.paths(), interval, reload, func() {
+		if err := s.load(); err != nil {
+			log.Printf("Keeping the current certificates: %s", err)
+		}
+	})
+}
+
+// getCertificate picks the certificate for the server name the client asked
+// for, or the first one if none matches.
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if hello.ServerName != "" {
+		for _, cert := range s.certs {
+			if cert.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return s.certs[0], nil
+}
+
+// getClientCertificate returns the first certificate of the store for
+// backends that ask for one.
+func (s *certStore) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.certs[0], nil
+}
+
+// serverConfig serves the certificates of the store.
+func (s *certStore) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: s.getCertificate,
+	}
+}
+
+// newBackendClient creates the client used to reach backends. It trusts the
+// CAs in the caFile bundle, if given, instead of the system ones, and
+// presents the certificates of clientCerts to backends that ask for one.
+func newBackendClient(caFile string, clientCerts *certStore) (*http.Client, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	if clientCerts != nil {
+		config.GetClientCertificate = clientCerts.getClientCertificate
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mysteriousgophers/architecture-lab-4/httptools"
+)
+
+// testCA issues certificates for tests.
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	dir    string
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "lb test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, dir: t.TempDir(), serial: 1}
+}
+
+func writePEM(t *testing.T, path, kind string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// caFile writes the CA certificate and returns its path.
+func (ca *testCA) caFile(t *testing.T) string {
+	path := filepath.Join(ca.dir, "ca.pem")
+	writePEM(t, path, "CERTIFICATE", ca.cert.Raw)
+	return path
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue writes a certificate for hosts, usable by servers and clients, and
+// its key to files named after name.
+func (ca *testCA) issue(t *testing.T, name string, hosts ...string) certFiles {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := certFiles{cert: filepath.Join(ca.dir, name+".pem"), key: filepath.Join(ca.dir, name+"-key.pem")}
+	writePEM(t, files.cert, "CERTIFICATE", der)
+	writePEM(t, files.key, "PRIVATE KEY", keyDER)
+	return files
+}
+
+func servedName(t *testing.T, s *certStore, serverName string) string {
+	t.Helper()
+	cert, err := s.getCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestParseCertFiles(t *testing.T) {
+	files, err := parseCertFiles("a.pem, b.pem", "a-key.pem,b-key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[1] != (certFiles{cert: "b.pem", key: "b-key.pem"}) {
+		t.Errorf("Unexpected files %v", files)
+	}
+	if files, err := parseCertFiles("", ""); err != nil || files != nil {
+		t.Errorf("Expected no files, got %v, %v", files, err)
+	}
+	for _, invalid := range [][2]string{{"a.pem,b.pem", "a-key.pem"}, {"a.pem", ""}, {"a.pem,", "a-key.pem,"}} {
+		if _, err := parseCertFiles(invalid[0], invalid[1]); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestCertStore_SNI(t *testing.T) {
+	ca := newTestCA(t)
+	store, err := newCertStore([]certFiles{
+		ca.issue(t, "a", "a.example"),
+		ca.issue(t, "b", "b.example", "*.b.example"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for serverName, expected := range map[string]string{
+		"a.example":     "a",
+		"b.example":     "b",
+		"www.b.example": "b",
+		"c.example":     "a",
+		"":              "a",
+	} {
+		if name := servedName(t, store, serverName); name != expected {
+			t.Errorf("%q: expected certificate %s, got %s", serverName, expected, name)
+		}
+	}
+}
+
+func TestCertStore_Reload(t *testing.T) {
+	ca := newTestCA(t)
+	files := ca.issue(t, "a", "a.example")
+	store, err := newCertStore([]certFiles{files})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reload := make(chan os.Signal)
+	store.watch(ctx, 10*time.Millisecond, reload)
+
+	serial := func() int64 {
+		cert, _ := store.getCertificate(&tls.ClientHelloInfo{ServerName: "a.example"})
+		return cert.Leaf.SerialNumber.Int64()
+	}
+	first := serial()
+	ca.issue(t, "a", "a.example")
+	waitFor(t, "the certificate to be reloaded", func() bool { return serial() != first })
+
+	// A broken key keeps the current certificate.
+	second := serial()
+	if err := os.WriteFile(files.key, []byte("broken"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reload <- os.Interrupt
+	time.Sleep(50 * time.Millisecond)
+	if serial() != second {
+		t.Error("Expected a broken key to keep the current certificate")
+	}
+}
+
+func TestServeTLS(t *testing.T) {
+	ca := newTestCA(t)
+	store, err := newCertStore([]certFiles{ca.issue(t, "a", "a.example"), ca.issue(t, "b", "b.example")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(r.Header.Get("X-Forwarded-Proto")))
+	}))
+	defer backend.Close()
+	balancer := NewBalancer([]string{strings.TrimPrefix(backend.URL, "http://")},
+		&MockHealthChecker{}, &DefaultRequestSender{}, time.Second, false)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: balancer.handler()}
+	go server.Serve(tls.NewListener(ln, store.serverConfig()))
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:    ca.pool(),
+		ServerName: "b.example",
+	}}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "https" {
+		t.Errorf("Expected the request to be forwarded as https, got %d %q", resp.StatusCode, body)
+	}
+	if name := resp.TLS.PeerCertificates[0].Subject.CommonName; name != "b" {
+		t.Errorf("Expected the certificate of b.example, got %s", name)
+	}
+}
+
+func TestServeTLS_LongConnections(t *testing.T) {
+	ca := newTestCA(t)
+	store, err := newCertStore([]certFiles{ca.issue(t, "a", "a.example")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if upgradeType(r.Header) == "websocket" {
+			conn, brw, err := http.NewResponseController(rw).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+			brw.Flush()
+			io.Copy(conn, brw)
+			return
+		}
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.Write([]byte("data: first\n\n"))
+		rw.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		rw.Write([]byte("data: second\n\n"))
+	}))
+	defer backend.Close()
+	balancer := NewBalancer([]string{strings.TrimPrefix(backend.URL, "http://")},
+		&MockHealthChecker{}, &DefaultRequestSender{}, 100*time.Millisecond, false)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both the request timeout and the server timeouts are shorter than
+	// the connections below.
+	server := httptools.NewHTTPServer("", balancer.handler(), store.serverConfig())
+	server.ReadTimeout, server.WriteTimeout = 100*time.Millisecond, 100*time.Millisecond
+	go server.ServeTLS(ln, "", "")
+	defer server.Close()
+	tlsConfig := &tls.Config{RootCAs: ca.pool(), ServerName: "a.example", NextProtos: []string{"h2", "http/1.1"}}
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if proto := conn.ConnectionState().NegotiatedProtocol; proto == "h2" {
+		t.Fatal("Expected HTTP/2 to be disabled, since it cannot upgrade connections")
+	}
+	conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: a.example\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected the WebSocket handshake to succeed, got %d", resp.StatusCode)
+	}
+	time.Sleep(300 * time.Millisecond)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	for _, message := range []string{"ping\n", "pong\n"} {
+		if _, err := conn.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		if echo, err := reader.ReadString('\n'); err != nil || echo != message {
+			t.Fatalf("Expected echo %q, got %q (%v)", message, echo, err)
+		}
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, ForceAttemptHTTP2: true}}
+	resp, err = client.Get("https://" + ln.Addr().String() + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || string(body) != "data: first\n\ndata: second\n\n" {
+		t.Errorf("Expected the stream to outlive the timeouts, got %q (%v)", body, err)
+	}
+}
+
+func TestBackendTLS(t *testing.T) {
+	ca := newTestCA(t)
+	serverFiles := ca.issue(t, "backend", "127.0.0.1")
+	serverCert, err := tls.LoadX509KeyPair(serverFiles.cert, serverFiles.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool(),
+	}
+	backend.StartTLS()
+	defer backend.Close()
+	dst := strings.TrimPrefix(backend.URL, "https://")
+
+	clientStore, err := newCertStore([]certFiles{ca.issue(t, "lb")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	withClientCert, err := newBackendClient(ca.caFile(t), clientStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutClientCert, err := newBackendClient(ca.caFile(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		client   *http.Client
+		expected int
+	}{
+		{"mTLS", withClientCert, http.StatusOK},
+		{"no client certificate", withoutClientCert, http.StatusServiceUnavailable},
+		{"system CAs", nil, http.StatusServiceUnavailable},
+	} {
+		balancer := NewBalancer([]string{dst}, &MockHealthChecker{}, &DefaultRequestSender{Client: tc.client}, time.Second, true)
+		rr := serveRequest(balancer, httptest.NewRequest("GET", "/", nil))
+		if rr.Code != tc.expected {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.expected, rr.Code)
+		}
+		if tc.expected == http.StatusOK && rr.Body.String() != "lb" {
+			t.Errorf("%s: expected the backend to see the lb certificate, got %q", tc.name, rr.Body.String())
+		}
+	}
+
+	checker := &DefaultHealthChecker{Client: withClientCert}
+	check := defaultHealthCheck
+	check.ExpectStatus = http.StatusOK
+	if !checker.Probe(context.Background(), dst, true, check) {
+		t.Error("Expected health checks to reach the backend over mTLS")
+	}
+
+	if _, err := newBackendClient(serverFiles.key, nil); err == nil {
+		t.Error("Expected an error for a CA bundle without certificates")
+	}
+}
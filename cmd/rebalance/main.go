@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/mysteriousgophers/architecture-lab-4/dbclient"
+	"github.com/mysteriousgophers/architecture-lab-4/partition"
+)
+
+var (
+	nodes        = flag.String("nodes", "", "comma-separated db nodes of the new membership")
+	removed      = flag.String("removed", "", "comma-separated db nodes that left the membership")
+	virtualNodes = flag.Int("vnodes", partition.DefaultVirtualNodes, "virtual nodes per db node")
+	dbToken      = flag.String("db-token", os.Getenv("DB_TOKEN"), "bearer token for the db nodes, which needs admin access to list their namespaces")
+)
+
+func splitNodes(s string) []string {
+	var res []string
+	for _, node := range strings.Split(s, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			res = append(res, node)
+		}
+	}
+	return res
+}
+
+func main() {
+	flag.Parse()
+	members := splitNodes(*nodes)
+	if len(members) == 0 {
+		log.Fatal("-nodes is required")
+	}
+
+	client := partition.NewClient(partition.NewRing(members, *virtualNodes), dbclient.Options{Token: *dbToken})
+	moved, err := partition.Rebalance(context.Background(), client, append(members, splitNodes(*removed)...))
+	if err != nil {
+		log.Fatalf("Rebalancing failed after moving %d keys: %s", moved, err)
+	}
+	log.Printf("Rebalancing finished, %d keys moved", moved)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/mysteriousgophers/architecture-lab-4/datastore"
+)
+
+var (
+	from        = flag.String("from", "", "root directory of the current shard set")
+	fromShards  = flag.Int("from-shards", 1, "number of shards in the current shard set")
+	to          = flag.String("to", "", "root directory of the new shard set")
+	toShards    = flag.Int("to-shards", 1, "number of shards in the new shard set")
+	segmentSize = flag.Int64("segment-size", 10*1024*1024, "segment size of the new shard set")
+)
+
+func main() {
+	flag.Parse()
+	if *from == "" || *to == "" {
+		log.Fatal("both -from and -to are required")
+	}
+
+	src := datastore.ShardDirs(*from, *fromShards)
+	dst := datastore.ShardDirs(*to, *toShards)
+	if err := datastore.Reshard(src, dst, *segmentSize); err != nil {
+		log.Fatalf("Resharding failed: %s", err)
+	}
+	log.Printf("Resharded %d shards in %s into %d shards in %s", *fromShards, *from, *toShards, *to)
+}
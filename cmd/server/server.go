@@ -1,22 +1,30 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
-	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/mysteriousgophers/architecture-lab-4/dbclient"
 	"github.com/mysteriousgophers/architecture-lab-4/httptools"
+	"github.com/mysteriousgophers/architecture-lab-4/partition"
 	"github.com/mysteriousgophers/architecture-lab-4/signal"
 )
 
-var port = flag.Int("port", 8080, "server port")
+var (
+	port         = flag.Int("port", 8080, "server port")
+	dbNodes      = flag.String("db-nodes", "db:8083", "comma-separated db nodes; keys are partitioned between them by consistent hashing")
+	virtualNodes = flag.Int("db-vnodes", partition.DefaultVirtualNodes, "virtual nodes per db node")
+	dbToken      = flag.String("db-token", os.Getenv("DB_TOKEN"), "bearer token for the db nodes")
+)
 
-const url = "http://db:8083/db"
 const confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 const confHealthFailure = "CONF_HEALTH_FAILURE"
 
@@ -25,13 +33,11 @@ type Response struct {
 	Value string `json:"value"`
 }
 
-type Request struct {
-	Value string `json:"value"`
-}
-
 func main() {
+	flag.Parse()
 	h := new(http.ServeMux)
-	client := http.DefaultClient
+	ring := partition.NewRing(strings.Split(*dbNodes, ","), *virtualNodes)
+	client := partition.NewClient(ring, dbclient.Options{Token: *dbToken})
 
 	h.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
 		rw.Header().Set("content-type", "text/plain")
@@ -53,16 +59,13 @@ func main() {
 			return
 		}
 
-		resp, err := client.Get(fmt.Sprintf("%s/%s", url, key))
-		if err != nil {
-			rw.WriteHeader(http.StatusInternalServerError)
+		value, err := client.Get(r.Context(), key)
+		if errors.Is(err, dbclient.ErrNotFound) {
+			rw.WriteHeader(http.StatusNotFound)
 			return
 		}
-
-		statusOk := resp.StatusCode >= 200 && resp.StatusCode < 300
-
-		if !statusOk {
-			rw.WriteHeader(resp.StatusCode)
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
@@ -73,14 +76,12 @@ func main() {
 
 		report.Process(r)
 
-		var response Response
-		json.NewDecoder(resp.Body).Decode(&response)
-
 		rw.Header().Set("content-type", "application/json")
 		rw.WriteHeader(http.StatusOK)
-		_ = json.NewEncoder(rw).Encode(response)
-
-		defer resp.Body.Close()
+		_ = json.NewEncoder(rw).Encode(Response{
+			Key:   key,
+			Value: value,
+		})
 	})
 
 	// for tests
@@ -136,12 +137,12 @@ func main() {
 	server := httptools.CreateServer(*port, h)
 	server.Start()
 
-	buff := new(bytes.Buffer)
-	body := Request{Value: time.Now().Format(time.RFC3339)}
-	json.NewEncoder(buff).Encode(body)
-
-	res, _ := client.Post(fmt.Sprintf("%s/MysteriousGophers", url), "application/json", buff)
-	defer res.Body.Close()
+	// The db may still be starting, so the initial write is retried for longer.
+	startupClient := partition.NewClient(ring, dbclient.Options{Retries: 10, Token: *dbToken})
+	err := startupClient.Put(context.Background(), "MysteriousGophers", time.Now().Format(time.RFC3339))
+	if err != nil {
+		log.Printf("Failed to store initial data: %s", err)
+	}
 
 	signal.WaitForTerminationSignal()
 }
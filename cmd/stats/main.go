@@ -1,21 +1,27 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
 	"time"
+
+	"github.com/mysteriousgophers/architecture-lab-4/dbclient"
 )
 
-var https = flag.Bool("https", false, "whether backends support HTTPs")
+var (
+	https   = flag.Bool("https", false, "whether backends support HTTPs")
+	db      = flag.String("db", "localhost:8083", "db service address, empty to skip the db stats")
+	servers = flag.String("servers", "localhost:8080,localhost:8081,localhost:8082", "comma-separated server addresses")
+	dbToken = flag.String("db-token", os.Getenv("DB_TOKEN"), "bearer token for the db service")
+)
 
-var serversPool = []string{
-	"localhost:8080",
-	"localhost:8081",
-	"localhost:8082",
-}
+const dbKeysToShow = 5
 
 type report map[string][]string
 
@@ -26,8 +32,9 @@ func scheme() string {
 	return "http"
 }
 
-func main()  {
+func main() {
 	flag.Parse()
+	serversPool := strings.Split(*servers, ",")
 
 	client := new(http.Client)
 	client.Timeout = 10 * time.Second
@@ -59,4 +66,32 @@ func main()  {
 		data, _ := json.MarshalIndent(res[i], "", "  ")
 		log.Println(string(data))
 	}
+
+	if *db != "" {
+		dbStats(dbclient.New(*db, dbclient.Options{Timeout: 10 * time.Second, Token: *dbToken}))
+	}
+}
+
+func dbStats(client *dbclient.Client) {
+	keys := 0
+	var shown []string
+	err := client.Scan(context.Background(), "", func(key, value string) error {
+		if keys < dbKeysToShow {
+			shown = append(shown, fmt.Sprintf("%s = %s", key, value))
+		}
+		keys++
+		return nil
+	})
+
+	log.Println("=========================")
+	log.Println("DB", *db)
+	log.Println("=========================")
+	if err != nil {
+		log.Printf("error %s %s", *db, err)
+		return
+	}
+	for _, line := range shown {
+		log.Println(line)
+	}
+	log.Printf("%d keys stored", keys)
 }
@@ -0,0 +1,232 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	blobDirName   = "blobs"
+	blobTmpPrefix = "tmp-"
+)
+
+// WithBlobs stores values longer than threshold in separate blob files, so
+// they neither overflow segments nor get copied by Compact. A threshold of
+// zero or less means half the segment size. Blobs are named by the SHA-256
+// of their content and removed by Compact once no live key refers to them.
+// They cannot be combined with WithEncryption.
+func WithBlobs(threshold int64) Option {
+	return func(db *Db) {
+		db.blobs = true
+		db.blobThreshold = threshold
+	}
+}
+
+func (db *Db) blobDir() string {
+	return filepath.Join(db.dir, blobDirName)
+}
+
+func (db *Db) isLarge(value string) bool {
+	return db.blobs && int64(len(value)) > db.blobThreshold
+}
+
+// writeBlob stores the content of r and returns the name of the blob. The
+// blob is protected from collection until release is called, which has to
+// happen once the record referring to it is written or has failed.
+func (db *Db) writeBlob(r io.Reader) (name string, release func(), err error) {
+	tmp, err := os.CreateTemp(db.blobDir(), blobTmpPrefix)
+	if err != nil {
+		return "", nil, err
+	}
+	defer func() {
+		tmp.Close()
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+		return "", nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", nil, err
+	}
+	name = hex.EncodeToString(h.Sum(nil))
+
+	db.blobMu.Lock()
+	defer db.blobMu.Unlock()
+	if err := os.Rename(tmp.Name(), filepath.Join(db.blobDir(), name)); err != nil {
+		return "", nil, err
+	}
+	db.pendingBlobs[name]++
+	return name, func() {
+		db.blobMu.Lock()
+		defer db.blobMu.Unlock()
+		if db.pendingBlobs[name]--; db.pendingBlobs[name] == 0 {
+			delete(db.pendingBlobs, name)
+		}
+	}, nil
+}
+
+// storeBlobs moves the large values of entries to blobs.
+func (db *Db) storeBlobs(entries []Entry) (release func(), err error) {
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+	var releases []func()
+	release = func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	for i := range entries {
+		if entries[i].deleted || !db.isLarge(entries[i].value) {
+			continue
+		}
+		name, r, err := db.writeBlob(strings.NewReader(entries[i].value))
+		if err != nil {
+			release()
+			return nil, err
+		}
+		releases = append(releases, r)
+		entries[i].value = name
+		entries[i].blob = true
+	}
+	return release, nil
+}
+
+// openBlob returns a reader of the blob that fails with ErrHashMismatch at
+// the end if the content does not match the name, and the blob size.
+func (db *Db) openBlob(name string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(filepath.Join(db.blobDir(), name))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return &blobReader{f: f, hash: sha256.New(), name: name}, info.Size(), nil
+}
+
+type blobReader struct {
+	f    *os.File
+	hash hash.Hash
+	name string
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	n, err := r.f.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(r.hash.Sum(nil)) != r.name {
+		return n, ErrHashMismatch
+	}
+	return n, err
+}
+
+func (r *blobReader) Close() error {
+	return r.f.Close()
+}
+
+// resolve returns the value of an intact entry, reading it from its blob if
+// it has one.
+func (db *Db) resolve(entry Entry) (string, error) {
+	if !entry.blob {
+		return entry.value, nil
+	}
+	r, _, err := db.openBlob(entry.value)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	var value strings.Builder
+	if _, err := io.Copy(&value, r); err != nil {
+		return "", err
+	}
+	return value.String(), nil
+}
+
+// GetReader streams the value of the key together with its size. Values
+// kept in blobs are read from disk as the reader is consumed, and a damaged
+// blob makes the last Read fail with ErrHashMismatch.
+func (db *Db) GetReader(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	var (
+		r    io.ReadCloser
+		size int64
+	)
+	err := db.read(ctx, key, func(entry Entry) (err error) {
+		if !entry.blob {
+			r, size = io.NopCloser(strings.NewReader(entry.value)), int64(len(entry.value))
+			return nil
+		}
+		r, size, err = db.openBlob(entry.value)
+		return err
+	})
+	return r, size, err
+}
+
+// PutReader stores the content of r as the value of the key without holding
+// it in memory if it goes to a blob.
+func (db *Db) PutReader(ctx context.Context, key string, r io.Reader) error {
+	if !db.blobs {
+		var value strings.Builder
+		if _, err := io.Copy(&value, r); err != nil {
+			return err
+		}
+		return db.PutContext(ctx, key, value.String())
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	head := make([]byte, db.blobThreshold+1)
+	n, err := io.ReadFull(r, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return db.PutContext(ctx, key, string(head[:n]))
+	}
+	if err != nil {
+		return err
+	}
+
+	name, release, err := db.writeBlob(io.MultiReader(bytes.NewReader(head), r))
+	if err != nil {
+		return err
+	}
+	defer release()
+	return db.submit(ctx, &PutOp{entries: []Entry{{key: key, value: name, blob: true}}})
+}
+
+// collectBlobs removes the blobs that are neither referenced nor being
+// written. It runs with db.mu held, so no records are added meanwhile.
+func (db *Db) collectBlobs(referenced map[string]bool) error {
+	files, err := os.ReadDir(db.blobDir())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	db.blobMu.Lock()
+	defer db.blobMu.Unlock()
+	for _, file := range files {
+		name := file.Name()
+		if referenced[name] || db.pendingBlobs[name] > 0 || strings.HasPrefix(name, blobTmpPrefix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(db.blobDir(), name)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot remove blob %s: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package datastore
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func blobFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := os.ReadDir(filepath.Join(dir, blobDirName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = file.Name()
+	}
+	return names
+}
+
+func TestDb_Blobs(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, testSegmentSize, WithBlobs(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := strings.Repeat("large value ", 100)
+	if err := db.Put("large", large); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("small", testValue); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutReader(context.Background(), "streamed", strings.NewReader(large+"!")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	for _, data := range readSegments(t, dir) {
+		if strings.Contains(string(data), "large value") {
+			t.Fatal("Large value was written to a segment")
+		}
+	}
+	if files := blobFiles(t, dir); len(files) != 2 {
+		t.Errorf("Unexpected blobs %v", files)
+	}
+
+	db, err = NewDb(dir, testSegmentSize, WithBlobs(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for key, want := range map[string]string{"large": large, "small": testValue, "streamed": large + "!"} {
+		if value, err := db.Get(key); err != nil || value != want {
+			t.Errorf("Unexpected value of %s: %d bytes, %v", key, len(value), err)
+		}
+		r, size, err := db.GetReader(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || string(data) != want || size != int64(len(want)) {
+			t.Errorf("Unexpected stream of %s: %d of %d bytes, %v", key, len(data), size, err)
+		}
+	}
+}
+
+func TestDb_BlobCollection(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, testSegmentSize, WithBlobs(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	first, second := strings.Repeat("a", 100), strings.Repeat("b", 100)
+	db.Put("overwritten", first)
+	db.Put("overwritten", second)
+	db.Put("deleted", strings.Repeat("c", 100))
+	db.Delete("deleted")
+	db.Put("shared", second)
+	for i := 0; i < testRecordsCount; i++ {
+		db.Put(testKey, testValue+strconv.Itoa(i))
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if files := blobFiles(t, dir); len(files) != 1 {
+		t.Errorf("Unreferenced blobs were kept: %v", files)
+	}
+	if value, err := db.Get("overwritten"); err != nil || value != second {
+		t.Errorf("Unexpected value after collection: %v", err)
+	}
+	if value, err := db.Get("shared"); err != nil || value != second {
+		t.Errorf("Unexpected shared value after collection: %v", err)
+	}
+}
+
+func TestDb_BlobCorruption(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, testSegmentSize, WithBlobs(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Put("large", strings.Repeat("x", 100))
+	blob := filepath.Join(dir, blobDirName, blobFiles(t, dir)[0])
+	if err := os.WriteFile(blob, []byte(strings.Repeat("y", 100)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Get("large"); err != ErrHashMismatch {
+		t.Errorf("Expected ErrHashMismatch from Get, got %v", err)
+	}
+	r, _, err := db.GetReader(context.Background(), "large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := io.ReadAll(r); err != ErrHashMismatch {
+		t.Errorf("Expected ErrHashMismatch from the reader, got %v", err)
+	}
+	db.Scrub(context.Background())
+	if stats := db.Stats(); len(stats.CorruptKeys) != 1 {
+		t.Errorf("Scrubber missed the corrupt blob: %+v", stats)
+	}
+}
+
+func TestDb_BlobsWithEncryption(t *testing.T) {
+	if _, err := NewDb(t.TempDir(), testSegmentSize, WithBlobs(32), WithEncryption(testEncryptionKey(1))); err == nil {
+		t.Error("Blobs were combined with encryption")
+	}
+}
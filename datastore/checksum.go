@@ -0,0 +1,104 @@
+package datastore
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+)
+
+// Checksum names the algorithm that protects record values. Every segment
+// uses one algorithm, recorded in its header, so segments written with
+// different algorithms can be read side by side.
+type Checksum byte
+
+const (
+	// ChecksumSHA1 stores a hex-encoded SHA-1, the only algorithm of
+	// segments written before checksums became configurable.
+	ChecksumSHA1 Checksum = iota
+	ChecksumCRC32C
+	ChecksumFNV64a
+	ChecksumSHA256
+)
+
+var checksumNames = map[string]Checksum{
+	"sha1":   ChecksumSHA1,
+	"crc32c": ChecksumCRC32C,
+	"fnv64a": ChecksumFNV64a,
+	"sha256": ChecksumSHA256,
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// ParseChecksum returns the algorithm with the given name. An empty name
+// stands for the default, ChecksumSHA1.
+func ParseChecksum(name string) (Checksum, error) {
+	if name == "" {
+		return ChecksumSHA1, nil
+	}
+	c, ok := checksumNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown checksum algorithm %q", name)
+	}
+	return c, nil
+}
+
+func (c Checksum) String() string {
+	switch c {
+	case ChecksumSHA1:
+		return "sha1"
+	case ChecksumCRC32C:
+		return "crc32c"
+	case ChecksumFNV64a:
+		return "fnv64a"
+	case ChecksumSHA256:
+		return "sha256"
+	}
+	return fmt.Sprintf("checksum(%d)", byte(c))
+}
+
+func (c Checksum) valid() bool {
+	return c <= ChecksumSHA256
+}
+
+// size is the length of the hashes sum returns.
+func (c Checksum) size() int {
+	switch c {
+	case ChecksumCRC32C:
+		return crc32.Size
+	case ChecksumFNV64a:
+		return 8
+	case ChecksumSHA256:
+		return sha256.Size
+	default:
+		return 2 * sha1.Size
+	}
+}
+
+func (c Checksum) sum(value string) string {
+	switch c {
+	case ChecksumCRC32C:
+		return string(binary.BigEndian.AppendUint32(nil, crc32.Checksum([]byte(value), crc32c)))
+	case ChecksumFNV64a:
+		h := fnv.New64a()
+		h.Write([]byte(value))
+		return string(h.Sum(nil))
+	case ChecksumSHA256:
+		h := sha256.Sum256([]byte(value))
+		return string(h[:])
+	default:
+		h := sha1.New()
+		h.Write([]byte(value))
+		return fmt.Sprintf("%x", h.Sum(nil))
+	}
+}
+
+// WithChecksum makes new segments use c. Existing segments keep the
+// algorithm they were written with until they are compacted.
+func WithChecksum(c Checksum) Option {
+	return func(db *Db) {
+		db.checksum = c
+	}
+}
@@ -0,0 +1,145 @@
+package datastore
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var testChecksums = []Checksum{ChecksumSHA1, ChecksumCRC32C, ChecksumFNV64a, ChecksumSHA256}
+
+func TestDb_Checksums(t *testing.T) {
+	for _, c := range testChecksums {
+		t.Run(c.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			db, err := NewDb(dir, testSegmentSize, WithChecksum(c))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < testRecordsCount; i++ {
+				if err := db.Put(testKey+strconv.Itoa(i), testValue); err != nil {
+					t.Fatal(err)
+				}
+			}
+			db.Close()
+
+			db, err = NewDb(dir, testSegmentSize, WithChecksum(c))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for i := 0; i < testRecordsCount; i++ {
+				if value, err := db.Get(testKey + strconv.Itoa(i)); err != nil || value != testValue {
+					t.Fatalf("Unexpected value %q, %v", value, err)
+				}
+			}
+
+			corruptValue(t, dir, testValue)
+			if err := db.Scan("", func(key, value string) error { return nil }); err != ErrHashMismatch {
+				t.Errorf("Corruption was not detected: %v", err)
+			}
+		})
+	}
+}
+
+func TestDb_MixedChecksums(t *testing.T) {
+	dir := t.TempDir()
+
+	// A segment written before checksums became configurable.
+	old := Entry{key: "old", value: "value", version: 1}
+	data := append([]byte("KVS\x02"), old.Encode()...)
+	if err := os.WriteFile(filepath.Join(dir, outFileName+"0"), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDb(dir, testSegmentSize, WithChecksum(ChecksumCRC32C))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if getFilesCount(t, dir) != 2 {
+		t.Fatal("Records with another checksum were appended to the old segment")
+	}
+	if err := db.Put("new", "value"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < testRecordsCount; i++ {
+		db.Put(testKey, testValue+strconv.Itoa(i))
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"old", "new"} {
+		if value, err := db.Get(key); err != nil || value != "value" {
+			t.Errorf("Unexpected value of %s: %q, %v", key, value, err)
+		}
+	}
+	compacted, err := os.ReadFile(db.segments[0].filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(compacted), string(segmentFormat{checksum: ChecksumCRC32C}.header())) {
+		t.Errorf("Compacted segment has header %q", compacted[:5])
+	}
+}
+
+func TestParseChecksum(t *testing.T) {
+	for _, c := range testChecksums {
+		if parsed, err := ParseChecksum(c.String()); err != nil || parsed != c {
+			t.Errorf("Cannot parse %s: %v", c, err)
+		}
+	}
+	if _, err := ParseChecksum("md4"); err == nil {
+		t.Error("Unknown checksum was accepted")
+	}
+	if _, err := NewDb(t.TempDir(), testSegmentSize, WithChecksum(Checksum(100))); err == nil {
+		t.Error("Db was created with an unknown checksum")
+	}
+}
+
+func benchmarkChecksums(b *testing.B, valueSize int, fn func(b *testing.B, db *Db, value string)) {
+	value := strings.Repeat("v", valueSize)
+	for _, c := range testChecksums {
+		b.Run(c.String()+"/"+strconv.Itoa(valueSize), func(b *testing.B) {
+			db, err := NewDb(b.TempDir(), 10*1024*1024, WithChecksum(c))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			b.SetBytes(int64(valueSize))
+			fn(b, db, value)
+		})
+	}
+}
+
+func BenchmarkDb_PutChecksum(b *testing.B) {
+	for _, size := range []int{16, 4096} {
+		benchmarkChecksums(b, size, func(b *testing.B, db *Db, value string) {
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := db.Put(testKey+strconv.Itoa(i%1000), value); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDb_GetChecksum(b *testing.B) {
+	for _, size := range []int{16, 4096} {
+		benchmarkChecksums(b, size, func(b *testing.B, db *Db, value string) {
+			for i := 0; i < 1000; i++ {
+				db.Put(testKey+strconv.Itoa(i), value)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Get(testKey + strconv.Itoa(i%1000)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -2,7 +2,9 @@ package datastore
 
 import (
 	"bufio"
-	"crypto/sha1"
+	"bytes"
+	"context"
+	"crypto/cipher"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -12,16 +14,23 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
-	outFileName = "current-data"
-	bufSize     = 8192
+	outFileName     = "current-data"
+	compactFileName = "compaction-tmp"
+	bufSize         = 8192
 )
 
 var (
 	ErrNotFound     = fmt.Errorf("record does not exist")
 	ErrHashMismatch = fmt.Errorf("data integrity check failed")
+	ErrReadOnly     = fmt.Errorf("database is opened in read-only mode")
+	ErrClosed       = fmt.Errorf("database is closed")
+	ErrConflict     = fmt.Errorf("transaction conflicts with a concurrent write")
+
+	errSegmentReplaced = fmt.Errorf("segment file was replaced")
 )
 
 type hashIndex map[string]int64
@@ -40,19 +49,82 @@ type Db struct {
 	segments         []*Segment
 	mu               sync.RWMutex
 	closeOnce        sync.Once
+	closed           chan struct{}
+	writerDone       chan struct{}
+	readOnly         bool
+	// version is the last version given to a write, versions holds the
+	// current version of every key.
+	version  uint64
+	versions map[string]uint64
+
+	compactSegments int
+	compactInterval time.Duration
+	// checksum is used for the records of new segments.
+	checksum Checksum
+	// keys decrypt segments by key id. New segments are encrypted with keyID
+	// if encrypt is set.
+	keys    map[byte]cipher.AEAD
+	keyID   byte
+	encrypt bool
+	// optionErr is set by an Option that could not be applied.
+	optionErr error
+
+	blobs         bool
+	blobThreshold int64
+	// blobMu guards pendingBlobs, the blobs written for records that are
+	// not indexed yet, against collection.
+	blobMu       sync.Mutex
+	pendingBlobs map[string]int
+
+	scrub   ScrubOptions
+	scrubMu sync.Mutex
+	statsMu sync.Mutex
+	stats   Stats
+	corrupt map[string]struct{}
 }
 
+// PutOp is a group of entries the writer appends together. When
+// checkConflicts is set, the group is rejected with ErrConflict if any of
+// its keys was written after the snapshot version.
 type PutOp struct {
-	entry Entry
-	resp  chan error
+	ctx            context.Context
+	entries        []Entry
+	snapshot       uint64
+	checkConflicts bool
+	resp           chan error
 }
 
 type Segment struct {
 	index    hashIndex
 	filePath string
+	size     int64
+	// legacy segments were written before the segment header was introduced.
+	legacy bool
+	segmentFormat
+	// info identifies the file the index was built from. It is only tracked
+	// in read-only mode, where the writer may replace the file underneath us.
+	// Refresh updates it, along with the index, under the Db lock, so records
+	// are only read while holding the lock.
+	info os.FileInfo
+	// tombstones holds the indexed keys whose record in this segment is a
+	// tombstone, so that live keys can be told apart without reading them.
+	tombstones map[string]struct{}
+}
+
+// add indexes the record of key found at position.
+func (s *Segment) add(key string, position int64, deleted bool) {
+	s.index[key] = position
+	if deleted {
+		if s.tombstones == nil {
+			s.tombstones = make(map[string]struct{})
+		}
+		s.tombstones[key] = struct{}{}
+	} else {
+		delete(s.tombstones, key)
+	}
 }
 
-func NewDb(dir string, segmentSize int64) (*Db, error) {
+func NewDb(dir string, segmentSize int64, opts ...Option) (*Db, error) {
 	if err := os.MkdirAll(dir, 0o755); err != nil {
 		return nil, err
 	}
@@ -63,34 +135,84 @@ func NewDb(dir string, segmentSize int64) (*Db, error) {
 		putOps:           make(chan *PutOp),
 		segments:         make([]*Segment, 0),
 		lastSegmentIndex: -1,
+		closed:           make(chan struct{}),
+		writerDone:       make(chan struct{}),
+		versions:         make(map[string]uint64),
+		corrupt:          make(map[string]struct{}),
+		pendingBlobs:     make(map[string]int),
+	}
+	for _, opt := range opts {
+		opt(db)
+	}
+	if db.optionErr != nil {
+		return nil, db.optionErr
+	}
+	if db.blobs {
+		if db.encrypt {
+			return nil, fmt.Errorf("blobs cannot be combined with encryption")
+		}
+		if db.blobThreshold <= 0 {
+			db.blobThreshold = segmentSize / 2
+		}
+		if err := os.MkdirAll(db.blobDir(), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	if !db.checksum.valid() {
+		return nil, fmt.Errorf("unknown checksum %d", byte(db.checksum))
+	}
+	if db.encrypt && segmentSize >= 1<<32 {
+		// Record offsets are part of the nonces and have to fit 32 bits.
+		return nil, fmt.Errorf("encrypted segments cannot be larger than 4GiB")
 	}
 
 	if err := db.recoverAll(); err != nil {
 		return nil, err
 	}
 
-	if len(db.segments) == 0 {
+	lastSegment := db.getLastSegment()
+	if lastSegment == nil || lastSegment.legacy || lastSegment.size > 0 && !db.writesFormat(lastSegment.segmentFormat) {
 		if err := db.createSegment(); err != nil {
 			return nil, err
 		}
 	} else {
-		lastSegment := db.getLastSegment()
 		f, err := os.OpenFile(lastSegment.filePath, os.O_APPEND|os.O_WRONLY, 0o600)
 		if err != nil {
 			return nil, err
 		}
 		db.out = f
+		if lastSegment.size == 0 {
+			if err := db.writeHeader(lastSegment); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	go db.startPutRoutine()
+	if db.compactSegments > 0 && db.compactInterval > 0 {
+		go db.startCompactionRoutine()
+	}
+	if db.scrub.Interval > 0 {
+		go db.startScrubRoutine()
+	}
 
 	return db, nil
 }
 
+// Close stops accepting new operations, waits for the write that is already
+// in progress and closes the active segment. Operations issued after Close
+// fail with ErrClosed.
 func (db *Db) Close() error {
 	var err error
 	db.closeOnce.Do(func() {
-		close(db.putOps)
+		close(db.closed)
+		if db.readOnly {
+			return
+		}
+		<-db.writerDone
+
+		db.mu.Lock()
+		defer db.mu.Unlock()
 		if db.out != nil {
 			err = db.out.Close()
 		}
@@ -98,31 +220,92 @@ func (db *Db) Close() error {
 	return err
 }
 
+func (db *Db) isClosed() bool {
+	select {
+	case <-db.closed:
+		return true
+	default:
+		return false
+	}
+}
+
 func (db *Db) startPutRoutine() {
-	for op := range db.putOps {
-		db.mu.Lock()
-		currentSize, err := db.out.Seek(0, io.SeekEnd)
-		if err != nil {
-			op.resp <- err
-			db.mu.Unlock()
-			continue
+	defer close(db.writerDone)
+	for {
+		select {
+		case op := <-db.putOps:
+			op.resp <- db.applyPut(op)
+		case <-db.closed:
+			return
 		}
+	}
+}
+
+func (db *Db) applyPut(op *PutOp) error {
+	if err := op.ctx.Err(); err != nil {
+		return err
+	}
 
-		if currentSize+op.entry.GetLength() > db.segmentSize {
-			if err := db.createSegment(); err != nil {
-				op.resp <- err
-				db.mu.Unlock()
-				continue
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if op.checkConflicts {
+		for _, entry := range op.entries {
+			if db.versions[entry.key] > op.snapshot {
+				return ErrConflict
 			}
 		}
+	}
 
-		n, err := db.out.Write(op.entry.Encode())
-		if err == nil {
-			db.setKey(op.entry.key, int64(n))
+	entries := make([]Entry, 0, len(op.entries))
+	var length int64
+	for _, entry := range op.entries {
+		if entry.deleted && !db.hasKey(entry.key) {
+			continue
+		}
+		entry.checksum = db.checksum
+		if !entry.deleted {
+			entry.hash = entry.calculateHash()
+		}
+		entries = append(entries, entry)
+		length += entry.GetLength()
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	currentSize, err := db.out.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	// Entries of one operation always go to the same segment.
+	if currentSize+length > db.segmentSize && len(db.getLastSegment().index) > 0 {
+		if err := db.createSegment(); err != nil {
+			return err
 		}
-		op.resp <- err
-		db.mu.Unlock()
+		currentSize = db.getLastSegment().size
 	}
+
+	lastSegment := db.getLastSegment()
+	var data []byte
+	positions := make([]int64, len(entries))
+	for i := range entries {
+		db.version++
+		entries[i].version = db.version
+		positions[i] = currentSize + int64(len(data))
+		data = append(data, lastSegment.encode(&entries[i], positions[i])...)
+	}
+	if _, err := db.out.Write(data); err != nil {
+		return err
+	}
+
+	for i, entry := range entries {
+		lastSegment.add(entry.key, positions[i], entry.deleted)
+		db.versions[entry.key] = entry.version
+	}
+	lastSegment.size = currentSize + int64(len(data))
+	return nil
 }
 
 func (db *Db) createSegment() error {
@@ -144,7 +327,34 @@ func (db *Db) createSegment() error {
 		index:    make(hashIndex),
 	}
 	db.segments = append(db.segments, newSegment)
-	return nil
+	return db.writeHeader(newSegment)
+}
+
+func (db *Db) writeHeader(segment *Segment) error {
+	format, err := db.newSegmentFormat()
+	if err != nil {
+		return err
+	}
+	segment.segmentFormat = format
+	n, err := db.out.Write(format.header())
+	segment.size += int64(n)
+	return err
+}
+
+// newSegmentFormat returns the format of a new segment, with a fresh nonce
+// prefix if segments are encrypted.
+func (db *Db) newSegmentFormat() (segmentFormat, error) {
+	cipher, err := db.newSegmentCipher()
+	return segmentFormat{checksum: db.checksum, cipher: cipher}, err
+}
+
+// writesFormat tells whether new records can be appended to a segment of the
+// given format.
+func (db *Db) writesFormat(f segmentFormat) bool {
+	if f.checksum != db.checksum || (f.cipher != nil) != db.encrypt {
+		return false
+	}
+	return f.cipher == nil || f.cipher.keyID == db.keyID
 }
 
 func (db *Db) generateNewFileName() string {
@@ -155,79 +365,134 @@ func (db *Db) Compact() error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if db.isClosed() {
+		return ErrClosed
+	}
 	if len(db.segments) < 2 {
 		return nil
 	}
 	segmentsToCompact := db.segments[:len(db.segments)-1]
 	activeSegment := db.getLastSegment()
+	lastCompacted := segmentsToCompact[len(segmentsToCompact)-1]
 
-	db.lastSegmentIndex++
-	newFilePath := db.generateNewFileName()
-	newFile, err := os.OpenFile(newFilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	// The compacted data is written aside and then renamed over the newest
+	// compacted segment, so it keeps a lower index than the active segment and
+	// recovery still applies segments in the right order.
+	tmpFilePath := filepath.Join(db.dir, compactFileName)
+	newFile, err := os.OpenFile(tmpFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
 	if err != nil {
 		return fmt.Errorf("compaction failed: cannot create new segment file: %v", err)
 	}
 	defer newFile.Close()
 
+	format, err := db.newSegmentFormat()
+	if err != nil {
+		return fmt.Errorf("compaction failed: %v", err)
+	}
 	newSegment := &Segment{
-		filePath: newFilePath,
-		index:    make(hashIndex),
+		filePath:      lastCompacted.filePath,
+		index:         make(hashIndex),
+		segmentFormat: format,
+	}
+	header := format.header()
+	if _, err := newFile.Write(header); err != nil {
+		return fmt.Errorf("compaction failed: %v", err)
+	}
+	offset := int64(len(header))
+
+	// Older segments are only removed after the rename, which may fail or be
+	// cut short by a crash. A tombstone is therefore kept while a segment
+	// older than its own still holds a live record of the key, and every
+	// tombstone is kept while files left over from an earlier compaction are
+	// still on disk.
+	files, err := db.segmentFiles()
+	if err != nil {
+		return fmt.Errorf("compaction failed: %v", err)
 	}
-	var offset int64
+	keepTombstones := len(files) == 0 || files[0] != filepath.Base(segmentsToCompact[0].filePath)
 
-	keysToKeep := make(map[string]KeyPosition)
+	blobs := make(map[string]bool)
+	keysToKeep := make(map[string]int)
 	for i := len(segmentsToCompact) - 1; i >= 0; i-- {
-		s := segmentsToCompact[i]
-		for key, pos := range s.index {
+		for key := range segmentsToCompact[i].index {
 			if _, exists := keysToKeep[key]; !exists {
-				keysToKeep[key] = KeyPosition{segment: s, position: pos}
+				keysToKeep[key] = i
 			}
 		}
 	}
 
-	for key, keyPos := range keysToKeep {
-		entry, err := keyPos.segment.getFromSegment(keyPos.position)
+	for key, i := range keysToKeep {
+		s := segmentsToCompact[i]
+		if _, deleted := s.tombstones[key]; deleted && !keepTombstones && !liveIn(segmentsToCompact[:i], key) {
+			continue
+		}
+		entry, err := s.getFromSegment(s.index[key])
 		if err != nil {
 			continue
 		}
 		entry.key = key
-		encoded := entry.Encode()
+		entry.checksum = db.checksum
+		encoded := newSegment.encode(&entry, offset)
 		n, err := newFile.Write(encoded)
 		if err == nil {
-			newSegment.index[key] = offset
+			newSegment.add(key, offset, entry.deleted)
 			offset += int64(n)
+			if entry.blob {
+				blobs[entry.value] = true
+			}
 		}
 	}
 
+	newSegment.size = offset
+
+	if err := newFile.Sync(); err != nil {
+		return fmt.Errorf("compaction failed: %v", err)
+	}
+	if err := os.Rename(tmpFilePath, newSegment.filePath); err != nil {
+		return fmt.Errorf("compaction failed: cannot replace segment file: %v", err)
+	}
+
 	db.segments = []*Segment{newSegment, activeSegment}
 
 	for _, oldSegment := range segmentsToCompact {
-		os.Remove(oldSegment.filePath)
+		if oldSegment != lastCompacted {
+			os.Remove(oldSegment.filePath)
+		}
 	}
-	return nil
-}
 
-func (db *Db) recoverAll() error {
-	files, err := os.ReadDir(db.dir)
-	if err != nil {
-		if os.IsNotExist(err) {
+	for _, pos := range activeSegment.index {
+		entry, err := activeSegment.getFromSegment(pos)
+		if err != nil {
+			// Without every reference known, no blob is safe to remove.
 			return nil
 		}
-		return err
+		if entry.blob && !entry.deleted {
+			blobs[entry.value] = true
+		}
 	}
+	return db.collectBlobs(blobs)
+}
 
-	var segmentFiles []string
-	for _, file := range files {
-		if strings.HasPrefix(file.Name(), outFileName) {
-			segmentFiles = append(segmentFiles, file.Name())
+// liveIn reports whether any of segments indexes a live record of key.
+func liveIn(segments []*Segment, key string) bool {
+	for _, s := range segments {
+		if _, ok := s.index[key]; ok {
+			if _, deleted := s.tombstones[key]; !deleted {
+				return true
+			}
 		}
 	}
+	return false
+}
 
-	sort.Slice(segmentFiles, func(i, j int) bool {
-		numA, _ := strconv.Atoi(strings.TrimPrefix(segmentFiles[i], outFileName))
-		numB, _ := strconv.Atoi(strings.TrimPrefix(segmentFiles[j], outFileName))
-		return numA < numB
-	})
+func (db *Db) recoverAll() error {
+	segmentFiles, err := db.segmentFiles()
+	if err != nil {
+		return err
+	}
 
 	for _, fileName := range segmentFiles {
 		filePath := filepath.Join(db.dir, fileName)
@@ -248,6 +513,33 @@ func (db *Db) recoverAll() error {
 	return nil
 }
 
+// segmentFiles lists segment file names in the order they have to be applied.
+func (db *Db) segmentFiles() ([]string, error) {
+	files, err := os.ReadDir(db.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var segmentFiles []string
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), outFileName) {
+			segmentFiles = append(segmentFiles, file.Name())
+		}
+	}
+
+	sort.Slice(segmentFiles, func(i, j int) bool {
+		numA, _ := strconv.Atoi(strings.TrimPrefix(segmentFiles[i], outFileName))
+		numB, _ := strconv.Atoi(strings.TrimPrefix(segmentFiles[j], outFileName))
+		return numA < numB
+	})
+	return segmentFiles, nil
+}
+
+// recoverSegment indexes the records of the segment starting from
+// segment.size, so calling it again only picks up newly appended records.
 func (db *Db) recoverSegment(segment *Segment) error {
 	f, err := os.Open(segment.filePath)
 	if err != nil {
@@ -255,34 +547,75 @@ func (db *Db) recoverSegment(segment *Segment) error {
 	}
 	defer f.Close()
 
-	var offset int64
+	if db.readOnly {
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if segment.info != nil && !os.SameFile(info, segment.info) || info.Size() < segment.size {
+			segment.index = make(hashIndex)
+			segment.tombstones = nil
+			segment.size = 0
+		}
+		segment.info = info
+	}
+
+	if _, err := f.Seek(segment.size, io.SeekStart); err != nil {
+		return err
+	}
+
 	reader := bufio.NewReaderSize(f, bufSize)
+	if segment.size == 0 {
+		header, err := reader.Peek(maxSegmentHeaderSize)
+		headerSize, checksum, keyID, prefix, headerErr := parseSegmentHeader(header)
+		switch {
+		case headerErr != nil:
+			return headerErr
+		case headerSize > 0:
+			reader.Discard(headerSize)
+			segment.size = int64(headerSize)
+			segment.legacy = false
+			segment.segmentFormat = segmentFormat{checksum: checksum}
+			if prefix != nil {
+				if segment.cipher, err = db.segmentCipher(keyID, prefix); err != nil {
+					return fmt.Errorf("cannot read %s: %v", segment.filePath, err)
+				}
+			}
+		case err == io.EOF && (bytes.HasPrefix(segmentHeader, header) || bytes.HasPrefix(header, encryptedSegmentHeader)):
+			// A new segment the header has not been fully written to yet.
+			return nil
+		default:
+			segment.legacy = true
+		}
+	}
+
 	for {
 		data, err := readNext(reader)
 		if err == io.EOF {
 			break
 		}
+		if err == io.ErrUnexpectedEOF && db.readOnly {
+			// The writer is in the middle of appending this record.
+			break
+		}
 		if err != nil {
 			return err
 		}
-		var e Entry
-		e.Decode(data)
-		segment.index[e.key] = offset
-		offset += int64(len(data))
+		e, err := segment.decode(data, segment.size)
+		if err != nil {
+			return fmt.Errorf("cannot read a record of %s: %v", segment.filePath, err)
+		}
+		segment.add(e.key, segment.size, e.deleted)
+		segment.size += int64(len(data))
+		db.versions[e.key] = e.version
+		if e.version > db.version {
+			db.version = e.version
+		}
 	}
 	return nil
 }
 
-func (db *Db) setKey(key string, n int64) {
-	currentOffset, _ := db.out.Seek(0, io.SeekEnd)
-	startPosition := currentOffset - n
-	db.getLastSegment().index[key] = startPosition
-}
-
-func (db *Db) getPos(key string) (*KeyPosition, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-
+func (db *Db) getPosLocked(key string) (*KeyPosition, error) {
 	for i := len(db.segments) - 1; i >= 0; i-- {
 		s := db.segments[i]
 		if pos, ok := s.index[key]; ok {
@@ -292,32 +625,148 @@ func (db *Db) getPos(key string) (*KeyPosition, error) {
 	return nil, ErrNotFound
 }
 
+func (db *Db) hasKey(key string) bool {
+	_, err := db.getPosLocked(key)
+	return err == nil
+}
+
 func (db *Db) Get(key string) (string, error) {
-	keyPos, err := db.getPos(key)
+	return db.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get but fails early if ctx is already done.
+func (db *Db) GetContext(ctx context.Context, key string) (string, error) {
+	var value string
+	err := db.read(ctx, key, func(entry Entry) (err error) {
+		value, err = db.resolve(entry)
+		return err
+	})
+	return value, err
+}
+
+// read passes the current entry of the key to fn once it passed the
+// integrity check.
+func (db *Db) read(ctx context.Context, key string, fn func(Entry) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if db.isClosed() {
+		return ErrClosed
+	}
+
+	err := db.readEntry(key, fn)
+	if db.readOnly && (err == ErrNotFound || err == errSegmentReplaced || os.IsNotExist(err)) {
+		// The writer may have appended the key or compacted the segments
+		// since our last refresh.
+		if err := db.Refresh(); err != nil {
+			return err
+		}
+		err = db.readEntry(key, fn)
+	}
+	return err
+}
+
+// entry reads the current record of the key. The lock is held from the
+// index lookup through the file read, so compaction cannot replace the
+// segment in between.
+func (db *Db) entry(key string) (Entry, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	keyPos, err := db.getPosLocked(key)
 	if err != nil {
-		return "", err
+		return Entry{}, err
 	}
-	entry, err := keyPos.segment.getFromSegment(keyPos.position)
+	return keyPos.segment.getFromSegment(keyPos.position)
+}
+
+func (db *Db) readEntry(key string, fn func(Entry) error) error {
+	entry, err := db.entry(key)
 	if err != nil {
-		return "", err
+		return err
+	}
+	if entry.deleted {
+		return ErrNotFound
 	}
 	if entry.calculateHash() != entry.hash {
-		return "", ErrHashMismatch
+		return ErrHashMismatch
+	}
+	return fn(entry)
+}
+
+// Scan calls fn for every key starting with prefix, in key order. Scanning
+// stops at the first error returned by fn.
+func (db *Db) Scan(prefix string, fn func(key, value string) error) error {
+	if db.isClosed() {
+		return ErrClosed
+	}
+
+	for _, key := range db.Keys(prefix) {
+		// Positions are looked up again for every key, as compaction may
+		// have replaced the segments since the keys were listed.
+		entry, err := db.entry(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if entry.deleted {
+			continue
+		}
+		if entry.calculateHash() != entry.hash {
+			return ErrHashMismatch
+		}
+		value, err := db.resolve(entry)
+		if err != nil {
+			return err
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
 	}
-	return entry.value, nil
+	return nil
 }
 
 func (db *Db) Put(key, value string) error {
-	resp := make(chan error, 1)
-	op := &PutOp{
-		entry: Entry{
-			key:   key,
-			value: value,
-			hash:  calculateHash(value),
-		},
-		resp: resp,
-	}
-	db.putOps <- op
+	return db.PutContext(context.Background(), key, value)
+}
+
+// PutContext is like Put but gives up with ctx.Err() if ctx is done before the
+// writer picks the operation up. Once picked up, the write is carried out
+// and its result is returned.
+func (db *Db) PutContext(ctx context.Context, key, value string) error {
+	entries := []Entry{{key: key, value: value}}
+	release, err := db.storeBlobs(entries)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return db.submit(ctx, &PutOp{entries: entries})
+}
+
+// Delete removes the key. Deleting a missing key is not an error.
+func (db *Db) Delete(key string) error {
+	return db.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is like Delete with the cancellation rules of PutContext.
+func (db *Db) DeleteContext(ctx context.Context, key string) error {
+	return db.submit(ctx, &PutOp{entries: []Entry{{key: key, deleted: true}}})
+}
+
+func (db *Db) submit(ctx context.Context, op *PutOp) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	op.ctx = ctx
+	op.resp = make(chan error, 1)
+	select {
+	case db.putOps <- op:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-db.closed:
+		return ErrClosed
+	}
 	return <-op.resp
 }
 
@@ -329,7 +778,7 @@ func (db *Db) getLastSegment() *Segment {
 }
 
 func (s *Segment) getFromSegment(position int64) (Entry, error) {
-	file, err := os.Open(s.filePath)
+	file, err := s.open()
 	if err != nil {
 		return Entry{}, err
 	}
@@ -345,15 +794,55 @@ func (s *Segment) getFromSegment(position int64) (Entry, error) {
 		return Entry{}, err
 	}
 
-	var e Entry
-	e.Decode(data)
+	return s.decode(data, position)
+}
+
+// decode reads the record found at position.
+func (s *Segment) decode(data []byte, position int64) (Entry, error) {
+	e := Entry{checksum: s.checksum}
+	var err error
+	if s.legacy {
+		err = e.decodeLegacy(data)
+	} else {
+		err = e.Decode(data)
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	if s.cipher != nil {
+		if err := s.cipher.open(&e, position); err != nil {
+			return Entry{}, err
+		}
+	}
 	return e, nil
 }
 
-func calculateHash(value string) string {
-	h := sha1.New()
-	h.Write([]byte(value))
-	return fmt.Sprintf("%x", h.Sum(nil))
+// encode returns the record of e to be written at position.
+func (s *Segment) encode(e *Entry, position int64) []byte {
+	if s.cipher == nil {
+		return e.Encode()
+	}
+	sealed := s.cipher.seal(e, position)
+	return sealed.encodeRecord()
+}
+
+func (s *Segment) open() (*os.File, error) {
+	file, err := os.Open(s.filePath)
+	if err != nil {
+		return nil, err
+	}
+	if s.info != nil {
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if !os.SameFile(info, s.info) {
+			file.Close()
+			return nil, errSegmentReplaced
+		}
+	}
+	return file, nil
 }
 
 func readNext(r *bufio.Reader) ([]byte, error) {
@@ -1,9 +1,16 @@
 package datastore
 
 import (
+	"context"
+	"encoding/binary"
+	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const (
@@ -123,3 +130,358 @@ func TestDb_Segmentation(t *testing.T) {
 		}
 	})
 }
+
+func TestDb_RecoveryAfterCompaction(t *testing.T) {
+	db, cleanup := createTestDb(t)
+	defer cleanup()
+
+	for i := 0; i < testRecordsCount; i++ {
+		db.Put(testKey+strconv.Itoa(i), testValue)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compaction failed: %v", err)
+	}
+	if err := db.Put(testKey+"0", "new-value"); err != nil {
+		t.Fatalf("Cannot put value to the db: %s", err)
+	}
+	db.Close()
+
+	recovered, err := NewDb(db.dir, testSegmentSize)
+	if err != nil {
+		t.Fatalf("Cannot reopen db: %s", err)
+	}
+	defer recovered.Close()
+
+	value, err := recovered.Get(testKey + "0")
+	if err != nil {
+		t.Fatalf("Cannot get value from the recovered db: %s", err)
+	}
+	if value != "new-value" {
+		t.Errorf("Wrong value received after recovery. Expected %s, received %s", "new-value", value)
+	}
+}
+
+func TestDb_Context(t *testing.T) {
+	t.Run("cancelled context", func(t *testing.T) {
+		db, cleanup := createTestDb(t)
+		defer cleanup()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if err := db.PutContext(ctx, testKey, testValue); err != context.Canceled {
+			t.Errorf("Expected context.Canceled on Put, got %v", err)
+		}
+		if _, err := db.GetContext(ctx, testKey); err != context.Canceled {
+			t.Errorf("Expected context.Canceled on Get, got %v", err)
+		}
+		if _, err := db.Get(testKey); err != ErrNotFound {
+			t.Errorf("Cancelled put must not be written, got %v", err)
+		}
+	})
+
+	t.Run("operations after close", func(t *testing.T) {
+		db, cleanup := createTestDb(t)
+		defer cleanup()
+
+		if err := db.Put(testKey, testValue); err != nil {
+			t.Fatalf("Cannot put value to the db: %s", err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("Cannot close the db: %s", err)
+		}
+
+		if err := db.Put(testKey, testValue); err != ErrClosed {
+			t.Errorf("Expected ErrClosed on Put, got %v", err)
+		}
+		if _, err := db.Get(testKey); err != ErrClosed {
+			t.Errorf("Expected ErrClosed on Get, got %v", err)
+		}
+		if err := db.Close(); err != nil {
+			t.Errorf("Repeated Close returned an error: %s", err)
+		}
+	})
+
+	t.Run("close drains in-flight puts", func(t *testing.T) {
+		db, cleanup := createTestDb(t)
+		defer cleanup()
+
+		var wg sync.WaitGroup
+		errs := make([]error, testRecordsCount)
+		for i := 0; i < testRecordsCount; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = db.Put(testKey+strconv.Itoa(i), testValue)
+			}(i)
+		}
+		db.Close()
+		wg.Wait()
+
+		reader, err := NewDbReadOnly(db.dir)
+		if err != nil {
+			t.Fatalf("Cannot open db in read-only mode: %s", err)
+		}
+		defer reader.Close()
+
+		for i, err := range errs {
+			if err == ErrClosed {
+				continue
+			}
+			if err != nil {
+				t.Fatalf("Unexpected Put error: %s", err)
+			}
+			if _, err := reader.Get(testKey + strconv.Itoa(i)); err != nil {
+				t.Errorf("Acknowledged put of key %d was lost: %s", i, err)
+			}
+		}
+	})
+}
+
+func TestDb_Delete(t *testing.T) {
+	db, cleanup := createTestDb(t)
+	defer cleanup()
+
+	for i := 0; i < testRecordsCount; i++ {
+		db.Put(testKey+strconv.Itoa(i), testValue)
+	}
+	if err := db.Delete(testKey + "0"); err != nil {
+		t.Fatalf("Cannot delete value from the db: %s", err)
+	}
+	if err := db.Delete("missing-key"); err != nil {
+		t.Errorf("Deleting a missing key returned an error: %s", err)
+	}
+	if _, err := db.Get(testKey + "0"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for deleted key, got %v", err)
+	}
+
+	db.Put(testKey+"1", testValue)
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compaction failed: %v", err)
+	}
+	if _, err := db.Get(testKey + "0"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for deleted key after compaction, got %v", err)
+	}
+	if err := db.Put(testKey+"0", "new-value"); err != nil {
+		t.Fatalf("Cannot put value to the db: %s", err)
+	}
+	value, err := db.Get(testKey + "0")
+	if err != nil || value != "new-value" {
+		t.Errorf("Cannot put a deleted key back: %q, %v", value, err)
+	}
+}
+
+func TestDb_DeleteSurvivesInterruptedCompaction(t *testing.T) {
+	db, cleanup := createTestDb(t)
+	defer cleanup()
+
+	for i := 0; i < testRecordsCount; i++ {
+		db.Put(testKey+strconv.Itoa(i), testValue)
+	}
+	oldest := filepath.Join(db.dir, outFileName+"0")
+	data, err := os.ReadFile(oldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(testKey + "0"); err != nil {
+		t.Fatalf("Cannot delete value from the db: %s", err)
+	}
+	db.Put(testKey+"1", testValue)
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compaction failed: %v", err)
+	}
+	db.Close()
+
+	// The oldest segment is left behind, as if the process stopped before
+	// compaction removed it.
+	if err := os.WriteFile(oldest, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	recovered, err := NewDb(db.dir, testSegmentSize)
+	if err != nil {
+		t.Fatalf("Cannot reopen db: %s", err)
+	}
+	defer recovered.Close()
+	if _, err := recovered.Get(testKey + "0"); err != ErrNotFound {
+		t.Errorf("Expected the deleted key to stay deleted, got %v", err)
+	}
+}
+
+func TestDb_CompactionDropsTombstones(t *testing.T) {
+	db, cleanup := createTestDb(t)
+	defer cleanup()
+
+	for round := 0; round < 5; round++ {
+		for i := 0; i < testRecordsCount; i++ {
+			key := fmt.Sprintf("%s%d-%d", testKey, round, i)
+			db.Put(key, testValue)
+			db.Delete(key)
+		}
+		db.Put("filler", testValue)
+		db.Put("filler", testValue)
+		if len(db.segments) < 3 {
+			t.Fatalf("Expected at least 3 segments, got %d", len(db.segments))
+		}
+		if err := db.Compact(); err != nil {
+			t.Fatalf("Compaction failed: %v", err)
+		}
+		// Tombstones of earlier rounds no longer hide anything.
+		if n := len(db.segments[0].tombstones); n > testRecordsCount {
+			t.Errorf("Round %d: expected at most %d tombstones, got %d", round, testRecordsCount, n)
+		}
+	}
+
+	db.Put("filler", testValue)
+	db.Put("filler", testValue)
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compaction failed: %v", err)
+	}
+	if n := len(db.segments[0].tombstones); n != 0 {
+		t.Errorf("Expected no tombstones left, got %d", n)
+	}
+	for round := 0; round < 5; round++ {
+		if _, err := db.Get(fmt.Sprintf("%s%d-0", testKey, round)); err != ErrNotFound {
+			t.Errorf("Expected deleted key to stay deleted, got %v", err)
+		}
+	}
+}
+
+func TestDb_LegacySegment(t *testing.T) {
+	dir := t.TempDir()
+
+	// A segment written before versions were introduced: no header, and
+	// records end right after the hash.
+	var data []byte
+	for _, e := range []Entry{{key: "a", value: "1"}, {key: "b", value: "2"}} {
+		encoded := e.Encode()
+		encoded = encoded[:len(encoded)-metaSize]
+		binary.LittleEndian.PutUint32(encoded, uint32(len(encoded)))
+		data = append(data, encoded...)
+	}
+	if err := os.WriteFile(filepath.Join(dir, outFileName+"0"), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDb(dir, testSegmentSize)
+	if err != nil {
+		t.Fatalf("Cannot open db with a legacy segment: %s", err)
+	}
+	defer db.Close()
+
+	if value, err := db.Get("a"); err != nil || value != "1" {
+		t.Errorf("Cannot read legacy record: %q, %v", value, err)
+	}
+	if err := db.Put("b", "3"); err != nil {
+		t.Fatalf("Cannot put value to the db: %s", err)
+	}
+	if value, err := db.Get("b"); err != nil || value != "3" {
+		t.Errorf("Wrong value after overwriting a legacy record: %q, %v", value, err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compaction failed: %v", err)
+	}
+	if value, err := db.Get("a"); err != nil || value != "1" {
+		t.Errorf("Cannot read legacy record after compaction: %q, %v", value, err)
+	}
+}
+
+func TestDb_VersionsSurviveRecovery(t *testing.T) {
+	db, cleanup := createTestDb(t)
+	defer cleanup()
+
+	db.Put(testKey, testValue)
+	db.Put(testKey, testValue)
+	version := db.versions[testKey]
+	db.Close()
+
+	recovered, err := NewDb(db.dir, testSegmentSize)
+	if err != nil {
+		t.Fatalf("Cannot reopen db: %s", err)
+	}
+	defer recovered.Close()
+
+	if recovered.versions[testKey] != version || recovered.version < version {
+		t.Errorf("Versions were not recovered: key %d, db %d, expected %d", recovered.versions[testKey], recovered.version, version)
+	}
+}
+
+func TestDb_BackgroundCompaction(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, testSegmentSize, WithCompaction(3, 10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create db: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < testRecordsCount; i++ {
+		db.Put(testKey, testValue+strconv.Itoa(i))
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for getFilesCount(t, dir) > 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Segments were not compacted, %d files left", getFilesCount(t, dir))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	value, err := db.Get(testKey)
+	if err != nil || value != testValue+strconv.Itoa(testRecordsCount-1) {
+		t.Errorf("Wrong value after background compaction: %q, %v", value, err)
+	}
+}
+
+func TestDb_ReadsDuringCompaction(t *testing.T) {
+	db, cleanup := createTestDb(t)
+	defer cleanup()
+
+	for i := 0; i < testRecordsCount; i++ {
+		if err := db.Put(testKey+strconv.Itoa(i), testValue+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				key := strconv.Itoa(i % testRecordsCount)
+				if value, err := db.Get(testKey + key); err != nil || value != testValue+key {
+					t.Errorf("Get(%s) during compaction: %q, %v", key, value, err)
+					return
+				}
+				// A slow consumer lets compaction replace segments mid-scan.
+				err := db.Scan(testKey, func(key, value string) error {
+					time.Sleep(100 * time.Microsecond)
+					if value != testValue+strings.TrimPrefix(key, testKey) {
+						return fmt.Errorf("%s has value %q", key, value)
+					}
+					return nil
+				})
+				if err != nil {
+					t.Errorf("Scan during compaction: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	// Other keys are written between compactions, so the compacted segment
+	// is rewritten with the test keys at new offsets.
+	for i := 0; i < 200; i++ {
+		if err := db.Put("other"+strconv.Itoa(i), testValue); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,164 @@
+package datastore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const noncePrefixSize = 7
+
+// EncryptionKey is an AES key. Its ID is stored in the header of every
+// segment the key encrypts, so old segments can still be read after the key
+// is rotated.
+type EncryptionKey struct {
+	ID  byte
+	Key []byte
+}
+
+// ParseEncryptionKeys reads keys written as "<id>:<base64 key>", separated
+// by commas or new lines. Keys have to be 16, 24 or 32 bytes long.
+func ParseEncryptionKeys(s string) ([]EncryptionKey, error) {
+	var keys []EncryptionKey
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(field, ":")
+		if !ok {
+			return nil, fmt.Errorf("encryption key %q is not in the <id>:<base64 key> form", field)
+		}
+		n, err := strconv.ParseUint(id, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key id %q: %v", id, err)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %s: %v", id, err)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("invalid encryption key %s: %v", id, err)
+		}
+		keys = append(keys, EncryptionKey{ID: byte(n), Key: key})
+	}
+	return keys, nil
+}
+
+// LoadEncryptionKeys reads the keys from a file in the ParseEncryptionKeys
+// format.
+func LoadEncryptionKeys(path string) ([]EncryptionKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseEncryptionKeys(string(data))
+}
+
+// WithEncryption encrypts the keys and values of new segments with AES-GCM
+// using the first key. The other keys are only used to read segments written
+// before a key rotation; Compact re-encrypts them with the first key.
+func WithEncryption(keys ...EncryptionKey) Option {
+	return func(db *Db) {
+		db.keys = make(map[byte]cipher.AEAD, len(keys))
+		for i, key := range keys {
+			block, err := aes.NewCipher(key.Key)
+			if err != nil {
+				db.optionErr = fmt.Errorf("invalid encryption key %d: %v", key.ID, err)
+				return
+			}
+			aead, err := cipher.NewGCM(block)
+			if err != nil {
+				db.optionErr = err
+				return
+			}
+			db.keys[key.ID] = aead
+			if i == 0 {
+				db.encrypt = true
+				db.keyID = key.ID
+			}
+		}
+	}
+}
+
+// segmentCipher seals the records of one segment. Nonces are the random
+// prefix of the segment followed by the record offset and the part of the
+// record, so no two seals under the same key share a nonce.
+type segmentCipher struct {
+	keyID  byte
+	aead   cipher.AEAD
+	prefix []byte
+}
+
+func (db *Db) newSegmentCipher() (*segmentCipher, error) {
+	if !db.encrypt {
+		return nil, nil
+	}
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	return &segmentCipher{keyID: db.keyID, aead: db.keys[db.keyID], prefix: prefix}, nil
+}
+
+func (db *Db) segmentCipher(keyID byte, prefix []byte) (*segmentCipher, error) {
+	aead, ok := db.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("segment is encrypted with unknown key %d", keyID)
+	}
+	return &segmentCipher{keyID: keyID, aead: aead, prefix: prefix}, nil
+}
+
+func (c *segmentCipher) nonce(position int64, part byte) []byte {
+	nonce := make([]byte, 0, c.aead.NonceSize())
+	nonce = append(nonce, c.prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, uint32(position))
+	return append(nonce, part)
+}
+
+// seal encrypts the key and value of e. The hash goes in front of the
+// value, so the stored record carries no plaintext checksum.
+func (c *segmentCipher) seal(e *Entry, position int64) Entry {
+	sealed := Entry{
+		key:      string(c.aead.Seal(nil, c.nonce(position, 0), []byte(e.key), nil)),
+		version:  e.version,
+		deleted:  e.deleted,
+		blob:     e.blob,
+		checksum: e.checksum,
+	}
+	if !e.deleted {
+		e.hash = e.calculateHash()
+		sealed.value = string(c.aead.Seal(nil, c.nonce(position, 1), []byte(e.hash+e.value), nil))
+	}
+	return sealed
+}
+
+// open decrypts a record read at position. It fails only if the key cannot
+// be decrypted; a damaged value leaves the entry without a hash, so it fails
+// the usual integrity check.
+func (c *segmentCipher) open(e *Entry, position int64) error {
+	key, err := c.aead.Open(nil, c.nonce(position, 0), []byte(e.key), nil)
+	if err != nil {
+		return ErrHashMismatch
+	}
+	e.key = string(key)
+	if e.deleted {
+		return nil
+	}
+
+	value, err := c.aead.Open(nil, c.nonce(position, 1), []byte(e.value), nil)
+	hashSize := e.checksum.size()
+	if err != nil || len(value) < hashSize {
+		e.value, e.hash = "", ""
+		return nil
+	}
+	e.hash = string(value[:hashSize])
+	e.value = string(value[hashSize:])
+	return nil
+}
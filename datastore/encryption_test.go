@@ -0,0 +1,162 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func testEncryptionKey(id byte) EncryptionKey {
+	return EncryptionKey{ID: id, Key: bytes.Repeat([]byte{id}, 32)}
+}
+
+func readSegments(t *testing.T, dir string) [][]byte {
+	t.Helper()
+	files, _ := filepath.Glob(filepath.Join(dir, outFileName+"*"))
+	var contents [][]byte
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, data)
+	}
+	return contents
+}
+
+func TestDb_Encryption(t *testing.T) {
+	dir := t.TempDir()
+	key := testEncryptionKey(1)
+	db, err := NewDb(dir, testSegmentSize, WithEncryption(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < testRecordsCount; i++ {
+		if err := db.Put("secret-key"+strconv.Itoa(i), "secret-value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Delete("secret-key0")
+	db.Close()
+
+	for _, data := range readSegments(t, dir) {
+		if bytes.Contains(data, []byte("secret")) {
+			t.Fatalf("Segment holds plaintext: %q", data)
+		}
+	}
+
+	db, err = NewDb(dir, testSegmentSize, WithEncryption(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get("secret-key0"); err != ErrNotFound {
+		t.Errorf("Deleted key is readable: %v", err)
+	}
+	for i := 1; i < testRecordsCount; i++ {
+		if value, err := db.Get("secret-key" + strconv.Itoa(i)); err != nil || value != "secret-value" {
+			t.Fatalf("Unexpected value %q, %v", value, err)
+		}
+	}
+
+	reader, err := NewDbReadOnly(dir, WithEncryption(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if value, err := reader.Get("secret-key1"); err != nil || value != "secret-value" {
+		t.Errorf("Unexpected read-only value %q, %v", value, err)
+	}
+	if _, err := NewDbReadOnly(dir); err == nil {
+		t.Error("Encrypted segments were opened without a key")
+	}
+	if _, err := NewDbReadOnly(dir, WithEncryption(EncryptionKey{ID: 1, Key: bytes.Repeat([]byte{9}, 32)})); err == nil {
+		t.Error("Encrypted segments were opened with a wrong key")
+	}
+}
+
+func TestDb_EncryptionCorruption(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, testSegmentSize, WithEncryption(testEncryptionKey(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Put(testKey, testValue)
+
+	// The value ciphertext directly precedes the version and flags.
+	file := db.getLastSegment().filePath
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-metaSize-1] ^= 0xff
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(testKey); err != ErrHashMismatch {
+		t.Errorf("Expected ErrHashMismatch, got %v", err)
+	}
+}
+
+func TestDb_KeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, newKey := testEncryptionKey(1), testEncryptionKey(2)
+
+	db, err := NewDb(dir, testSegmentSize, WithEncryption(oldKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < testRecordsCount; i++ {
+		db.Put(testKey+strconv.Itoa(i), testValue)
+	}
+	db.Close()
+
+	db, err = NewDb(dir, testSegmentSize, WithEncryption(newKey, oldKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("new", testValue)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	for _, data := range readSegments(t, dir) {
+		if data[5] != newKey.ID {
+			t.Fatalf("Segment is still encrypted with key %d", data[5])
+		}
+	}
+
+	db, err = NewDb(dir, testSegmentSize, WithEncryption(newKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < testRecordsCount; i++ {
+		if value, err := db.Get(testKey + strconv.Itoa(i)); err != nil || value != testValue {
+			t.Fatalf("Unexpected value after rotation %q, %v", value, err)
+		}
+	}
+}
+
+func TestParseEncryptionKeys(t *testing.T) {
+	k1 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 16))
+	k2 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+	keys, err := ParseEncryptionKeys("2:" + k2 + "\n1:" + k1 + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].ID != 2 || len(keys[0].Key) != 32 || keys[1].ID != 1 {
+		t.Errorf("Unexpected keys %+v", keys)
+	}
+
+	for _, invalid := range []string{k1, "x:" + k1, "1:not-base64", "1:" + base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := ParseEncryptionKeys(invalid); err == nil {
+			t.Errorf("Invalid keys %q were accepted", invalid)
+		}
+	}
+}
@@ -1,22 +1,98 @@
 package datastore
 
 import (
-	"bufio"
-	"crypto/sha1"
+	"bytes"
 	"encoding/binary"
 	"fmt"
 )
 
+// segmentHeader opens every segment written in the current record format,
+// followed by the Checksum of its records. Encrypted segments start with
+// encryptedSegmentHeader instead, followed by the checksum, the key id and
+// the nonce prefix. Segments with the previous header use ChecksumSHA1, and
+// segments without a header hold legacy records, which have no version and
+// flags.
+var (
+	segmentHeader          = []byte("KVS\x03")
+	encryptedSegmentHeader = []byte("KVS\x04")
+	segmentHeaderV2        = []byte("KVS\x02")
+)
+
+const maxSegmentHeaderSize = 6 + noncePrefixSize
+
+type segmentFormat struct {
+	checksum Checksum
+	cipher   *segmentCipher
+}
+
+func (f segmentFormat) header() []byte {
+	if f.cipher == nil {
+		return append(bytes.Clone(segmentHeader), byte(f.checksum))
+	}
+	header := append(bytes.Clone(encryptedSegmentHeader), byte(f.checksum), f.cipher.keyID)
+	return append(header, f.cipher.prefix...)
+}
+
+// parseSegmentHeader returns the size of the header at the start of data,
+// the checksum it names and, for encrypted segments, the key id and the
+// nonce prefix. It returns a zero size if data does not start with a
+// complete header.
+func parseSegmentHeader(data []byte) (size int, checksum Checksum, keyID byte, prefix []byte, err error) {
+	switch {
+	case bytes.HasPrefix(data, segmentHeaderV2):
+		return len(segmentHeaderV2), ChecksumSHA1, 0, nil, nil
+	case bytes.HasPrefix(data, segmentHeader) && len(data) > len(segmentHeader):
+		size = len(segmentHeader) + 1
+	case bytes.HasPrefix(data, encryptedSegmentHeader) && len(data) >= maxSegmentHeaderSize:
+		size = maxSegmentHeaderSize
+		keyID = data[5]
+		prefix = bytes.Clone(data[6:size])
+	default:
+		return 0, 0, 0, nil, nil
+	}
+	checksum = Checksum(data[4])
+	if !checksum.valid() {
+		return 0, 0, 0, nil, fmt.Errorf("segment uses an unknown checksum %d", byte(checksum))
+	}
+	return size, checksum, keyID, prefix, nil
+}
+
+const (
+	// metaSize is the size of the version and flags that follow the hash.
+	metaSize = 9
+
+	flagDeleted byte = 1 << iota
+	flagBlob
+)
+
+// Entry is a single segment record. A deleted entry is a tombstone: it is
+// written without a hash and hides older records of the same key. Every
+// write gets a new version, which transactions use to detect conflicts.
+// The hash is computed with the checksum of the entry's segment. The value
+// of a blob entry is the name of the blob file that holds the actual value.
 type Entry struct {
 	key, value, hash string
+	version          uint64
+	deleted          bool
+	blob             bool
+	checksum         Checksum
 }
 
 func (e *Entry) Encode() []byte {
+	if e.deleted {
+		e.hash = ""
+	} else {
+		e.hash = e.calculateHash()
+	}
+	return e.encodeRecord()
+}
+
+// encodeRecord writes the fields of e as they are, without computing the hash.
+func (e *Entry) encodeRecord() []byte {
 	kl := len(e.key)
 	vl := len(e.value)
-	e.hash = e.calculateHash()
 	hl := len(e.hash)
-	size := kl + vl + hl + 12
+	size := kl + vl + hl + 12 + metaSize
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
 	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
@@ -24,81 +100,74 @@ func (e *Entry) Encode() []byte {
 	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
 	copy(res[kl+12:], e.value)
 	copy(res[kl+12+vl:], e.hash)
+	binary.LittleEndian.PutUint64(res[kl+12+vl+hl:], e.version)
+	if e.deleted {
+		res[size-1] |= flagDeleted
+	}
+	if e.blob {
+		res[size-1] |= flagBlob
+	}
 	return res
 }
 
 func (e *Entry) GetLength() int64 {
-	return getLength(e.key, e.value) + int64(len(e.hash))
+	return getLength(e.key, e.value) + int64(len(e.hash)) + metaSize
 }
 
-func (e *Entry) Decode(input []byte) {
-	kl := binary.LittleEndian.Uint32(input[4:])
-	keyBuf := make([]byte, kl)
-	copy(keyBuf, input[8:kl+8])
-	e.key = string(keyBuf)
-
-	vl := binary.LittleEndian.Uint32(input[kl+8:])
-	valBuf := make([]byte, vl)
-	copy(valBuf, input[kl+12:kl+12+vl])
-	e.value = string(valBuf)
-
-	hl := len(input) - int(kl+12+vl)
-	hashBuf := make([]byte, hl)
-	copy(hashBuf, input[kl+12+vl:])
-	e.hash = string(hashBuf)
-}
+// errShortRecord is returned for records shorter than the sizes they give.
+var errShortRecord = fmt.Errorf("record is truncated")
 
-func (e *Entry) calculateHash() string {
-	h := sha1.New()
-	h.Write([]byte(e.value))
-	return fmt.Sprintf("%x", h.Sum(nil))
+// checkSize tells whether input holds as many bytes as its record size.
+func checkSize(input []byte, min int) error {
+	if len(input) < min || uint64(binary.LittleEndian.Uint32(input)) != uint64(len(input)) {
+		return errShortRecord
+	}
+	return nil
 }
 
-func readValue(in *bufio.Reader) (string, error) {
-	header, err := in.Peek(8)
-	if err != nil {
-		return "", err
+func (e *Entry) Decode(input []byte) error {
+	if err := checkSize(input, 12+metaSize); err != nil {
+		return err
 	}
-	keySize := int(binary.LittleEndian.Uint32(header[4:]))
-	_, err = in.Discard(keySize + 8)
-	if err != nil {
-		return "", err
+	if err := e.decodeFields(input[:len(input)-metaSize]); err != nil {
+		return err
 	}
+	meta := input[len(input)-metaSize:]
+	e.version = binary.LittleEndian.Uint64(meta)
+	e.deleted = meta[8]&flagDeleted != 0
+	e.blob = meta[8]&flagBlob != 0
+	return nil
+}
 
-	header, err = in.Peek(4)
-	if err != nil {
-		return "", err
-	}
-	valSize := int(binary.LittleEndian.Uint32(header))
-	_, err = in.Discard(4)
-	if err != nil {
-		return "", err
+// decodeLegacy reads a record of a segment without the header.
+func (e *Entry) decodeLegacy(input []byte) error {
+	if err := checkSize(input, 12); err != nil {
+		return err
 	}
+	return e.decodeFields(input)
+}
 
-	data := make([]byte, valSize)
-	n, err := in.Read(data)
-	if err != nil {
-		return "", err
+// decodeFields reads the key, value and hash of a record.
+func (e *Entry) decodeFields(input []byte) error {
+	kl := uint64(binary.LittleEndian.Uint32(input[4:]))
+	if uint64(len(input)) < kl+12 {
+		return errShortRecord
 	}
-	if n != valSize {
-		return "", fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
+	e.key = string(input[8 : kl+8])
+
+	vl := uint64(binary.LittleEndian.Uint32(input[kl+8:]))
+	if uint64(len(input)) < kl+12+vl {
+		return errShortRecord
 	}
+	e.value = string(input[kl+12 : kl+12+vl])
 
-	return string(data), nil
+	e.hash = string(input[kl+12+vl:])
+	e.deleted = len(e.hash) == 0
+	return nil
 }
 
-func readHash(in *bufio.Reader) (string, error) {
-	hashSize := 40
-	hashData := make([]byte, hashSize)
-	n, err := in.Read(hashData)
-	if err != nil {
-		return "", err
-	}
-	if n != hashSize {
-		return "", fmt.Errorf("can't read hash bytes (read %d, expected %d)", n, hashSize)
-	}
-
-	return string(hashData), nil
+func (e *Entry) calculateHash() string {
+	return e.checksum.sum(e.value)
 }
 
 func getLength(key string, value string) int64 {
@@ -1,10 +1,6 @@
 package datastore
 
-import (
-	"bufio"
-	"bytes"
-	"testing"
-)
+import "testing"
 
 func TestEntry_Encode(t *testing.T) {
 	e := Entry{key: "key", value: "value"}
@@ -25,35 +21,13 @@ func TestEntry_Encode(t *testing.T) {
 	}
 }
 
-func TestReadValue(t *testing.T) {
-	e := Entry{key: "key", value: "test-value"}
-	data := e.Encode()
-	v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
-	if err != nil {
-		t.Fatal(err)
-	}
-	if v != "test-value" {
-		t.Errorf("Got bad value [%s]", v)
-	}
-}
-
-func TestReadHash(t *testing.T) {
-	e := Entry{key: "key", value: "test-value"}
-	data := e.Encode()
-
-	buf := bufio.NewReader(bytes.NewReader(data))
-	_, err := readValue(buf)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	hash, err := readHash(buf)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	expectedHash := e.hash
-	if hash != expectedHash {
-		t.Errorf("incorrect hash: got '%s', want '%s'", hash, expectedHash)
+func TestEntry_DecodeShort(t *testing.T) {
+	e := Entry{key: "key", value: "value"}
+	encoded := e.Encode()
+	for n := 0; n < len(encoded); n++ {
+		var decoded Entry
+		if err := decoded.Decode(encoded[:n]); err == nil {
+			t.Errorf("Expected an error for a record cut at %d bytes", n)
+		}
 	}
 }
@@ -0,0 +1,123 @@
+package datastore
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"sort"
+	"strings"
+)
+
+// The functions of this file answer from the index alone, without reading
+// any record, so they neither verify checksums nor see blobs. A read-only
+// Db answers as of its last Refresh.
+
+// Has tells whether the key exists.
+func (db *Db) Has(key string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	keyPos, err := db.getPosLocked(key)
+	if err != nil {
+		return false
+	}
+	_, deleted := keyPos.segment.tombstones[key]
+	return !deleted
+}
+
+// Keys returns the existing keys starting with prefix, in key order.
+func (db *Db) Keys(prefix string) []string {
+	db.mu.RLock()
+	var keys []string
+	db.eachKeyLocked(func(key string) {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	})
+	db.mu.RUnlock()
+	sort.Strings(keys)
+	return keys
+}
+
+// KeysPage returns a page of the existing keys for iterating over all of
+// them, and the cursor of the next page, which is 0 after the last one.
+// Iteration starts with cursor 0. Keys are visited in the order of their
+// hash, so every key that exists for the whole iteration is returned
+// exactly once, even if other keys are written or deleted in between. A
+// page holds about count keys, in key order: keys with the same hash are
+// never split between pages. A count below 1 is treated as 1.
+func (db *Db) KeysPage(cursor uint64, count int) ([]string, uint64) {
+	count = max(count, 1)
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	// The first pass finds the highest hash of the page, the second one
+	// collects its keys and the hash the next page starts from.
+	var lowest hashHeap
+	db.eachKeyLocked(func(key string) {
+		h := keyHash(key)
+		if h < cursor {
+			return
+		}
+		if len(lowest) < count {
+			heap.Push(&lowest, h)
+		} else if h < lowest[0] {
+			lowest[0] = h
+			heap.Fix(&lowest, 0)
+		}
+	})
+	if len(lowest) == 0 {
+		return nil, 0
+	}
+	last := lowest[0]
+
+	var keys []string
+	var next uint64
+	db.eachKeyLocked(func(key string) {
+		switch h := keyHash(key); {
+		case h < cursor:
+		case h <= last:
+			keys = append(keys, key)
+		case next == 0 || h < next:
+			next = h
+		}
+	})
+	sort.Strings(keys)
+	return keys, next
+}
+
+// eachKeyLocked calls fn for every existing key. A key is only visited in
+// the newest segment that indexes it.
+func (db *Db) eachKeyLocked(fn func(key string)) {
+	for i, s := range db.segments {
+	keys:
+		for key := range s.index {
+			for _, newer := range db.segments[i+1:] {
+				if _, ok := newer.index[key]; ok {
+					continue keys
+				}
+			}
+			if _, deleted := s.tombstones[key]; !deleted {
+				fn(key)
+			}
+		}
+	}
+}
+
+func keyHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// hashHeap is a max-heap of hashes.
+type hashHeap []uint64
+
+func (h hashHeap) Len() int           { return len(h) }
+func (h hashHeap) Less(i, j int) bool { return h[i] > h[j] }
+func (h hashHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *hashHeap) Push(x any)        { *h = append(*h, x.(uint64)) }
+func (h *hashHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,80 @@
+package datastore
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestDb_Keys(t *testing.T) {
+	db, cleanup := createTestDb(t)
+	defer cleanup()
+
+	for i := 0; i < testRecordsCount; i++ {
+		db.Put(testKey+strconv.Itoa(i), testValue)
+	}
+	db.Put("other", testValue)
+	db.Delete(testKey + "0")
+	db.Put(testKey+"1", "updated")
+
+	if db.Has(testKey+"0") || !db.Has(testKey+"1") || db.Has("missing") {
+		t.Error("Has does not match the stored keys")
+	}
+	keys := db.Keys(testKey)
+	if len(keys) != testRecordsCount-1 || !sort.StringsAreSorted(keys) {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compaction failed: %v", err)
+	}
+	if db.Has(testKey+"0") || len(db.Keys("")) != testRecordsCount {
+		t.Errorf("Keys changed after compaction: %v", db.Keys(""))
+	}
+}
+
+func TestDb_KeysPage(t *testing.T) {
+	db, cleanup := createTestDb(t)
+	defer cleanup()
+
+	for i := 0; i < testRecordsCount; i++ {
+		db.Put(testKey+strconv.Itoa(i), testValue)
+	}
+
+	seen := make(map[string]int)
+	var cursor uint64
+	pages := 0
+	for {
+		keys, next := db.KeysPage(cursor, 3)
+		if !sort.StringsAreSorted(keys) {
+			t.Errorf("Page %v is not sorted", keys)
+		}
+		for _, key := range keys {
+			seen[key]++
+		}
+		// Keys written and deleted during the iteration do not disturb it.
+		db.Put("added"+strconv.Itoa(pages), testValue)
+		db.Delete("added" + strconv.Itoa(pages))
+		pages++
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+
+	if pages < testRecordsCount/3 {
+		t.Errorf("Expected pages of about 3 keys, got %d pages", pages)
+	}
+	for i := 0; i < testRecordsCount; i++ {
+		if n := seen[testKey+strconv.Itoa(i)]; n != 1 {
+			t.Errorf("Key %d was returned %d times", i, n)
+		}
+	}
+	if keys, next := db.KeysPage(0, 100); len(keys) != testRecordsCount || next != 0 {
+		t.Errorf("Expected a single page of every key, got %d keys and cursor %d", len(keys), next)
+	}
+	for _, count := range []int{0, -1} {
+		if keys, next := db.KeysPage(0, count); len(keys) == 0 || next == 0 {
+			t.Errorf("Count %d: expected a page of the first keys, got %v and cursor %d", count, keys, next)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package datastore
+
+import (
+	"log"
+	"time"
+)
+
+type Option func(*Db)
+
+// WithCompaction makes the database compact itself in the background once
+// it has at least minSegments segments, checking every interval.
+func WithCompaction(minSegments int, interval time.Duration) Option {
+	return func(db *Db) {
+		db.compactSegments = minSegments
+		db.compactInterval = interval
+	}
+}
+
+func (db *Db) startCompactionRoutine() {
+	ticker := time.NewTicker(db.compactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			db.mu.RLock()
+			segments := len(db.segments)
+			db.mu.RUnlock()
+			if segments < db.compactSegments {
+				continue
+			}
+			if err := db.Compact(); err != nil && err != ErrClosed {
+				log.Printf("Background compaction of %s failed: %s", db.dir, err)
+			}
+		case <-db.closed:
+			return
+		}
+	}
+}
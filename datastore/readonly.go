@@ -0,0 +1,80 @@
+package datastore
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// NewDbReadOnly opens an existing data directory without taking part in
+// writing it. Another process may keep writing to dir: Get picks up keys it
+// has not seen yet, and Refresh re-reads the directory explicitly.
+// Of the options, only WithEncryption has an effect on a read-only Db.
+func NewDbReadOnly(dir string, opts ...Option) (*Db, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+
+	db := &Db{
+		dir:              dir,
+		segments:         make([]*Segment, 0),
+		lastSegmentIndex: -1,
+		closed:           make(chan struct{}),
+		readOnly:         true,
+		versions:         make(map[string]uint64),
+		corrupt:          make(map[string]struct{}),
+	}
+	for _, opt := range opts {
+		opt(db)
+	}
+	if db.optionErr != nil {
+		return nil, db.optionErr
+	}
+	if err := db.Refresh(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Refresh indexes records appended since the last refresh and follows
+// segments created, replaced or removed by the writer's compaction.
+// It does nothing for a writable Db, whose index is always up to date.
+func (db *Db) Refresh() error {
+	if !db.readOnly {
+		return nil
+	}
+
+	segmentFiles, err := db.segmentFiles()
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	known := make(map[string]*Segment, len(db.segments))
+	for _, s := range db.segments {
+		known[s.filePath] = s
+	}
+
+	segments := make([]*Segment, 0, len(segmentFiles))
+	for _, fileName := range segmentFiles {
+		filePath := filepath.Join(db.dir, fileName)
+		segment, ok := known[filePath]
+		if !ok {
+			segment = &Segment{
+				filePath: filePath,
+				index:    make(hashIndex),
+			}
+		}
+		if err := db.recoverSegment(segment); err != nil {
+			if os.IsNotExist(err) {
+				// Removed by a compaction that finished after we listed the directory.
+				continue
+			}
+			return err
+		}
+		segments = append(segments, segment)
+	}
+	db.segments = segments
+	return nil
+}
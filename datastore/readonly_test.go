@@ -0,0 +1,135 @@
+package datastore
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestDb_ReadOnly(t *testing.T) {
+	db, cleanup := createTestDb(t)
+	defer cleanup()
+
+	for i := 0; i < testRecordsCount; i++ {
+		if err := db.Put(testKey+strconv.Itoa(i), testValue); err != nil {
+			t.Fatalf("Cannot put value to the db: %s", err)
+		}
+	}
+
+	reader, err := NewDbReadOnly(db.dir)
+	if err != nil {
+		t.Fatalf("Cannot open db in read-only mode: %s", err)
+	}
+	defer reader.Close()
+
+	t.Run("reads existing records", func(t *testing.T) {
+		for i := 0; i < testRecordsCount; i++ {
+			value, err := reader.Get(testKey + strconv.Itoa(i))
+			if err != nil {
+				t.Fatalf("Cannot get value from the reader: %s", err)
+			}
+			if value != testValue {
+				t.Errorf("Wrong value received from the reader. Expected %s, received %s", testValue, value)
+			}
+		}
+	})
+
+	t.Run("rejects writes", func(t *testing.T) {
+		if err := reader.Put(testKey, testValue); err != ErrReadOnly {
+			t.Errorf("Expected ErrReadOnly on Put, got %v", err)
+		}
+		if err := reader.Compact(); err != ErrReadOnly {
+			t.Errorf("Expected ErrReadOnly on Compact, got %v", err)
+		}
+	})
+
+	t.Run("picks up new keys on demand", func(t *testing.T) {
+		if err := db.Put("new-key", "new-value"); err != nil {
+			t.Fatalf("Cannot put value to the db: %s", err)
+		}
+		value, err := reader.Get("new-key")
+		if err != nil {
+			t.Fatalf("Cannot get new key from the reader: %s", err)
+		}
+		if value != "new-value" {
+			t.Errorf("Wrong value received from the reader. Expected %s, received %s", "new-value", value)
+		}
+	})
+
+	t.Run("follows updates and compaction on refresh", func(t *testing.T) {
+		if err := db.Put(testKey+"0", "updated-value"); err != nil {
+			t.Fatalf("Cannot put value to the db: %s", err)
+		}
+		if err := db.Compact(); err != nil {
+			t.Fatalf("Compaction failed: %v", err)
+		}
+		if err := reader.Refresh(); err != nil {
+			t.Fatalf("Refresh failed: %v", err)
+		}
+
+		value, err := reader.Get(testKey + "0")
+		if err != nil {
+			t.Fatalf("Cannot get value from the reader: %s", err)
+		}
+		if value != "updated-value" {
+			t.Errorf("Wrong value received after refresh. Expected %s, received %s", "updated-value", value)
+		}
+		for i := 1; i < testRecordsCount; i++ {
+			if _, err := reader.Get(testKey + strconv.Itoa(i)); err != nil {
+				t.Fatalf("Cannot get value from the reader after compaction: %s", err)
+			}
+		}
+	})
+
+	t.Run("reads while refreshing", func(t *testing.T) {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if err := reader.Refresh(); err != nil {
+					t.Errorf("Refresh failed: %v", err)
+					return
+				}
+			}
+		}()
+		for i := 0; i < 50; i++ {
+			if _, err := reader.Get(testKey + strconv.Itoa(i%testRecordsCount)); err != nil {
+				t.Errorf("Cannot get value while refreshing: %s", err)
+			}
+		}
+		wg.Wait()
+	})
+}
+
+func TestDb_Scan(t *testing.T) {
+	db, cleanup := createTestDb(t)
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		db.Put(testKey+strconv.Itoa(i), testValue)
+	}
+	db.Put("other", testValue)
+	db.Put(testKey+"1", "new-value")
+
+	var keys, values []string
+	err := db.Scan(testKey, func(key, value string) error {
+		keys = append(keys, key)
+		values = append(values, value)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Scan failed: %s", err)
+	}
+
+	expectedKeys := []string{testKey + "0", testKey + "1", testKey + "2"}
+	expectedValues := []string{testValue, "new-value", testValue}
+	for i := range expectedKeys {
+		if i >= len(keys) || keys[i] != expectedKeys[i] || values[i] != expectedValues[i] {
+			t.Fatalf("Unexpected scan result %v %v", keys, values)
+		}
+	}
+	if len(keys) != len(expectedKeys) {
+		t.Errorf("Unexpected scan result %v", keys)
+	}
+}
@@ -0,0 +1,242 @@
+package datastore
+
+import (
+	"context"
+	"io"
+	"log"
+	"sort"
+	"time"
+)
+
+// Recoverer fetches a good copy of a corrupt key, e.g. from a replica or a
+// backup.
+type Recoverer interface {
+	Recover(ctx context.Context, key string) (string, error)
+}
+
+// RecovererFunc adapts a function to the Recoverer interface.
+type RecovererFunc func(ctx context.Context, key string) (string, error)
+
+func (f RecovererFunc) Recover(ctx context.Context, key string) (string, error) {
+	return f(ctx, key)
+}
+
+type ScrubOptions struct {
+	// Rate limits how many records are verified per second, 1000 by default.
+	Rate int
+	// Interval is the pause before the first pass and between two passes
+	// over the database, 10 minutes by default.
+	Interval time.Duration
+	// OnCorrupt is called for every record that fails verification, with
+	// ErrHashMismatch or the read error.
+	OnCorrupt func(key string, err error)
+	// Recoverer, if set, is asked for the value of every corrupt key, which
+	// is then written back unless the key changed in the meantime.
+	Recoverer Recoverer
+}
+
+// Stats describes what the scrubber has found so far.
+type Stats struct {
+	Segments        int
+	ScrubPasses     uint64
+	ScrubbedRecords uint64
+	RecoveredKeys   uint64
+	LastScrub       time.Time
+	// CorruptKeys lists keys whose current record failed verification and
+	// has not been recovered or overwritten yet.
+	CorruptKeys []string
+}
+
+// WithScrubber verifies the hash of every live record in the background.
+func WithScrubber(opts ScrubOptions) Option {
+	return func(db *Db) {
+		if opts.Rate <= 0 {
+			opts.Rate = 1000
+		}
+		if opts.Interval <= 0 {
+			opts.Interval = 10 * time.Minute
+		}
+		db.scrub = opts
+	}
+}
+
+func (db *Db) Stats() Stats {
+	db.mu.RLock()
+	segments := len(db.segments)
+	db.mu.RUnlock()
+
+	db.statsMu.Lock()
+	defer db.statsMu.Unlock()
+	stats := db.stats
+	stats.Segments = segments
+	stats.CorruptKeys = make([]string, 0, len(db.corrupt))
+	for key := range db.corrupt {
+		stats.CorruptKeys = append(stats.CorruptKeys, key)
+	}
+	sort.Strings(stats.CorruptKeys)
+	return stats
+}
+
+func (db *Db) startScrubRoutine() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-db.closed
+		cancel()
+	}()
+
+	for {
+		select {
+		case <-time.After(db.scrub.Interval):
+		case <-ctx.Done():
+			return
+		}
+		if err := db.Scrub(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Scrubbing %s failed: %s", db.dir, err)
+		}
+	}
+}
+
+// Scrub makes one pass over all live records and verifies their hashes at
+// the configured rate, or as fast as possible without a scrubber. Passes run
+// one at a time, so a call waits for the pass in progress to finish.
+func (db *Db) Scrub(ctx context.Context) error {
+	db.scrubMu.Lock()
+	defer db.scrubMu.Unlock()
+	if db.isClosed() {
+		return ErrClosed
+	}
+
+	db.mu.RLock()
+	keys := make([]string, 0, len(db.versions))
+	for key := range db.versions {
+		keys = append(keys, key)
+	}
+	db.mu.RUnlock()
+	sort.Strings(keys)
+
+	var limit <-chan time.Time
+	if db.scrub.Rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(db.scrub.Rate))
+		defer ticker.Stop()
+		limit = ticker.C
+	}
+
+	for _, key := range keys {
+		if limit != nil {
+			select {
+			case <-limit:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		} else if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		version, err := db.verify(key)
+		db.statsMu.Lock()
+		db.stats.ScrubbedRecords++
+		db.statsMu.Unlock()
+		if err != nil {
+			db.handleCorrupt(ctx, key, version, err)
+		} else {
+			db.markCorrupt(key, false)
+		}
+	}
+
+	db.statsMu.Lock()
+	db.stats.ScrubPasses++
+	db.stats.LastScrub = time.Now()
+	db.statsMu.Unlock()
+	return nil
+}
+
+// verify checks the current record of key and returns the version it has.
+func (db *Db) verify(key string) (uint64, error) {
+	version, blob, err := db.verifyRecord(key)
+	if err != nil || blob == nil {
+		return version, err
+	}
+	// The blob is read without the lock, as with GetReader, so writers and
+	// readers are not held up by a large file.
+	defer blob.Close()
+	_, err = io.Copy(io.Discard, blob)
+	return version, err
+}
+
+// verifyRecord checks the record of key and opens its blob, if it has one.
+// The lock keeps compaction from replacing the segment while it is read.
+func (db *Db) verifyRecord(key string) (uint64, io.ReadCloser, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	version := db.versions[key]
+	keyPos, err := db.getPosLocked(key)
+	if err != nil {
+		// Dropped by compaction since the pass started.
+		return version, nil, nil
+	}
+	entry, err := keyPos.segment.getFromSegment(keyPos.position)
+	if err != nil {
+		return version, nil, err
+	}
+	if entry.deleted {
+		return version, nil, nil
+	}
+	if entry.calculateHash() != entry.hash {
+		return version, nil, ErrHashMismatch
+	}
+	if entry.blob {
+		blob, _, err := db.openBlob(entry.value)
+		return version, blob, err
+	}
+	return version, nil, nil
+}
+
+func (db *Db) handleCorrupt(ctx context.Context, key string, version uint64, err error) {
+	db.markCorrupt(key, true)
+	if db.scrub.OnCorrupt != nil {
+		db.scrub.OnCorrupt(key, err)
+	}
+	if db.scrub.Recoverer == nil || db.readOnly {
+		return
+	}
+
+	value, err := db.scrub.Recoverer.Recover(ctx, key)
+	if err != nil {
+		log.Printf("Cannot recover corrupt key %q: %s", key, err)
+		return
+	}
+	// Large values go to blob files, as with Put. The write is rejected if
+	// the key was written after it was verified, in which case the corrupt
+	// record is no longer current anyway.
+	entries := []Entry{{key: key, value: value}}
+	release, err := db.storeBlobs(entries)
+	if err == nil {
+		err = db.submit(ctx, &PutOp{
+			entries:        entries,
+			snapshot:       version,
+			checkConflicts: true,
+		})
+		release()
+	}
+	if err != nil && err != ErrConflict {
+		log.Printf("Cannot write recovered key %q: %s", key, err)
+		return
+	}
+	db.markCorrupt(key, false)
+	if err == nil {
+		db.statsMu.Lock()
+		db.stats.RecoveredKeys++
+		db.statsMu.Unlock()
+	}
+}
+
+func (db *Db) markCorrupt(key string, corrupt bool) {
+	db.statsMu.Lock()
+	defer db.statsMu.Unlock()
+	if corrupt {
+		db.corrupt[key] = struct{}{}
+	} else {
+		delete(db.corrupt, key)
+	}
+}
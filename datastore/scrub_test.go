@@ -0,0 +1,147 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// corruptValue flips a byte of value in the segment files of dir.
+func corruptValue(t *testing.T, dir, value string) {
+	t.Helper()
+	files, _ := filepath.Glob(filepath.Join(dir, outFileName+"*"))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i := bytes.Index(data, []byte(value)); i >= 0 {
+			data[i] ^= 0xff
+			if err := os.WriteFile(file, data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+	}
+	t.Fatalf("Value %q not found in %s", value, dir)
+}
+
+func TestDb_Scrub(t *testing.T) {
+	dir := t.TempDir()
+	var mu sync.Mutex
+	var reported []string
+	db, err := NewDb(dir, testSegmentSize, WithScrubber(ScrubOptions{
+		Interval: time.Hour,
+		OnCorrupt: func(key string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			reported = append(reported, key)
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("k1", "good")
+	db.Put("k2", "rotten-value")
+	db.Put("k3", "later-overwritten")
+	corruptValue(t, dir, "rotten-value")
+	corruptValue(t, dir, "later-overwritten")
+
+	if err := db.Scrub(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	stats := db.Stats()
+	if len(stats.CorruptKeys) != 2 || stats.CorruptKeys[0] != "k2" || stats.CorruptKeys[1] != "k3" {
+		t.Errorf("Unexpected corrupt keys %v", stats.CorruptKeys)
+	}
+	mu.Lock()
+	if len(reported) != 2 {
+		t.Errorf("Unexpected reported keys %v", reported)
+	}
+	mu.Unlock()
+
+	// A new write replaces the corrupt record.
+	db.Put("k3", "fresh")
+	if err := db.Scrub(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if stats := db.Stats(); len(stats.CorruptKeys) != 1 || stats.ScrubPasses < 2 {
+		t.Errorf("Unexpected stats after overwrite %+v", stats)
+	}
+}
+
+func TestDb_ScrubRecover(t *testing.T) {
+	dir := t.TempDir()
+	backup := map[string]string{"key": "original"}
+	db, err := NewDb(dir, testSegmentSize, WithScrubber(ScrubOptions{
+		Rate:     10000,
+		Interval: 10 * time.Millisecond,
+		Recoverer: RecovererFunc(func(ctx context.Context, key string) (string, error) {
+			return backup[key], nil
+		}),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("key", "original")
+	corruptValue(t, dir, "original")
+	if _, err := db.Get("key"); err != ErrHashMismatch {
+		t.Fatalf("Expected ErrHashMismatch, got %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for db.Stats().RecoveredKeys == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Corrupt key was not recovered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if value, err := db.Get("key"); err != nil || value != "original" {
+		t.Errorf("Unexpected recovered value %q, %v", value, err)
+	}
+	if stats := db.Stats(); len(stats.CorruptKeys) != 0 {
+		t.Errorf("Recovered key is still reported: %v", stats.CorruptKeys)
+	}
+}
+
+func TestDb_ScrubRecoverBlob(t *testing.T) {
+	dir := t.TempDir()
+	// The replica has a newer value, long enough for a blob.
+	recovered := string(bytes.Repeat([]byte("r"), 100))
+	db, err := NewDb(dir, testSegmentSize, WithBlobs(64), WithScrubber(ScrubOptions{
+		Rate:     10000,
+		Interval: 10 * time.Millisecond,
+		Recoverer: RecovererFunc(func(ctx context.Context, key string) (string, error) {
+			return recovered, nil
+		}),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("key", "original")
+	corruptValue(t, dir, "original")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for db.Stats().RecoveredKeys == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Corrupt key was not recovered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if value, err := db.Get("key"); err != nil || value != recovered {
+		t.Errorf("Unexpected recovered value %q, %v", value, err)
+	}
+	if files := blobFiles(t, dir); len(files) != 1 {
+		t.Errorf("Recovered value was not stored as a blob: %v", files)
+	}
+}
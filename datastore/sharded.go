@@ -0,0 +1,142 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+)
+
+// ShardedDb spreads keys over several independent Db instances, each with its
+// own directory, segments and writer, so writes to different shards do not
+// wait for each other.
+type ShardedDb struct {
+	shards []*Db
+}
+
+// ShardDirs returns the directory set NewShardedDb expects for count shards
+// kept under root.
+func ShardDirs(root string, count int) []string {
+	dirs := make([]string, count)
+	for i := range dirs {
+		dirs[i] = filepath.Join(root, fmt.Sprintf("shard-%d", i))
+	}
+	return dirs
+}
+
+// NewShardedDb opens one Db per directory with the given options. The order
+// of dirs defines which keys every shard owns, so it has to stay the same
+// between runs.
+func NewShardedDb(dirs []string, segmentSize int64, opts ...Option) (*ShardedDb, error) {
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("at least one shard directory is required")
+	}
+
+	sdb := &ShardedDb{shards: make([]*Db, 0, len(dirs))}
+	for _, dir := range dirs {
+		db, err := NewDb(dir, segmentSize, opts...)
+		if err != nil {
+			sdb.Close()
+			return nil, fmt.Errorf("cannot open shard %s: %v", dir, err)
+		}
+		sdb.shards = append(sdb.shards, db)
+	}
+	return sdb, nil
+}
+
+func shardIndex(key string, count int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(count))
+}
+
+func (sdb *ShardedDb) shard(key string) *Db {
+	return sdb.shards[shardIndex(key, len(sdb.shards))]
+}
+
+func (sdb *ShardedDb) Get(key string) (string, error) {
+	return sdb.shard(key).Get(key)
+}
+
+func (sdb *ShardedDb) GetContext(ctx context.Context, key string) (string, error) {
+	return sdb.shard(key).GetContext(ctx, key)
+}
+
+func (sdb *ShardedDb) Put(key, value string) error {
+	return sdb.shard(key).Put(key, value)
+}
+
+func (sdb *ShardedDb) PutContext(ctx context.Context, key, value string) error {
+	return sdb.shard(key).PutContext(ctx, key, value)
+}
+
+func (sdb *ShardedDb) Delete(key string) error {
+	return sdb.shard(key).Delete(key)
+}
+
+func (sdb *ShardedDb) DeleteContext(ctx context.Context, key string) error {
+	return sdb.shard(key).DeleteContext(ctx, key)
+}
+
+// Scan calls fn for every key starting with prefix. Keys are visited shard by
+// shard and are only ordered within a shard.
+func (sdb *ShardedDb) Scan(prefix string, fn func(key, value string) error) error {
+	for _, db := range sdb.shards {
+		if err := db.Scan(prefix, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sdb *ShardedDb) Compact() error {
+	for _, db := range sdb.shards {
+		if err := db.Compact(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sdb *ShardedDb) Close() error {
+	var firstErr error
+	for _, db := range sdb.shards {
+		if err := db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Reshard copies every live key from the shards in src into a new shard set
+// in dst. The source directories are only read, so they have to be removed
+// by the caller once the new set is in use. The options apply to both sets,
+// so encrypted shards can be read and written again.
+func Reshard(src, dst []string, segmentSize int64, opts ...Option) error {
+	for _, s := range src {
+		for _, d := range dst {
+			if filepath.Clean(s) == filepath.Clean(d) {
+				return fmt.Errorf("shard directory %s is used as both source and destination", s)
+			}
+		}
+	}
+
+	target, err := NewShardedDb(dst, segmentSize, opts...)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	for _, dir := range src {
+		source, err := NewDbReadOnly(dir, opts...)
+		if err != nil {
+			return fmt.Errorf("cannot open shard %s: %v", dir, err)
+		}
+		err = source.Scan("", target.Put)
+		source.Close()
+		if err != nil {
+			return fmt.Errorf("cannot copy shard %s: %v", dir, err)
+		}
+	}
+	return target.Close()
+}
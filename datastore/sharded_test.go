@@ -0,0 +1,147 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func createTestShardedDb(t testing.TB, root string, count int, segmentSize int64) *ShardedDb {
+	t.Helper()
+	sdb, err := NewShardedDb(ShardDirs(root, count), segmentSize)
+	if err != nil {
+		t.Fatalf("Failed to create sharded db: %v", err)
+	}
+	return sdb
+}
+
+func TestShardedDb(t *testing.T) {
+	root := t.TempDir()
+	sdb := createTestShardedDb(t, root, 4, testSegmentSize)
+	defer sdb.Close()
+
+	for i := 0; i < testRecordsCount; i++ {
+		if err := sdb.Put(testKey+strconv.Itoa(i), testValue); err != nil {
+			t.Fatalf("Cannot put value to the sharded db: %s", err)
+		}
+	}
+
+	used := 0
+	for _, db := range sdb.shards {
+		keys := 0
+		if err := db.Scan("", func(string, string) error { keys++; return nil }); err != nil {
+			t.Fatal(err)
+		}
+		if keys > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Errorf("Expected keys to be spread over several shards, got %d", used)
+	}
+
+	if err := sdb.Delete(testKey + "0"); err != nil {
+		t.Fatalf("Cannot delete value from the sharded db: %s", err)
+	}
+	if _, err := sdb.Get(testKey + "0"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for deleted key, got %v", err)
+	}
+	for i := 1; i < testRecordsCount; i++ {
+		value, err := sdb.Get(testKey + strconv.Itoa(i))
+		if err != nil {
+			t.Fatalf("Cannot get value from the sharded db: %s", err)
+		}
+		if value != testValue {
+			t.Errorf("Wrong value received from the sharded db. Expected %s, received %s", testValue, value)
+		}
+	}
+}
+
+func TestShardedDb_Options(t *testing.T) {
+	sdb, err := NewShardedDb(ShardDirs(t.TempDir(), 2), testSegmentSize, WithChecksum(ChecksumSHA256))
+	if err != nil {
+		t.Fatalf("Failed to create sharded db: %v", err)
+	}
+	defer sdb.Close()
+
+	for i, db := range sdb.shards {
+		if db.checksum != ChecksumSHA256 {
+			t.Errorf("Expected shard %d to use the given checksum, got %d", i, db.checksum)
+		}
+	}
+}
+
+func TestReshard(t *testing.T) {
+	root := t.TempDir()
+	src := ShardDirs(root+"/old", 2)
+	dst := ShardDirs(root+"/new", 3)
+
+	sdb, err := NewShardedDb(src, testSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < testRecordsCount; i++ {
+		sdb.Put(testKey+strconv.Itoa(i), testValue+strconv.Itoa(i))
+	}
+	sdb.Delete(testKey + "1")
+	sdb.Close()
+
+	if err := Reshard(src, src, testSegmentSize); err == nil {
+		t.Error("Expected resharding into the source directories to fail")
+	}
+	if err := Reshard(src, dst, testSegmentSize); err != nil {
+		t.Fatalf("Resharding failed: %s", err)
+	}
+
+	resharded, err := NewShardedDb(dst, testSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resharded.Close()
+
+	for i := 0; i < testRecordsCount; i++ {
+		key := testKey + strconv.Itoa(i)
+		value, err := resharded.Get(key)
+		if i == 1 {
+			if err != ErrNotFound {
+				t.Errorf("Deleted key was copied, got %q, %v", value, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Cannot get value after resharding: %s", err)
+		}
+		if value != testValue+strconv.Itoa(i) {
+			t.Errorf("Wrong value received after resharding. Expected %s, received %s", testValue+strconv.Itoa(i), value)
+		}
+	}
+}
+
+func BenchmarkShardedDb_Put(b *testing.B) {
+	for _, count := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("shards=%d", count), func(b *testing.B) {
+			root, err := os.MkdirTemp("", testDir)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+
+			sdb := createTestShardedDb(b, root, count, 10*1024*1024)
+			defer sdb.Close()
+
+			var n int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					key := testKey + strconv.FormatInt(atomic.AddInt64(&n, 1), 10)
+					if err := sdb.Put(key, testValue); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+)
+
+var ErrTxDone = fmt.Errorf("transaction has already been committed or rolled back")
+
+// Tx is a read-modify-write transaction with snapshot isolation. Reads see
+// the database as of Begin, writes are buffered until Commit and applied
+// together by the writer, which rejects them with ErrConflict if another
+// write touched any of the same keys after the snapshot.
+type Tx struct {
+	db       *Db
+	snapshot uint64
+	writes   map[string]Entry
+	order    []string
+	done     bool
+}
+
+func (db *Db) Begin() *Tx {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return &Tx{
+		db:       db,
+		snapshot: db.version,
+		writes:   make(map[string]Entry),
+	}
+}
+
+// Get returns the value of the key as of the snapshot, including the
+// transaction's own writes. Older versions of a key are not indexed, so
+// reading a key that was written after the snapshot fails with ErrConflict
+// and the transaction has to be retried.
+func (tx *Tx) Get(key string) (string, error) {
+	if tx.done {
+		return "", ErrTxDone
+	}
+	if entry, ok := tx.writes[key]; ok {
+		if entry.deleted {
+			return "", ErrNotFound
+		}
+		return entry.value, nil
+	}
+	if tx.db.isClosed() {
+		return "", ErrClosed
+	}
+
+	entry, err := tx.db.entry(key)
+	if err != nil {
+		return "", err
+	}
+	if entry.version > tx.snapshot {
+		return "", ErrConflict
+	}
+	if entry.deleted {
+		return "", ErrNotFound
+	}
+	if entry.calculateHash() != entry.hash {
+		return "", ErrHashMismatch
+	}
+	return tx.db.resolve(entry)
+}
+
+func (tx *Tx) Put(key, value string) error {
+	return tx.write(Entry{key: key, value: value})
+}
+
+func (tx *Tx) Delete(key string) error {
+	return tx.write(Entry{key: key, deleted: true})
+}
+
+func (tx *Tx) write(entry Entry) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if _, ok := tx.writes[entry.key]; !ok {
+		tx.order = append(tx.order, entry.key)
+	}
+	tx.writes[entry.key] = entry
+	return nil
+}
+
+func (tx *Tx) Commit() error {
+	return tx.CommitContext(context.Background())
+}
+
+// CommitContext applies the buffered writes atomically with respect to other
+// writers. The transaction is finished whatever the outcome.
+func (tx *Tx) CommitContext(ctx context.Context) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	if len(tx.order) == 0 {
+		return nil
+	}
+
+	entries := make([]Entry, len(tx.order))
+	for i, key := range tx.order {
+		entries[i] = tx.writes[key]
+	}
+	release, err := tx.db.storeBlobs(entries)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return tx.db.submit(ctx, &PutOp{
+		entries:        entries,
+		snapshot:       tx.snapshot,
+		checkConflicts: true,
+	})
+}
+
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.writes = nil
+	tx.order = nil
+	return nil
+}
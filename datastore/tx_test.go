@@ -0,0 +1,150 @@
+package datastore
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestTx_CommitAndRollback(t *testing.T) {
+	db, cleanup := createTestDb(t)
+	defer cleanup()
+
+	db.Put("a", "1")
+	db.Put("b", "2")
+
+	tx := db.Begin()
+	tx.Put("a", "10")
+	tx.Delete("b")
+	tx.Put("c", "30")
+
+	if value, err := tx.Get("a"); err != nil || value != "10" {
+		t.Errorf("Transaction does not see its own write: %q, %v", value, err)
+	}
+	if _, err := tx.Get("b"); err != ErrNotFound {
+		t.Errorf("Transaction does not see its own delete: %v", err)
+	}
+	if value, _ := db.Get("a"); value != "1" {
+		t.Errorf("Uncommitted write is visible outside the transaction: %q", value)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+	if err := tx.Commit(); err != ErrTxDone {
+		t.Errorf("Expected ErrTxDone on repeated commit, got %v", err)
+	}
+
+	if value, _ := db.Get("a"); value != "10" {
+		t.Errorf("Wrong value after commit: %q", value)
+	}
+	if _, err := db.Get("b"); err != ErrNotFound {
+		t.Errorf("Delete was not committed: %v", err)
+	}
+	if value, _ := db.Get("c"); value != "30" {
+		t.Errorf("Wrong value after commit: %q", value)
+	}
+
+	tx = db.Begin()
+	tx.Put("a", "100")
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %s", err)
+	}
+	if err := tx.Put("a", "100"); err != ErrTxDone {
+		t.Errorf("Expected ErrTxDone after rollback, got %v", err)
+	}
+	if value, _ := db.Get("a"); value != "10" {
+		t.Errorf("Rolled back write is visible: %q", value)
+	}
+}
+
+func TestTx_Conflicts(t *testing.T) {
+	db, cleanup := createTestDb(t)
+	defer cleanup()
+
+	db.Put(testKey, "1")
+
+	t.Run("write-write conflict", func(t *testing.T) {
+		tx1 := db.Begin()
+		tx2 := db.Begin()
+		tx1.Put(testKey, "2")
+		tx2.Put(testKey, "3")
+
+		if err := tx1.Commit(); err != nil {
+			t.Fatalf("First commit failed: %s", err)
+		}
+		if err := tx2.Commit(); err != ErrConflict {
+			t.Errorf("Expected ErrConflict, got %v", err)
+		}
+		if value, _ := db.Get(testKey); value != "2" {
+			t.Errorf("Conflicting write was applied: %q", value)
+		}
+	})
+
+	t.Run("read after concurrent write", func(t *testing.T) {
+		tx := db.Begin()
+		db.Put(testKey, "4")
+		if _, err := tx.Get(testKey); err != ErrConflict {
+			t.Errorf("Expected ErrConflict for a key changed after the snapshot, got %v", err)
+		}
+	})
+
+	t.Run("disjoint keys", func(t *testing.T) {
+		tx1 := db.Begin()
+		tx2 := db.Begin()
+		tx1.Put("x", "1")
+		tx2.Put("y", "1")
+		if err := tx1.Commit(); err != nil {
+			t.Fatalf("Commit failed: %s", err)
+		}
+		if err := tx2.Commit(); err != nil {
+			t.Errorf("Transactions on different keys conflicted: %s", err)
+		}
+	})
+}
+
+func TestTx_ConcurrentIncrements(t *testing.T) {
+	db, cleanup := createTestDb(t)
+	defer cleanup()
+
+	db.Put(testKey, "0")
+
+	var wg sync.WaitGroup
+	for i := 0; i < testRecordsCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				tx := db.Begin()
+				value, err := tx.Get(testKey)
+				if err == ErrConflict {
+					tx.Rollback()
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n, _ := strconv.Atoi(value)
+				tx.Put(testKey, strconv.Itoa(n+1))
+				err = tx.Commit()
+				if err == ErrConflict {
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+				}
+				return
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := db.Get(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != strconv.Itoa(testRecordsCount) {
+		t.Errorf("Lost updates: expected %d, got %s", testRecordsCount, value)
+	}
+}
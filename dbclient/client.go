@@ -0,0 +1,302 @@
+// Package dbclient is a Go client for the HTTP API of the db service.
+package dbclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound  = errors.New("record does not exist")
+	ErrIntegrity = errors.New("data integrity check failed")
+	ErrExists    = errors.New("record already exists")
+)
+
+type Response struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type Request struct {
+	Value string `json:"value"`
+}
+
+// Error is returned for every response outside of the 2xx range. Use
+// errors.Is with ErrNotFound, ErrIntegrity and ErrExists to tell the common
+// cases apart.
+type Error struct {
+	StatusCode int    `json:"-"`
+	Message    string `json:"error"`
+	Code       string `json:"code"`
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("db responded with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("db responded with status %d: %s", e.StatusCode, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.Code == "not_found" || e.Code == "" && e.StatusCode == http.StatusNotFound
+	case ErrIntegrity:
+		return e.Code == "hash_mismatch"
+	case ErrExists:
+		return e.Code == "exists" || e.Code == "" && e.StatusCode == http.StatusPreconditionFailed
+	}
+	return false
+}
+
+func (e *Error) temporary() bool {
+	return e.StatusCode >= 500 && e.Code != "hash_mismatch"
+}
+
+type Options struct {
+	// Timeout limits a single attempt, 3 seconds by default.
+	Timeout time.Duration
+	// Retries is the number of attempts made after the first one fails with
+	// a network error or a temporary server error, 2 by default. Set it to
+	// a negative value to disable retries.
+	Retries int
+	// Backoff is the delay before the first retry, doubled for each next
+	// one up to MaxBackoff. 100ms and 2s by default.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// MaxIdleConns is the number of keep-alive connections kept per host.
+	MaxIdleConns int
+	// Transport overrides the pooled transport the client creates.
+	Transport http.RoundTripper
+	// Token is sent as a bearer token when the db requires authentication.
+	Token string
+	// Namespace selects a logical database, the default one if empty.
+	Namespace string
+}
+
+type Client struct {
+	baseURL string
+	http    *http.Client
+	opts    Options
+}
+
+// New creates a client for the db service at baseURL, e.g. "http://db:8083".
+func New(baseURL string, opts Options) *Client {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 3 * time.Second
+	}
+	if opts.Retries == 0 {
+		opts.Retries = 2
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = 100 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 2 * time.Second
+	}
+	if opts.MaxIdleConns <= 0 {
+		opts.MaxIdleConns = 32
+	}
+	transport := opts.Transport
+	if transport == nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.MaxIdleConns = opts.MaxIdleConns
+		t.MaxIdleConnsPerHost = opts.MaxIdleConns
+		transport = t
+	}
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "http://" + baseURL
+	}
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		http:    &http.Client{Transport: transport},
+		opts:    opts,
+	}
+}
+
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	var body Response
+	err := c.do(ctx, call{method: http.MethodGet, url: c.keyURL(key), handle: func(resp *http.Response) error {
+		return json.NewDecoder(resp.Body).Decode(&body)
+	}})
+	return body.Value, err
+}
+
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	data, err := json.Marshal(Request{Value: value})
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, call{method: http.MethodPost, url: c.keyURL(key), body: data})
+}
+
+// PutIfAbsent writes the value only if the key does not exist yet and
+// returns ErrExists otherwise. A retried attempt may find the value written
+// by the attempt before it and also return ErrExists.
+func (c *Client) PutIfAbsent(ctx context.Context, key, value string) error {
+	data, err := json.Marshal(Request{Value: value})
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, call{
+		method: http.MethodPut,
+		url:    c.keyURL(key),
+		body:   data,
+		header: http.Header{"If-None-Match": {"*"}},
+	})
+}
+
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.do(ctx, call{method: http.MethodDelete, url: c.keyURL(key)})
+}
+
+// Scan calls fn for every key starting with prefix. The records are
+// streamed, so a failing stream is not retried once fn has been called, and
+// the timeout only applies until the stream starts.
+func (c *Client) Scan(ctx context.Context, prefix string, fn func(key, value string) error) error {
+	u := c.baseURL + "/scan?prefix=" + url.QueryEscape(prefix)
+	if c.opts.Namespace != "" {
+		u += "&namespace=" + url.QueryEscape(c.opts.Namespace)
+	}
+	return c.do(ctx, call{method: http.MethodGet, url: u, stream: true, handle: func(resp *http.Response) error {
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for scanner.Scan() {
+			var record Response
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				return err
+			}
+			if err := fn(record.Key, record.Value); err != nil {
+				return err
+			}
+		}
+		return scanner.Err()
+	}})
+}
+
+// Namespaces lists the names of the namespaces of the db, which requires
+// admin access to all of them.
+func (c *Client) Namespaces(ctx context.Context) ([]string, error) {
+	var configs []struct {
+		Name string `json:"name"`
+	}
+	err := c.do(ctx, call{method: http.MethodGet, url: c.baseURL + "/admin/namespaces", handle: func(resp *http.Response) error {
+		return json.NewDecoder(resp.Body).Decode(&configs)
+	}})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(configs))
+	for i, config := range configs {
+		names[i] = config.Name
+	}
+	return names, nil
+}
+
+func (c *Client) keyURL(key string) string {
+	if c.opts.Namespace != "" {
+		return c.baseURL + "/db/" + url.PathEscape(c.opts.Namespace) + "/" + url.PathEscape(key)
+	}
+	return c.baseURL + "/db/" + url.PathEscape(key)
+}
+
+// call is a single API request. A successful response is passed to handle.
+type call struct {
+	method, url string
+	body        []byte
+	header      http.Header
+	handle      func(*http.Response) error
+	// stream responses are read for as long as handle takes, so the timeout
+	// only covers sending the request and receiving the response headers.
+	stream bool
+}
+
+// do sends the request, retrying temporary failures.
+func (c *Client) do(ctx context.Context, r call) error {
+	backoff := c.opts.Backoff
+	for attempt := 0; ; attempt++ {
+		err := c.attempt(ctx, r)
+		if err == nil || !c.retryable(ctx, err) || attempt >= c.opts.Retries {
+			return err
+		}
+
+		// Jitter keeps clients that failed together from retrying together.
+		delay := time.Duration(rand.Int63n(int64(backoff))) + backoff/2
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		if backoff *= 2; backoff > c.opts.MaxBackoff {
+			backoff = c.opts.MaxBackoff
+		}
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, r call) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	timeout := time.AfterFunc(c.opts.Timeout, func() { cancel(context.DeadlineExceeded) })
+	defer timeout.Stop()
+
+	var reader io.Reader
+	if r.body != nil {
+		reader = bytes.NewReader(r.body)
+	}
+	req, err := http.NewRequestWithContext(ctx, r.method, r.url, reader)
+	if err != nil {
+		return err
+	}
+	for name, values := range r.header {
+		req.Header[name] = values
+	}
+	if r.body != nil {
+		req.Header.Set("content-type", "application/json")
+	}
+	if c.opts.Token != "" {
+		req.Header.Set("authorization", "Bearer "+c.opts.Token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if r.stream {
+		timeout.Stop()
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		_ = json.NewDecoder(resp.Body).Decode(apiErr)
+		return apiErr
+	}
+	if r.handle != nil {
+		return r.handle(resp)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func (c *Client) retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.temporary()
+	}
+	// Network errors and timeouts of a single attempt.
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
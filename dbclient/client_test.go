@@ -0,0 +1,185 @@
+package dbclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func createTestClient(t *testing.T, h http.HandlerFunc) *Client {
+	t.Helper()
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+	return New(server.URL, Options{Timeout: 200 * time.Millisecond, Backoff: time.Millisecond})
+}
+
+func writeError(rw http.ResponseWriter, status int, code string) {
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(Error{Message: code, Code: code})
+}
+
+func TestClient_Get(t *testing.T) {
+	client := createTestClient(t, func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.EscapedPath() {
+		case "/db/team%2Fkey":
+			_ = json.NewEncoder(rw).Encode(Response{Key: "team/key", Value: "value"})
+		case "/db/corrupt":
+			writeError(rw, http.StatusInternalServerError, "hash_mismatch")
+		default:
+			writeError(rw, http.StatusNotFound, "not_found")
+		}
+	})
+	ctx := context.Background()
+
+	if value, err := client.Get(ctx, "team/key"); err != nil || value != "value" {
+		t.Errorf("Unexpected Get result %q, %v", value, err)
+	}
+
+	_, err := client.Get(ctx, "missing")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected *Error with status 404, got %v", err)
+	}
+
+	if _, err := client.Get(ctx, "corrupt"); !errors.Is(err, ErrIntegrity) || errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrIntegrity, got %v", err)
+	}
+}
+
+func TestClient_Retries(t *testing.T) {
+	t.Run("temporary errors are retried", func(t *testing.T) {
+		var calls int32
+		client := createTestClient(t, func(rw http.ResponseWriter, req *http.Request) {
+			if atomic.AddInt32(&calls, 1) < 3 {
+				writeError(rw, http.StatusServiceUnavailable, "unavailable")
+				return
+			}
+			var body Request
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Value != "value" {
+				t.Errorf("Request body was not resent: %q, %v", body.Value, err)
+			}
+			rw.WriteHeader(http.StatusCreated)
+		})
+
+		if err := client.Put(context.Background(), "key", "value"); err != nil {
+			t.Fatalf("Put failed: %s", err)
+		}
+		if calls != 3 {
+			t.Errorf("Expected 3 attempts, got %d", calls)
+		}
+	})
+
+	t.Run("integrity errors are not retried", func(t *testing.T) {
+		var calls int32
+		client := createTestClient(t, func(rw http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			writeError(rw, http.StatusInternalServerError, "hash_mismatch")
+		})
+
+		client.Get(context.Background(), "key")
+		if calls != 1 {
+			t.Errorf("Expected 1 attempt, got %d", calls)
+		}
+	})
+
+	t.Run("timeouts are retried", func(t *testing.T) {
+		var calls int32
+		client := createTestClient(t, func(rw http.ResponseWriter, req *http.Request) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				select {
+				case <-time.After(time.Second):
+				case <-req.Context().Done():
+				}
+				return
+			}
+			rw.WriteHeader(http.StatusNoContent)
+		})
+
+		if err := client.Delete(context.Background(), "key"); err != nil {
+			t.Fatalf("Delete failed: %s", err)
+		}
+		if calls != 2 {
+			t.Errorf("Expected 2 attempts, got %d", calls)
+		}
+	})
+}
+
+func TestClient_Scan(t *testing.T) {
+	client := createTestClient(t, func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/scan" || req.URL.Query().Get("prefix") != "a" {
+			t.Errorf("Unexpected scan request %s", req.URL)
+		}
+		encoder := json.NewEncoder(rw)
+		encoder.Encode(Response{Key: "a1", Value: "1"})
+		encoder.Encode(Response{Key: "a2", Value: "2"})
+	})
+
+	var keys []string
+	err := client.Scan(context.Background(), "a", func(key, value string) error {
+		keys = append(keys, key+"="+value)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Scan failed: %s", err)
+	}
+	if len(keys) != 2 || keys[0] != "a1=1" || keys[1] != "a2=2" {
+		t.Errorf("Unexpected scan result %v", keys)
+	}
+}
+
+func TestClient_ScanOutlivesTimeout(t *testing.T) {
+	client := createTestClient(t, func(rw http.ResponseWriter, req *http.Request) {
+		encoder := json.NewEncoder(rw)
+		encoder.Encode(Response{Key: "a1", Value: "1"})
+		rw.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		encoder.Encode(Response{Key: "a2", Value: "2"})
+	})
+
+	keys := 0
+	err := client.Scan(context.Background(), "", func(key, value string) error {
+		keys++
+		return nil
+	})
+	if err != nil || keys != 2 {
+		t.Errorf("Expected a stream longer than the timeout to be read, got %d keys, %v", keys, err)
+	}
+
+	slow := createTestClient(t, func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	})
+	slow.opts.Retries = -1
+	err = slow.Scan(context.Background(), "", func(string, string) error { return nil })
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the timeout to cover the response headers, got %v", err)
+	}
+}
+
+func TestClient_Namespace(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		paths = append(paths, req.URL.EscapedPath()+"?"+req.URL.RawQuery)
+		_ = json.NewEncoder(rw).Encode(Response{Key: "team/key", Value: "value"})
+	}))
+	defer server.Close()
+	client := New(server.URL, Options{Namespace: "billing"})
+
+	if _, err := client.Get(context.Background(), "team/key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Scan(context.Background(), "team/", func(key, value string) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 || paths[0] != "/db/billing/team%2Fkey?" || paths[1] != "/scan?prefix=team%2F&namespace=billing" {
+		t.Errorf("Unexpected request paths %q", paths)
+	}
+}
@@ -0,0 +1,220 @@
+package dbproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/mysteriousgophers/architecture-lab-4/datastore"
+)
+
+var ErrClientClosed = fmt.Errorf("client is closed")
+
+// Client is safe for concurrent use. Requests from different goroutines are
+// pipelined over a single connection.
+type Client struct {
+	conn net.Conn
+
+	writeMu sync.Mutex
+	w       *bufio.Writer
+
+	// mu guards the responses still expected, in request order, and the
+	// error that broke the connection.
+	mu      sync.Mutex
+	pending []chan []byte
+	err     error
+}
+
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+func NewClient(conn net.Conn) *Client {
+	c := &Client{
+		conn: conn,
+		w:    bufio.NewWriter(conn),
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *Client) Close() error {
+	c.fail(ErrClientClosed)
+	return c.conn.Close()
+}
+
+// Auth authenticates the connection with token, which servers that require
+// authentication expect before any other request. It returns ErrDenied for
+// an unknown token.
+func (c *Client) Auth(token string) error {
+	return c.exec(Op{Code: OpAuth, Key: token})
+}
+
+func (c *Client) Get(key string) (string, error) {
+	res, err := c.roundTrip(appendOp(nil, Op{Code: OpGet, Key: key}))
+	if err != nil {
+		return "", err
+	}
+	r, _, err := readResult(res)
+	if err != nil {
+		return "", err
+	}
+	return r.Value, r.Err
+}
+
+func (c *Client) Put(key, value string) error {
+	return c.exec(Op{Code: OpPut, Key: key, Value: value})
+}
+
+func (c *Client) Delete(key string) error {
+	return c.exec(Op{Code: OpDelete, Key: key})
+}
+
+// Batch sends all ops in one frame. The returned error is set only if the
+// batch as a whole failed; per-operation errors are in the results.
+func (c *Client) Batch(ops []Op) ([]Result, error) {
+	req := binary.LittleEndian.AppendUint32([]byte{OpBatch}, uint32(len(ops)))
+	for _, op := range ops {
+		req = appendOp(req, op)
+	}
+	res, err := c.roundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if res[0] != StatusOK {
+		r, _, err := readResult(res)
+		if err != nil {
+			return nil, err
+		}
+		return nil, r.Err
+	}
+	if len(res) < 5 {
+		return nil, errShortFrame
+	}
+	count := binary.LittleEndian.Uint32(res[1:])
+	rest := res[5:]
+	// Every result takes at least its status byte.
+	if count > uint32(len(rest)) {
+		return nil, errShortFrame
+	}
+	results := make([]Result, count)
+	for i := range results {
+		results[i], rest, err = readResult(rest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+func (c *Client) exec(op Op) error {
+	res, err := c.roundTrip(appendOp(nil, op))
+	if err != nil {
+		return err
+	}
+	r, _, err := readResult(res)
+	if err != nil {
+		return err
+	}
+	return r.Err
+}
+
+func (c *Client) roundTrip(req []byte) ([]byte, error) {
+	wait := make(chan []byte, 1)
+
+	c.writeMu.Lock()
+	// Registering under the write lock keeps pending in frame order.
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		c.writeMu.Unlock()
+		return nil, err
+	}
+	c.pending = append(c.pending, wait)
+	c.mu.Unlock()
+
+	err := writeFrame(c.w, req)
+	if err == nil {
+		err = c.w.Flush()
+	}
+	c.writeMu.Unlock()
+	if err != nil {
+		c.fail(err)
+	}
+
+	res, ok := <-wait
+	if !ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return nil, c.err
+	}
+	return res, nil
+}
+
+func (c *Client) readLoop() {
+	r := bufio.NewReader(c.conn)
+	for {
+		frame, err := readFrame(r)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		c.mu.Lock()
+		if len(c.pending) == 0 {
+			c.mu.Unlock()
+			c.fail(fmt.Errorf("unexpected response from server"))
+			c.conn.Close()
+			return
+		}
+		wait := c.pending[0]
+		c.pending = c.pending[1:]
+		c.mu.Unlock()
+		wait <- frame
+	}
+}
+
+// fail breaks the client: requests still waiting for a response and all
+// later requests get err.
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+	for _, wait := range c.pending {
+		close(wait)
+	}
+	c.pending = nil
+}
+
+func readResult(b []byte) (Result, []byte, error) {
+	if len(b) < 1 {
+		return Result{}, nil, errShortFrame
+	}
+	status, b := b[0], b[1:]
+	switch status {
+	case StatusOK:
+		value, rest, err := readString(b)
+		return Result{Value: value}, rest, err
+	case StatusNotFound:
+		return Result{Err: datastore.ErrNotFound}, b, nil
+	case StatusHashMismatch:
+		return Result{Err: datastore.ErrHashMismatch}, b, nil
+	case StatusDenied:
+		return Result{Err: ErrDenied}, b, nil
+	case StatusError:
+		msg, rest, err := readString(b)
+		return Result{Err: errors.New(msg)}, rest, err
+	default:
+		return Result{}, nil, fmt.Errorf("unknown status %d", status)
+	}
+}
@@ -0,0 +1,145 @@
+// Package dbproto implements a compact binary protocol for the db service.
+//
+// Every message is a frame: a little-endian uint32 with the length of the
+// rest of the frame, followed by a one-byte opcode (requests) or status
+// (responses) and its payload. Strings are encoded as a uint32 length
+// followed by the bytes. Responses come back in request order, so a client
+// may send several requests before reading any response.
+//
+//	GET    key              -> OK value | NOT_FOUND | ...
+//	PUT    key value        -> OK
+//	DELETE key              -> OK
+//	BATCH  count {op args}  -> OK count {status payload}
+//	AUTH   token            -> OK | DENIED
+//
+// A server that requires authentication answers DENIED to every operation
+// until the connection sends AUTH with a valid token, and to operations on
+// keys the token does not give access to.
+package dbproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	OpGet byte = iota + 1
+	OpPut
+	OpDelete
+	OpBatch
+	OpAuth
+)
+
+const (
+	StatusOK byte = iota
+	StatusNotFound
+	StatusHashMismatch
+	StatusError
+	StatusDenied
+)
+
+// maxFrameSize protects both sides from allocating absurd buffers when the
+// stream is corrupted.
+const maxFrameSize = 64 << 20
+
+var (
+	errShortFrame = fmt.Errorf("frame is too short")
+	ErrDenied     = fmt.Errorf("operation is not allowed")
+)
+
+// Op is a single operation of a batch.
+type Op struct {
+	Code  byte
+	Key   string
+	Value string
+}
+
+// Result is the outcome of a single operation of a batch.
+type Result struct {
+	Value string
+	Err   error
+}
+
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(size[:])
+	if n == 0 || n > maxFrameSize {
+		return nil, fmt.Errorf("invalid frame size %d", n)
+	}
+	// The buffer grows with the data actually received rather than with the
+	// size the peer announces.
+	var frame bytes.Buffer
+	if _, err := io.CopyN(&frame, r, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame.Bytes(), nil
+}
+
+func writeFrame(w io.Writer, frame []byte) error {
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(frame)))
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, errShortFrame
+	}
+	n := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	if uint32(len(b)) < n {
+		return "", nil, errShortFrame
+	}
+	return string(b[:n]), b[n:], nil
+}
+
+func appendOp(b []byte, op Op) []byte {
+	b = append(b, op.Code)
+	b = appendString(b, op.Key)
+	if op.Code == OpPut {
+		b = appendString(b, op.Value)
+	}
+	return b
+}
+
+// minOpSize is the size of the shortest operation: an opcode and an empty
+// key.
+const minOpSize = 5
+
+func readOp(b []byte) (Op, []byte, error) {
+	if len(b) < 1 {
+		return Op{}, nil, errShortFrame
+	}
+	op := Op{Code: b[0]}
+	key, b, err := readString(b[1:])
+	if err != nil {
+		return Op{}, nil, err
+	}
+	op.Key = key
+	switch op.Code {
+	case OpPut:
+		op.Value, b, err = readString(b)
+	case OpGet, OpDelete, OpAuth:
+	default:
+		err = fmt.Errorf("unknown operation %d", op.Code)
+	}
+	return op, b, err
+}
@@ -0,0 +1,212 @@
+package dbproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mysteriousgophers/architecture-lab-4/datastore"
+)
+
+func createTestClient(t *testing.T) *Client {
+	t.Helper()
+	client, err := Dial(createTestServer(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// createTestServer starts a server with the given Auth and returns its
+// address.
+func createTestServer(t *testing.T, auth AuthFunc) string {
+	t.Helper()
+	db, err := datastore.NewDb(t.TempDir(), 4096)
+	if err != nil {
+		t.Fatalf("Failed to create db: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(db)
+	server.Auth = auth
+	go server.Serve(l)
+	t.Cleanup(func() {
+		server.Close()
+		db.Close()
+	})
+	return l.Addr().String()
+}
+
+func TestClient_Operations(t *testing.T) {
+	client := createTestClient(t)
+
+	if err := client.Put("key", "value"); err != nil {
+		t.Fatalf("Put failed: %s", err)
+	}
+	if value, err := client.Get("key"); err != nil || value != "value" {
+		t.Errorf("Unexpected Get result %q, %v", value, err)
+	}
+	if err := client.Delete("key"); err != nil {
+		t.Fatalf("Delete failed: %s", err)
+	}
+	if _, err := client.Get("key"); err != datastore.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if err := client.Put("", ""); err != nil {
+		t.Errorf("Empty key and value were rejected: %s", err)
+	}
+}
+
+func TestClient_Batch(t *testing.T) {
+	client := createTestClient(t)
+
+	results, err := client.Batch([]Op{
+		{Code: OpPut, Key: "a", Value: "1"},
+		{Code: OpPut, Key: "b", Value: "2"},
+		{Code: OpGet, Key: "a"},
+		{Code: OpDelete, Key: "b"},
+		{Code: OpGet, Key: "b"},
+	})
+	if err != nil {
+		t.Fatalf("Batch failed: %s", err)
+	}
+	if len(results) != 5 {
+		t.Fatalf("Expected 5 results, got %d", len(results))
+	}
+	if results[2].Value != "1" || results[2].Err != nil {
+		t.Errorf("Unexpected result of get in batch %+v", results[2])
+	}
+	if results[4].Err != datastore.ErrNotFound {
+		t.Errorf("Expected ErrNotFound for deleted key in batch, got %v", results[4].Err)
+	}
+}
+
+func TestServer_OversizedBatch(t *testing.T) {
+	client := createTestClient(t)
+	conn, err := net.Dial("tcp", client.conn.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A count of 2^32-1 with no operations must not be used to size anything.
+	frame := binary.LittleEndian.AppendUint32([]byte{OpBatch}, 0xffffffff)
+	if err := writeFrame(conn, frame); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	res, err := readFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0] != StatusError {
+		t.Errorf("Expected an error for an oversized batch count, got status %d", res[0])
+	}
+
+	if err := writeFrame(conn, appendOp(nil, Op{Code: OpPut, Key: "key", Value: "value"})); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := readFrame(r); err != nil || res[0] != StatusOK {
+		t.Errorf("Connection is unusable after the rejected batch: %v, %v", res, err)
+	}
+}
+
+func TestClient_OversizedBatchResult(t *testing.T) {
+	conn, server := net.Pipe()
+	client := NewClient(conn)
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		if _, err := readFrame(bufio.NewReader(server)); err != nil {
+			return
+		}
+		// A count of 2^32-1 with no results must not be used to size anything.
+		writeFrame(server, binary.LittleEndian.AppendUint32([]byte{StatusOK}, 0xffffffff))
+	}()
+
+	if _, err := client.Batch([]Op{{Code: OpGet, Key: "key"}}); err != errShortFrame {
+		t.Errorf("Expected errShortFrame, got %v", err)
+	}
+}
+
+func TestServer_Auth(t *testing.T) {
+	addr := createTestServer(t, func(token string) func(key string, write bool) bool {
+		if token != "secret" {
+			return nil
+		}
+		return func(key string, write bool) bool {
+			return !write || strings.HasPrefix(key, "team/")
+		}
+	})
+	client, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Put("team/key", "value"); err != ErrDenied {
+		t.Errorf("Expected ErrDenied before AUTH, got %v", err)
+	}
+	if err := client.Auth("wrong"); err != ErrDenied {
+		t.Errorf("Expected ErrDenied for an unknown token, got %v", err)
+	}
+	if err := client.Auth("secret"); err != nil {
+		t.Fatalf("Cannot authenticate: %v", err)
+	}
+	if err := client.Put("team/key", "value"); err != nil {
+		t.Errorf("Write within the permissions failed: %v", err)
+	}
+	if value, err := client.Get("team/key"); err != nil || value != "value" {
+		t.Errorf("Unexpected read result %q, %v", value, err)
+	}
+	results, err := client.Batch([]Op{
+		{Code: OpPut, Key: "team/other", Value: "value"},
+		{Code: OpDelete, Key: "other"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Err != nil || results[1].Err != ErrDenied {
+		t.Errorf("Batch operations were not authorized one by one: %v", results)
+	}
+	if _, err := client.Batch([]Op{{Code: OpAuth, Key: "secret"}}); err == nil {
+		t.Error("AUTH was accepted in a batch")
+	}
+}
+
+func TestClient_Pipelining(t *testing.T) {
+	client := createTestClient(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := "key" + strconv.Itoa(i)
+			if err := client.Put(key, strconv.Itoa(i)); err != nil {
+				t.Error(err)
+				return
+			}
+			value, err := client.Get(key)
+			if err != nil || value != strconv.Itoa(i) {
+				t.Errorf("Response was matched to the wrong request: %q, %v", value, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestClient_Closed(t *testing.T) {
+	client := createTestClient(t)
+	client.Close()
+	if _, err := client.Get("key"); err != ErrClientClosed {
+		t.Errorf("Expected ErrClientClosed, got %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+package dbproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/mysteriousgophers/architecture-lab-4/datastore"
+)
+
+type Store interface {
+	Get(key string) (string, error)
+	Put(key, value string) error
+	Delete(key string) error
+}
+
+// AuthFunc checks the token sent with AUTH. It returns nil for an unknown
+// token, and otherwise a function telling whether the token allows reading
+// the key, or writing it if write is set.
+type AuthFunc func(token string) func(key string, write bool) bool
+
+type Server struct {
+	store Store
+	// Auth, if set before Serve, makes every connection authenticate with
+	// AUTH before its operations are applied.
+	Auth AuthFunc
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+func NewServer(store Store) *Server {
+	return &Server{
+		store: store,
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts connections on l until Close is called.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	sess := &session{}
+	if s.Auth == nil {
+		sess.allowed = allowAll
+	}
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		frame, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		if err := writeFrame(w, s.handle(sess, frame)); err != nil {
+			return
+		}
+		// Pipelined requests are answered in one write.
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// session is the state of a connection.
+type session struct {
+	// allowed is nil until the connection authenticates.
+	allowed func(key string, write bool) bool
+}
+
+func allowAll(string, bool) bool { return true }
+
+func (s *Server) handle(sess *session, frame []byte) []byte {
+	if frame[0] != OpBatch {
+		op, rest, err := readOp(frame)
+		if err == nil && len(rest) != 0 {
+			err = errShortFrame
+		}
+		if err != nil {
+			return appendResult(nil, Result{Err: err})
+		}
+		if op.Code == OpAuth {
+			return appendResult(nil, s.auth(sess, op.Key))
+		}
+		return appendResult(nil, s.apply(sess, op))
+	}
+
+	if len(frame) < 5 {
+		return appendResult(nil, Result{Err: errShortFrame})
+	}
+	count := binary.LittleEndian.Uint32(frame[1:])
+	rest := frame[5:]
+	// The count is checked before it sizes anything.
+	if count > uint32(len(rest)/minOpSize) {
+		return appendResult(nil, Result{Err: fmt.Errorf("batch of %d operations does not fit in its frame", count)})
+	}
+	ops := make([]Op, 0, count)
+	for i := uint32(0); i < count; i++ {
+		var op Op
+		var err error
+		op, rest, err = readOp(rest)
+		if err == nil && op.Code == OpAuth {
+			err = fmt.Errorf("AUTH cannot be batched")
+		}
+		if err != nil {
+			return appendResult(nil, Result{Err: err})
+		}
+		ops = append(ops, op)
+	}
+
+	// Operations of a batch are applied one by one, in order.
+	res := binary.LittleEndian.AppendUint32([]byte{StatusOK}, count)
+	for _, op := range ops {
+		res = appendResult(res, s.apply(sess, op))
+	}
+	return res
+}
+
+// auth authenticates the connection. Without Auth every token is accepted.
+func (s *Server) auth(sess *session, token string) Result {
+	if s.Auth == nil {
+		return Result{}
+	}
+	allowed := s.Auth(token)
+	if allowed == nil {
+		return Result{Err: ErrDenied}
+	}
+	sess.allowed = allowed
+	return Result{}
+}
+
+func (s *Server) apply(sess *session, op Op) Result {
+	if sess.allowed == nil || !sess.allowed(op.Key, op.Code != OpGet) {
+		return Result{Err: ErrDenied}
+	}
+	switch op.Code {
+	case OpGet:
+		value, err := s.store.Get(op.Key)
+		return Result{Value: value, Err: err}
+	case OpPut:
+		return Result{Err: s.store.Put(op.Key, op.Value)}
+	default:
+		return Result{Err: s.store.Delete(op.Key)}
+	}
+}
+
+func appendResult(b []byte, res Result) []byte {
+	switch {
+	case res.Err == nil:
+		return appendString(append(b, StatusOK), res.Value)
+	case errors.Is(res.Err, datastore.ErrNotFound):
+		return append(b, StatusNotFound)
+	case errors.Is(res.Err, datastore.ErrHashMismatch):
+		return append(b, StatusHashMismatch)
+	case errors.Is(res.Err, ErrDenied):
+		return append(b, StatusDenied)
+	default:
+		log.Printf("Binary protocol request failed: %s", res.Err)
+		return appendString(append(b, StatusError), res.Err.Error())
+	}
+}
@@ -1,6 +1,7 @@
 package httptools
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
@@ -17,20 +18,50 @@ type server struct {
 
 func (s server) Start() {
 	go func() {
-		log.Println("Staring the HTTP server...")
-		err := s.httpServer.ListenAndServe()
+		var err error
+		if s.httpServer.TLSConfig != nil {
+			log.Println("Staring the HTTPS server...")
+			err = s.httpServer.ListenAndServeTLS("", "")
+		} else {
+			log.Println("Staring the HTTP server...")
+			err = s.httpServer.ListenAndServe()
+		}
 		log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
 	}()
 }
 
 func CreateServer(port int, handler http.Handler) Server {
-	return server{
-		httpServer: &http.Server{
-			Addr:           fmt.Sprintf(":%d", port),
-			Handler:        handler,
-			ReadTimeout:    10 * time.Second,
-			WriteTimeout:   10 * time.Second,
-			MaxHeaderBytes: 1 << 20,
-		},
+	return CreateServerAt(fmt.Sprintf(":%d", port), handler)
+}
+
+// CreateServerAt creates a server listening on addr, e.g. "localhost:8091".
+func CreateServerAt(addr string, handler http.Handler) Server {
+	return server{httpServer: NewHTTPServer(addr, handler, nil)}
+}
+
+// CreateTLSServer creates a server that serves HTTPS with the certificates
+// of tlsConfig.
+func CreateTLSServer(port int, handler http.Handler, tlsConfig *tls.Config) Server {
+	return server{httpServer: NewHTTPServer(fmt.Sprintf(":%d", port), handler, tlsConfig)}
+}
+
+// NewHTTPServer creates the http.Server of the functions above, serving
+// HTTPS if tlsConfig is set. Handlers that stream responses or take over
+// connections clear the write timeout with http.ResponseController. HTTPS
+// is served over HTTP/1.1 only, since HTTP/2 connections cannot be taken
+// over for protocol upgrades such as WebSocket.
+func NewHTTPServer(addr string, handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	s := &http.Server{
+		Addr:           addr,
+		Handler:        handler,
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+		TLSConfig:      tlsConfig,
+	}
+	if tlsConfig != nil {
+		// A non-nil empty map keeps ServeTLS from enabling HTTP/2.
+		s.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
 	}
+	return s
 }
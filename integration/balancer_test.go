@@ -1,8 +1,10 @@
 package integration
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/mysteriousgophers/architecture-lab-4/dbclient"
 	. "gopkg.in/check.v1"
 	"net/http"
 	"os"
@@ -17,6 +19,7 @@ type IntegrationSuite struct{}
 var _ = Suite(&IntegrationSuite{})
 
 const baseAddress = "http://balancer:8090"
+const dbAddress = "http://db:8083"
 const team = "MysteriousGophers"
 
 type Response struct {
@@ -82,6 +85,10 @@ func (s *IntegrationSuite) TestBalancer(c *C) {
 	if body.Value == "" {
 		c.Error(err)
 	}
+
+	stored, err := dbclient.New(dbAddress, dbclient.Options{}).Get(context.Background(), team)
+	c.Check(err, IsNil)
+	c.Check(stored, Equals, body.Value)
 }
 
 func (s *IntegrationSuite) BenchmarkBalancer(c *C) {
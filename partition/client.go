@@ -0,0 +1,70 @@
+package partition
+
+import (
+	"context"
+	"sync"
+
+	"github.com/mysteriousgophers/architecture-lab-4/dbclient"
+)
+
+var ErrNotFound = dbclient.ErrNotFound
+
+// Client talks to a set of db nodes, sending every key to its owner on the
+// ring.
+type Client struct {
+	ring *Ring
+	opts dbclient.Options
+
+	mu    sync.Mutex
+	nodes map[string]*dbclient.Client
+}
+
+func NewClient(ring *Ring, opts dbclient.Options) *Client {
+	return &Client{
+		ring:  ring,
+		opts:  opts,
+		nodes: make(map[string]*dbclient.Client),
+	}
+}
+
+// WithNamespace returns a client for the same nodes that works with keys of
+// the given namespace.
+func (c *Client) WithNamespace(namespace string) *Client {
+	opts := c.opts
+	opts.Namespace = namespace
+	return NewClient(c.ring, opts)
+}
+
+func (c *Client) Ring() *Ring {
+	return c.ring
+}
+
+// Node returns the client of a single node.
+func (c *Client) Node(node string) *dbclient.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	client, ok := c.nodes[node]
+	if !ok {
+		client = dbclient.New(node, c.opts)
+		c.nodes[node] = client
+	}
+	return client
+}
+
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	return c.Node(c.ring.Owner(key)).Get(ctx, key)
+}
+
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	return c.Node(c.ring.Owner(key)).Put(ctx, key, value)
+}
+
+// PutIfAbsent writes the value to the owner of the key unless it already
+// holds the key, in which case it returns dbclient.ErrExists.
+func (c *Client) PutIfAbsent(ctx context.Context, key, value string) error {
+	return c.Node(c.ring.Owner(key)).PutIfAbsent(ctx, key, value)
+}
+
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.Node(c.ring.Owner(key)).Delete(ctx, key)
+}
@@ -0,0 +1,80 @@
+package partition
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/mysteriousgophers/architecture-lab-4/dbclient"
+)
+
+// batchSize is the number of misplaced keys collected from a scan before
+// they are moved, which bounds the memory a rebalance needs.
+const batchSize = 256
+
+// Rebalance moves every key stored on the given nodes to its owner on the
+// client's ring, in every namespace of the nodes. nodes has to include the
+// nodes that left the ring, since their keys are moved too. Listing the
+// namespaces requires admin access to the nodes.
+//
+// Clients have to write through the new ring while keys are moved. A key the
+// owner already holds was written that way and is newer than the misplaced
+// copy, so the owner's value is kept and the copy is only deleted. It returns
+// the number of keys moved.
+func Rebalance(ctx context.Context, c *Client, nodes []string) (int, error) {
+	moved := 0
+	for _, node := range nodes {
+		namespaces, err := c.Node(node).Namespaces(ctx)
+		if err != nil {
+			return moved, fmt.Errorf("cannot list namespaces of %s: %v", node, err)
+		}
+		for _, namespace := range namespaces {
+			n, err := rebalanceNode(ctx, c.WithNamespace(namespace), node)
+			moved += n
+			if err != nil {
+				return moved, fmt.Errorf("namespace %s: %v", namespace, err)
+			}
+		}
+	}
+	return moved, nil
+}
+
+// rebalanceNode moves the misplaced keys of a single node in batches while
+// the node is scanned.
+func rebalanceNode(ctx context.Context, c *Client, node string) (int, error) {
+	moved := 0
+	batch := make([]dbclient.Response, 0, batchSize)
+	move := func() error {
+		for _, record := range batch {
+			err := c.PutIfAbsent(ctx, record.Key, record.Value)
+			if err != nil && !errors.Is(err, dbclient.ErrExists) {
+				return fmt.Errorf("cannot move %s from %s: %v", record.Key, node, err)
+			}
+			if err := c.Node(node).Delete(ctx, record.Key); err != nil {
+				return fmt.Errorf("cannot delete %s from %s: %v", record.Key, node, err)
+			}
+			moved++
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	var moveErr error
+	err := c.Node(node).Scan(ctx, "", func(key, value string) error {
+		if c.ring.Owner(key) == node {
+			return nil
+		}
+		batch = append(batch, dbclient.Response{Key: key, Value: value})
+		if len(batch) == batchSize {
+			moveErr = move()
+		}
+		return moveErr
+	})
+	if moveErr != nil {
+		return moved, moveErr
+	}
+	if err != nil {
+		return moved, fmt.Errorf("cannot scan %s: %v", node, err)
+	}
+	return moved, move()
+}
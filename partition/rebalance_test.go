@@ -0,0 +1,191 @@
+package partition
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mysteriousgophers/architecture-lab-4/dbclient"
+)
+
+// fakeNode serves the parts of the db API the client uses. data holds the
+// default namespace, namespaces every namespace including it.
+type fakeNode struct {
+	mu         sync.Mutex
+	data       map[string]string
+	namespaces map[string]map[string]string
+}
+
+func newFakeNode(t *testing.T) (*fakeNode, string) {
+	n := &fakeNode{data: make(map[string]string)}
+	n.namespaces = map[string]map[string]string{"default": n.data}
+	server := httptest.NewServer(n)
+	t.Cleanup(server.Close)
+	return n, strings.TrimPrefix(server.URL, "http://")
+}
+
+func (n *fakeNode) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/scan" {
+		// Records are copied first, as the client writes to the node while
+		// the scan is streamed.
+		namespace := req.URL.Query().Get("namespace")
+		if namespace == "" {
+			namespace = "default"
+		}
+		n.mu.Lock()
+		records := make([]dbclient.Response, 0, len(n.namespaces[namespace]))
+		for key, value := range n.namespaces[namespace] {
+			records = append(records, dbclient.Response{Key: key, Value: value})
+		}
+		n.mu.Unlock()
+		for _, record := range records {
+			_ = json.NewEncoder(rw).Encode(record)
+		}
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch req.URL.Path {
+	case "/admin/namespaces":
+		var configs []map[string]string
+		for name := range n.namespaces {
+			configs = append(configs, map[string]string{"name": name})
+		}
+		_ = json.NewEncoder(rw).Encode(configs)
+		return
+	}
+
+	data, key := n.data, strings.TrimPrefix(req.URL.Path, "/db/")
+	if namespace, nsKey, ok := strings.Cut(key, "/"); ok {
+		data, key = n.namespaces[namespace], nsKey
+	}
+	switch req.Method {
+	case http.MethodGet:
+		value, ok := data[key]
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(dbclient.Response{Key: key, Value: value})
+	case http.MethodPost, http.MethodPut:
+		var body dbclient.Request
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if _, ok := data[key]; ok && req.Header.Get("if-none-match") == "*" {
+			rw.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		data[key] = body.Value
+		rw.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		delete(data, key)
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestClient(t *testing.T) {
+	node1, addr1 := newFakeNode(t)
+	node2, addr2 := newFakeNode(t)
+	client := NewClient(NewRing([]string{addr1, addr2}, DefaultVirtualNodes), dbclient.Options{})
+	ctx := context.Background()
+
+	for i := 0; i < 100; i++ {
+		if err := client.Put(ctx, "key"+strconv.Itoa(i), "value"+strconv.Itoa(i)); err != nil {
+			t.Fatalf("Put failed: %s", err)
+		}
+	}
+	if len(node1.data) == 0 || len(node2.data) == 0 || len(node1.data)+len(node2.data) != 100 {
+		t.Errorf("Keys are not partitioned: %d and %d", len(node1.data), len(node2.data))
+	}
+
+	value, err := client.Get(ctx, "key7")
+	if err != nil || value != "value7" {
+		t.Errorf("Unexpected Get result %q, %v", value, err)
+	}
+	if err := client.Delete(ctx, "key7"); err != nil {
+		t.Fatalf("Delete failed: %s", err)
+	}
+	if _, err := client.Get(ctx, "key7"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	node1, addr1 := newFakeNode(t)
+	node2, addr2 := newFakeNode(t)
+	node3, addr3 := newFakeNode(t)
+	ctx := context.Background()
+
+	old := NewClient(NewRing([]string{addr1, addr2}, DefaultVirtualNodes), dbclient.Options{})
+	for i := 0; i < 100; i++ {
+		old.Put(ctx, "key"+strconv.Itoa(i), "value"+strconv.Itoa(i))
+	}
+
+	// node1 leaves, node3 joins.
+	current := NewClient(NewRing([]string{addr2, addr3}, DefaultVirtualNodes), dbclient.Options{})
+	moved, err := Rebalance(ctx, current, []string{addr2, addr3, addr1})
+	if err != nil {
+		t.Fatalf("Rebalance failed: %s", err)
+	}
+	if moved == 0 {
+		t.Error("No keys were moved")
+	}
+	if len(node1.data) != 0 {
+		t.Errorf("Removed node still holds %d keys", len(node1.data))
+	}
+	if len(node2.data)+len(node3.data) != 100 {
+		t.Errorf("Keys were lost: %d and %d", len(node2.data), len(node3.data))
+	}
+	for i := 0; i < 100; i++ {
+		value, err := current.Get(ctx, "key"+strconv.Itoa(i))
+		if err != nil || value != "value"+strconv.Itoa(i) {
+			t.Fatalf("Unexpected value after rebalancing %q, %v", value, err)
+		}
+	}
+}
+
+func TestRebalance_Namespaces(t *testing.T) {
+	node1, addr1 := newFakeNode(t)
+	node2, addr2 := newFakeNode(t)
+	node1.namespaces["billing"] = make(map[string]string)
+	node2.namespaces["billing"] = make(map[string]string)
+	ctx := context.Background()
+
+	old := NewClient(NewRing([]string{addr1, addr2}, DefaultVirtualNodes), dbclient.Options{Namespace: "billing"})
+	for i := 0; i < 2*batchSize; i++ {
+		old.Put(ctx, "key"+strconv.Itoa(i), "value"+strconv.Itoa(i))
+	}
+	// A key written through the new ring before it was moved is kept.
+	current := NewClient(NewRing([]string{addr2}, DefaultVirtualNodes), dbclient.Options{})
+	var newer string
+	for key := range node1.namespaces["billing"] {
+		newer = key
+		break
+	}
+	if err := current.WithNamespace("billing").Put(ctx, newer, "newer"); err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := Rebalance(ctx, current, []string{addr2, addr1})
+	if err != nil {
+		t.Fatalf("Rebalance failed: %s", err)
+	}
+	if moved == 0 || len(node1.namespaces["billing"]) != 0 {
+		t.Errorf("Keys of the namespace were not moved: %d moved, %d left", moved, len(node1.namespaces["billing"]))
+	}
+	if len(node2.namespaces["billing"]) != 2*batchSize {
+		t.Errorf("Keys were lost: %d", len(node2.namespaces["billing"]))
+	}
+	if value := node2.namespaces["billing"][newer]; value != "newer" {
+		t.Errorf("Newer value was overwritten by the moved one: %q", value)
+	}
+}
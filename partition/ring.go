@@ -0,0 +1,65 @@
+package partition
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+const DefaultVirtualNodes = 100
+
+// Ring assigns keys to nodes by consistent hashing. Every node is placed on
+// the ring several times (virtual nodes), so adding or removing a node only
+// moves about 1/n of the keys and spreads them evenly over the rest.
+type Ring struct {
+	nodes  []string
+	hashes []uint32
+	owners map[uint32]string
+}
+
+func NewRing(nodes []string, virtualNodes int) *Ring {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	r := &Ring{
+		nodes:  append([]string(nil), nodes...),
+		owners: make(map[uint32]string),
+	}
+	for _, node := range nodes {
+		for i := 0; i < virtualNodes; i++ {
+			h := hash(fmt.Sprintf("%s#%d", node, i))
+			if _, taken := r.owners[h]; taken {
+				continue
+			}
+			r.owners[h] = node
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// Owner returns the node responsible for key, or "" if the ring is empty.
+func (r *Ring) Owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+func (r *Ring) Nodes() []string {
+	return append([]string(nil), r.nodes...)
+}
+
+// hash uses md5 for its spread rather than for security: fnv clusters the
+// similar "node#i" labels of virtual nodes.
+func hash(s string) uint32 {
+	sum := md5.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
@@ -0,0 +1,51 @@
+package partition
+
+import (
+	"strconv"
+	"testing"
+)
+
+const testKeysCount = 10000
+
+func TestRing_Owner(t *testing.T) {
+	if owner := NewRing(nil, 0).Owner("key"); owner != "" {
+		t.Errorf("Empty ring returned owner %q", owner)
+	}
+
+	nodes := []string{"db1:8083", "db2:8083", "db3:8083"}
+	ring := NewRing(nodes, DefaultVirtualNodes)
+
+	counts := make(map[string]int)
+	for i := 0; i < testKeysCount; i++ {
+		counts[ring.Owner("key"+strconv.Itoa(i))]++
+	}
+	for _, node := range nodes {
+		share := float64(counts[node]) / testKeysCount
+		if share < 0.2 || share > 0.47 {
+			t.Errorf("Node %s owns an unbalanced share of keys: %.2f", node, share)
+		}
+	}
+
+	if again := NewRing(nodes, DefaultVirtualNodes); again.Owner("key1") != ring.Owner("key1") {
+		t.Error("Rings with the same membership disagree on the owner")
+	}
+}
+
+func TestRing_AddNode(t *testing.T) {
+	before := NewRing([]string{"db1:8083", "db2:8083", "db3:8083"}, DefaultVirtualNodes)
+	after := NewRing([]string{"db1:8083", "db2:8083", "db3:8083", "db4:8083"}, DefaultVirtualNodes)
+
+	moved := 0
+	for i := 0; i < testKeysCount; i++ {
+		key := "key" + strconv.Itoa(i)
+		if owner := after.Owner(key); owner != before.Owner(key) {
+			if owner != "db4:8083" {
+				t.Fatalf("Key %s moved between existing nodes", key)
+			}
+			moved++
+		}
+	}
+	if share := float64(moved) / testKeysCount; share < 0.1 || share > 0.4 {
+		t.Errorf("Unexpected share of moved keys: %.2f", share)
+	}
+}
@@ -0,0 +1,81 @@
+package resp
+
+// match reports whether s matches the Redis glob pattern: * and ? wildcards,
+// [abc], [a-z] and [^a] classes and \ escapes. On a mismatch it only
+// backtracks to the last *, so it takes at most len(pattern)*len(s) steps.
+func match(pattern, s string) bool {
+	p, i := 0, 0
+	star, next := -1, 0
+	for p < len(pattern) || i < len(s) {
+		if p < len(pattern) {
+			if pattern[p] == '*' {
+				// Try the rest of the pattern at i first, then at later
+				// positions of s.
+				p++
+				star, next = p, i
+				continue
+			}
+			if i < len(s) {
+				if rest, ok := matchOne(pattern[p:], s[i]); ok {
+					p, i = len(pattern)-len(rest), i+1
+					continue
+				}
+			}
+		}
+		if star < 0 || next >= len(s) {
+			return false
+		}
+		next++
+		p, i = star, next
+	}
+	return true
+}
+
+// matchOne matches c against the pattern element pattern starts with, other
+// than *, and returns the pattern following it.
+func matchOne(pattern string, c byte) (string, bool) {
+	switch pattern[0] {
+	case '?':
+		return pattern[1:], true
+	case '[':
+		return matchClass(pattern[1:], c)
+	case '\\':
+		if len(pattern) > 1 {
+			pattern = pattern[1:]
+		}
+	}
+	return pattern[1:], pattern[0] == c
+}
+
+// matchClass matches c against the class that starts right after '[' and
+// returns the pattern following the closing ']'.
+func matchClass(pattern string, c byte) (string, bool) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		lo := pattern[0]
+		if lo == '\\' && len(pattern) > 1 {
+			pattern = pattern[1:]
+			lo = pattern[0]
+		}
+		pattern = pattern[1:]
+		hi := lo
+		if len(pattern) > 1 && pattern[0] == '-' && pattern[1] != ']' {
+			hi = pattern[1]
+			pattern = pattern[2:]
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	return pattern, matched != negate
+}
@@ -0,0 +1,516 @@
+// Package resp serves a subset of the Redis RESP2 protocol on top of
+// datastore.Db, so redis-cli and Redis client libraries can be used to
+// inspect and drive the db service.
+//
+// Supported commands: PING, GET, SET (with EX/PX), DEL, EXISTS, KEYS, SCAN,
+// INCR, EXPIRE, TTL, AUTH and QUIT. Expiration times are kept in memory
+// only and are lost when the server restarts.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mysteriousgophers/architecture-lab-4/datastore"
+)
+
+const (
+	sweepInterval    = time.Second
+	defaultScanCount = 10
+)
+
+var errSyntax = errors.New("ERR syntax error")
+
+// arity holds the minimum and maximum number of arguments of every
+// command; a maximum of -1 means no limit.
+var arity = map[string][2]int{
+	"PING": {0, 1}, "GET": {1, 1}, "SET": {2, -1}, "DEL": {1, -1}, "EXISTS": {1, -1},
+	"KEYS": {1, 1}, "SCAN": {1, -1}, "INCR": {1, 1}, "EXPIRE": {2, 2}, "TTL": {1, 1},
+	"AUTH": {1, 2},
+}
+
+// AuthFunc checks the password of AUTH. It returns nil for an unknown
+// password, and otherwise a function telling whether the key may be read,
+// or written if write is set.
+type AuthFunc func(password string) func(key string, write bool) bool
+
+// Store is the database served. Commands that only need to know which keys
+// exist, such as EXISTS, KEYS and SCAN, use Has, Keys and KeysPage, which
+// answer without reading values.
+type Store interface {
+	Get(key string) (string, error)
+	Put(key, value string) error
+	Delete(key string) error
+	Has(key string) bool
+	Keys(prefix string) []string
+	KeysPage(cursor uint64, count int) ([]string, uint64)
+	Begin() *datastore.Tx
+}
+
+type Server struct {
+	store Store
+	now   func() time.Time
+	// Auth, if set before Serve, makes every connection authenticate with
+	// AUTH before running other commands. Keys the password does not give
+	// access to cannot be used and are left out of KEYS and SCAN.
+	Auth AuthFunc
+
+	mu       sync.Mutex
+	expires  map[string]time.Time
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	done     chan struct{}
+}
+
+func NewServer(store Store) *Server {
+	return &Server{
+		store:   store,
+		now:     time.Now,
+		expires: make(map[string]time.Time),
+		conns:   make(map[net.Conn]struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Serve accepts connections on l until Close is called.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+	go s.sweepExpired()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	for conn := range s.conns {
+		conn.Close()
+	}
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	sess := &session{}
+	if s.Auth == nil {
+		sess.allowed = allowAll
+	}
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			var netErr net.Error
+			if !errors.As(err, &netErr) && !errors.Is(err, io.EOF) {
+				writeError(w, "ERR Protocol error: "+err.Error())
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := strings.EqualFold(args[0], "QUIT")
+		if quit {
+			writeSimple(w, "OK")
+		} else {
+			s.handle(w, sess, args)
+		}
+		if r.Buffered() == 0 || quit {
+			if err := w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// session is the state of a client connection.
+type session struct {
+	// allowed is nil until the connection authenticates.
+	allowed func(key string, write bool) bool
+}
+
+func allowAll(string, bool) bool { return true }
+
+func (s *Server) handle(w *bufio.Writer, sess *session, args []string) {
+	cmd, args := strings.ToUpper(args[0]), args[1:]
+	if sess.allowed == nil && cmd != "AUTH" {
+		writeError(w, "NOAUTH Authentication required.")
+		return
+	}
+	bounds, ok := arity[cmd]
+	if !ok {
+		writeError(w, "ERR unknown command '"+strings.ToLower(cmd)+"'")
+		return
+	}
+	if len(args) < bounds[0] || bounds[1] >= 0 && len(args) > bounds[1] {
+		writeError(w, "ERR wrong number of arguments for '"+strings.ToLower(cmd)+"' command")
+		return
+	}
+	if !permitted(sess, cmd, args) {
+		writeError(w, "NOPERM No permissions to access a key")
+		return
+	}
+
+	switch cmd {
+	case "AUTH":
+		s.auth(w, sess, args[len(args)-1])
+	case "PING":
+		if len(args) > 0 {
+			writeBulk(w, args[0])
+		} else {
+			writeSimple(w, "PONG")
+		}
+	case "GET":
+		value, err := s.get(args[0])
+		if errors.Is(err, datastore.ErrNotFound) {
+			writeNull(w)
+		} else if err != nil {
+			writeError(w, "ERR "+err.Error())
+		} else {
+			writeBulk(w, value)
+		}
+	case "SET":
+		s.set(w, args)
+	case "DEL":
+		s.count(w, args, true)
+	case "EXISTS":
+		s.count(w, args, false)
+	case "KEYS":
+		writeBulkArray(w, s.keys(sess, args[0]))
+	case "SCAN":
+		s.scan(w, sess, args)
+	case "INCR":
+		s.incr(w, args[0])
+	case "EXPIRE":
+		s.expire(w, args[0], args[1])
+	case "TTL":
+		s.ttl(w, args[0])
+	}
+}
+
+// auth authenticates the connection. The user name AUTH may come with is
+// ignored.
+func (s *Server) auth(w *bufio.Writer, sess *session, password string) {
+	if s.Auth == nil {
+		writeError(w, "ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+		return
+	}
+	allowed := s.Auth(password)
+	if allowed == nil {
+		writeError(w, "WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+	sess.allowed = allowed
+	writeSimple(w, "OK")
+}
+
+// permitted checks the access of the session to the keys cmd is given.
+func permitted(sess *session, cmd string, args []string) bool {
+	var keys []string
+	write := false
+	switch cmd {
+	case "GET", "TTL":
+		keys = args[:1]
+	case "EXISTS":
+		keys = args
+	case "SET", "INCR", "EXPIRE":
+		keys, write = args[:1], true
+	case "DEL":
+		keys, write = args, true
+	}
+	for _, key := range keys {
+		if !sess.allowed(key, write) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) set(w *bufio.Writer, args []string) {
+	key, value := args[0], args[1]
+	var ttl time.Duration
+	for opts := args[2:]; len(opts) > 0; opts = opts[2:] {
+		if len(opts) < 2 {
+			writeError(w, errSyntax.Error())
+			return
+		}
+		n, err := strconv.ParseInt(opts[1], 10, 64)
+		if err != nil || n <= 0 {
+			writeError(w, "ERR invalid expire time in 'set' command")
+			return
+		}
+		switch strings.ToUpper(opts[0]) {
+		case "EX":
+			ttl = time.Duration(n) * time.Second
+		case "PX":
+			ttl = time.Duration(n) * time.Millisecond
+		default:
+			writeError(w, errSyntax.Error())
+			return
+		}
+	}
+
+	if err := s.store.Put(key, value); err != nil {
+		writeError(w, "ERR "+err.Error())
+		return
+	}
+	s.mu.Lock()
+	if ttl > 0 {
+		s.expires[key] = s.now().Add(ttl)
+	} else {
+		delete(s.expires, key)
+	}
+	s.mu.Unlock()
+	writeSimple(w, "OK")
+}
+
+// count replies with the number of existing keys among args, deleting them
+// if del is set.
+func (s *Server) count(w *bufio.Writer, keys []string, del bool) {
+	var n int64
+	for _, key := range keys {
+		if !s.exists(key) {
+			continue
+		}
+		if del {
+			if err := s.delete(key); err != nil {
+				writeError(w, "ERR "+err.Error())
+				return
+			}
+		}
+		n++
+	}
+	writeInt(w, n)
+}
+
+func (s *Server) scan(w *bufio.Writer, sess *session, args []string) {
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		writeError(w, "ERR invalid cursor")
+		return
+	}
+	pattern, count := "*", defaultScanCount
+	for opts := args[1:]; len(opts) > 0; opts = opts[2:] {
+		if len(opts) < 2 {
+			writeError(w, errSyntax.Error())
+			return
+		}
+		switch strings.ToUpper(opts[0]) {
+		case "MATCH":
+			pattern = opts[1]
+		case "COUNT":
+			count, err = strconv.Atoi(opts[1])
+			if err != nil || count <= 0 {
+				writeError(w, errSyntax.Error())
+				return
+			}
+		default:
+			writeError(w, errSyntax.Error())
+			return
+		}
+	}
+
+	// The cursor is the key hash a page starts from, see KeysPage. As in
+	// Redis, COUNT limits the keys visited, not the keys returned.
+	s.removeExpired()
+	page, next := s.store.KeysPage(cursor, count)
+	matched := make([]string, 0, len(page))
+	for _, key := range page {
+		if match(pattern, key) && sess.allowed(key, false) {
+			matched = append(matched, key)
+		}
+	}
+
+	writeArrayHeader(w, 2)
+	writeBulk(w, strconv.FormatUint(next, 10))
+	writeBulkArray(w, matched)
+}
+
+func (s *Server) incr(w *bufio.Writer, key string) {
+	s.expireIfNeeded(key)
+	for {
+		tx := s.store.Begin()
+		value, err := tx.Get(key)
+		if errors.Is(err, datastore.ErrNotFound) {
+			value, err = "0", nil
+		}
+		if errors.Is(err, datastore.ErrConflict) {
+			tx.Rollback()
+			continue
+		}
+		if err != nil {
+			tx.Rollback()
+			writeError(w, "ERR "+err.Error())
+			return
+		}
+
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n == 1<<63-1 {
+			tx.Rollback()
+			writeError(w, "ERR value is not an integer or out of range")
+			return
+		}
+		tx.Put(key, strconv.FormatInt(n+1, 10))
+		err = tx.Commit()
+		if errors.Is(err, datastore.ErrConflict) {
+			continue
+		}
+		if err != nil {
+			writeError(w, "ERR "+err.Error())
+			return
+		}
+		writeInt(w, n+1)
+		return
+	}
+}
+
+func (s *Server) expire(w *bufio.Writer, key, seconds string) {
+	n, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		writeError(w, "ERR value is not an integer or out of range")
+		return
+	}
+	if !s.exists(key) {
+		writeInt(w, 0)
+		return
+	}
+	if n <= 0 {
+		if err := s.delete(key); err != nil {
+			writeError(w, "ERR "+err.Error())
+			return
+		}
+		writeInt(w, 1)
+		return
+	}
+	s.mu.Lock()
+	s.expires[key] = s.now().Add(time.Duration(n) * time.Second)
+	s.mu.Unlock()
+	writeInt(w, 1)
+}
+
+func (s *Server) ttl(w *bufio.Writer, key string) {
+	if !s.exists(key) {
+		writeInt(w, -2)
+		return
+	}
+	s.mu.Lock()
+	deadline, ok := s.expires[key]
+	s.mu.Unlock()
+	if !ok {
+		writeInt(w, -1)
+		return
+	}
+	writeInt(w, int64((deadline.Sub(s.now())+time.Second-1)/time.Second))
+}
+
+func (s *Server) get(key string) (string, error) {
+	s.expireIfNeeded(key)
+	return s.store.Get(key)
+}
+
+func (s *Server) exists(key string) bool {
+	s.expireIfNeeded(key)
+	return s.store.Has(key)
+}
+
+func (s *Server) delete(key string) error {
+	s.mu.Lock()
+	delete(s.expires, key)
+	s.mu.Unlock()
+	return s.store.Delete(key)
+}
+
+func (s *Server) keys(sess *session, pattern string) []string {
+	s.removeExpired()
+	var keys []string
+	for _, key := range s.store.Keys("") {
+		if match(pattern, key) && sess.allowed(key, false) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (s *Server) expireIfNeeded(key string) {
+	s.mu.Lock()
+	deadline, ok := s.expires[key]
+	expired := ok && !s.now().Before(deadline)
+	if expired {
+		delete(s.expires, key)
+	}
+	s.mu.Unlock()
+	if expired {
+		if err := s.store.Delete(key); err != nil {
+			log.Printf("Cannot delete expired key %s: %s", key, err)
+		}
+	}
+}
+
+func (s *Server) removeExpired() {
+	s.mu.Lock()
+	var expired []string
+	for key, deadline := range s.expires {
+		if !s.now().Before(deadline) {
+			expired = append(expired, key)
+		}
+	}
+	s.mu.Unlock()
+	for _, key := range expired {
+		s.expireIfNeeded(key)
+	}
+}
+
+func (s *Server) sweepExpired() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.removeExpired()
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mysteriousgophers/architecture-lab-4/datastore"
+)
+
+type rawClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func createTestClient(t *testing.T) (*rawClient, *Server) {
+	t.Helper()
+	server, addr := createTestServer(t, nil)
+	return dialTestClient(t, addr), server
+}
+
+func createTestServer(t *testing.T, auth AuthFunc) (*Server, string) {
+	t.Helper()
+	db, err := datastore.NewDb(t.TempDir(), 4096)
+	if err != nil {
+		t.Fatalf("Failed to create db: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(db)
+	server.Auth = auth
+	go server.Serve(l)
+	t.Cleanup(func() {
+		server.Close()
+		db.Close()
+	})
+	return server, l.Addr().String()
+}
+
+func dialTestClient(t *testing.T, addr string) *rawClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return &rawClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do sends the command as a RESP array and returns the raw reply with
+// "\r\n" replaced by spaces.
+func (c *rawClient) do(args ...string) string {
+	c.t.Helper()
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(cmd)); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.readReply()
+}
+
+func (c *rawClient) readReply() string {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	reply := strings.TrimRight(line, "\r\n")
+	switch line[0] {
+	case '$':
+		if reply != "$-1" {
+			data, err := c.r.ReadString('\n')
+			if err != nil {
+				c.t.Fatal(err)
+			}
+			reply += " " + strings.TrimRight(data, "\r\n")
+		}
+	case '*':
+		var n int
+		fmt.Sscanf(reply, "*%d", &n)
+		for i := 0; i < n; i++ {
+			reply += " " + c.readReply()
+		}
+	}
+	return reply
+}
+
+func TestServer_Commands(t *testing.T) {
+	c, _ := createTestClient(t)
+
+	tests := []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"ping", "hi"}, "$2 hi"},
+		{[]string{"GET", "a"}, "$-1"},
+		{[]string{"SET", "a", "hello"}, "+OK"},
+		{[]string{"GET", "a"}, "$5 hello"},
+		{[]string{"SET", "b", "1"}, "+OK"},
+		{[]string{"EXISTS", "a", "b", "c"}, ":2"},
+		{[]string{"INCR", "b"}, ":2"},
+		{[]string{"INCR", "counter"}, ":1"},
+		{[]string{"INCR", "a"}, "-ERR value is not an integer or out of range"},
+		{[]string{"KEYS", "*"}, "*3 $1 a $1 b $7 counter"},
+		{[]string{"KEYS", "c[a-z]*"}, "*1 $7 counter"},
+		{[]string{"SCAN", "0", "MATCH", "?"}, "*2 $1 0 *2 $1 a $1 b"},
+		{[]string{"DEL", "a", "missing"}, ":1"},
+		{[]string{"GET", "a"}, "$-1"},
+		{[]string{"TTL", "b"}, ":-1"},
+		{[]string{"EXPIRE", "b", "100"}, ":1"},
+		{[]string{"TTL", "b"}, ":100"},
+		{[]string{"EXPIRE", "missing", "100"}, ":0"},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command"},
+		{[]string{"FLUSHALL"}, "-ERR unknown command 'flushall'"},
+	}
+	for _, tc := range tests {
+		if reply := c.do(tc.args...); reply != tc.reply {
+			t.Errorf("%v: expected %q, got %q", tc.args, tc.reply, reply)
+		}
+	}
+}
+
+func TestServer_Auth(t *testing.T) {
+	_, addr := createTestServer(t, func(password string) func(key string, write bool) bool {
+		switch password {
+		case "admin":
+			return func(string, bool) bool { return true }
+		case "secret":
+			return func(key string, write bool) bool {
+				return strings.HasPrefix(key, "team:") || !write && key == "shared"
+			}
+		}
+		return nil
+	})
+	admin := dialTestClient(t, addr)
+	admin.do("AUTH", "admin")
+	admin.do("SET", "shared", "1")
+	admin.do("SET", "private", "1")
+	c := dialTestClient(t, addr)
+
+	tests := []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"PING"}, "-NOAUTH Authentication required."},
+		{[]string{"GET", "team:a"}, "-NOAUTH Authentication required."},
+		{[]string{"AUTH", "wrong"}, "-WRONGPASS invalid username-password pair or user is disabled."},
+		{[]string{"AUTH", "default", "secret"}, "+OK"},
+		{[]string{"SET", "team:a", "1"}, "+OK"},
+		{[]string{"SET", "other", "1"}, "-NOPERM No permissions to access a key"},
+		{[]string{"SET", "shared", "1"}, "-NOPERM No permissions to access a key"},
+		{[]string{"DEL", "team:a", "shared"}, "-NOPERM No permissions to access a key"},
+		{[]string{"GET", "private"}, "-NOPERM No permissions to access a key"},
+		{[]string{"EXISTS", "team:a", "shared"}, ":2"},
+		{[]string{"KEYS", "*"}, "*2 $6 shared $6 team:a"},
+		{[]string{"SCAN", "0", "MATCH", "p*"}, "*2 $1 0 *0"},
+	}
+	for _, tc := range tests {
+		if reply := c.do(tc.args...); reply != tc.reply {
+			t.Errorf("%v: expected %q, got %q", tc.args, tc.reply, reply)
+		}
+	}
+
+	if reply := c.do("QUIT"); reply != "+OK" {
+		t.Errorf("Unexpected QUIT reply %q", reply)
+	}
+	unauthenticated, _ := createTestClient(t)
+	if reply := unauthenticated.do("AUTH", "secret"); !strings.HasPrefix(reply, "-ERR AUTH <password> called without any password") {
+		t.Errorf("AUTH without a password configured replied %q", reply)
+	}
+}
+
+func TestServer_Scan(t *testing.T) {
+	c, _ := createTestClient(t)
+	for i := 0; i < 20; i++ {
+		c.do("SET", "key"+strconv.Itoa(i), "value")
+	}
+
+	seen := make(map[string]bool)
+	cursor := "0"
+	for pages := 0; ; pages++ {
+		if pages > 20 {
+			t.Fatal("SCAN does not finish")
+		}
+		reply := strings.Fields(c.do("SCAN", cursor, "COUNT", "3"))
+		// *2 $n cursor *n {$n key}
+		cursor = reply[2]
+		for i := 5; i < len(reply); i += 2 {
+			if seen[reply[i]] {
+				t.Errorf("%s was returned twice", reply[i])
+			}
+			seen[reply[i]] = true
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	if len(seen) != 20 {
+		t.Errorf("Expected every key to be scanned, got %d", len(seen))
+	}
+	if reply := c.do("SCAN", "-1"); reply != "-ERR invalid cursor" {
+		t.Errorf("Unexpected reply to an invalid cursor %q", reply)
+	}
+}
+
+func TestServer_ProtocolLimits(t *testing.T) {
+	for _, tc := range []struct{ request, reply string }{
+		{"*2000000\r\n", "-ERR Protocol error: invalid multibulk length"},
+		{"*1\r\n$600000000\r\n", "-ERR Protocol error: invalid bulk length"},
+		{strings.Repeat("a", maxInlineSize), "-ERR Protocol error: too big inline request"},
+		{"*1\r\n$" + strings.Repeat("1", maxInlineSize), "-ERR Protocol error: too big inline request"},
+	} {
+		c, _ := createTestClient(t)
+		if _, err := c.conn.Write([]byte(tc.request)); err != nil {
+			t.Fatal(err)
+		}
+		if reply := c.readReply(); reply != tc.reply {
+			t.Errorf("%.40q: expected %q, got %q", tc.request, tc.reply, reply)
+		}
+	}
+}
+
+func TestServer_Expiration(t *testing.T) {
+	c, server := createTestClient(t)
+
+	var mu sync.Mutex
+	now := time.Now()
+	server.mu.Lock()
+	server.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	server.mu.Unlock()
+
+	c.do("SET", "a", "1", "EX", "10")
+	c.do("SET", "b", "1")
+	c.do("EXPIRE", "b", "5")
+	if reply := c.do("GET", "a"); reply != "$1 1" {
+		t.Fatalf("Key expired too early: %q", reply)
+	}
+
+	mu.Lock()
+	now = now.Add(6 * time.Second)
+	mu.Unlock()
+	if reply := c.do("EXISTS", "a", "b"); reply != ":1" {
+		t.Errorf("Expected only one key to survive, got %q", reply)
+	}
+	if reply := c.do("KEYS", "*"); reply != "*1 $1 a" {
+		t.Errorf("Expired key is listed: %q", reply)
+	}
+
+	c.do("SET", "a", "2")
+	mu.Lock()
+	now = now.Add(time.Minute)
+	mu.Unlock()
+	if reply := c.do("GET", "a"); reply != "$1 2" {
+		t.Errorf("SET did not clear the expiration: %q", reply)
+	}
+}
+
+func TestServer_InlineAndPipelinedCommands(t *testing.T) {
+	c, _ := createTestClient(t)
+
+	if _, err := c.conn.Write([]byte("SET x 1\r\nINCR x\r\nPING\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"+OK", ":2", "+PONG"} {
+		if reply := c.readReply(); reply != expected {
+			t.Errorf("Expected %q, got %q", expected, reply)
+		}
+	}
+	if reply := c.do("QUIT"); reply != "+OK" {
+		t.Errorf("Unexpected QUIT reply %q", reply)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		matched    bool
+	}{
+		{"*", "anything", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"user:*:name", "user:42:name", true},
+		{"*a*b", "xaxxb", true},
+		{"a*", "", false},
+		{"*", "", true},
+		{"*?", "", false},
+		{`*\*`, "ab*", true},
+		{strings.Repeat("*a", 12) + "b", strings.Repeat("a", 40), false},
+	}
+	for _, tc := range tests {
+		if matched := match(tc.pattern, tc.s); matched != tc.matched {
+			t.Errorf("match(%q, %q) = %t, expected %t", tc.pattern, tc.s, matched, tc.matched)
+		}
+	}
+}